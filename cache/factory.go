@@ -2,22 +2,44 @@
 package cache
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"sync"
 	"time"
 
 	"github.com/agravelot/imageopti/config"
 )
 
+// ErrNotFound is returned by Get when no valid entry exists for the key,
+// any other error means the cache system itself is failing.
+var ErrNotFound = errors.New("cache entry not found")
+
 // Cache Define cache system interface.
 type Cache interface {
-	Get(key string) ([]byte, error)
-	Set(key string, val []byte, expiry time.Duration) error
+	// Get return cached value of given key, or an error wrapping ErrNotFound on cache miss.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set store given value, a non positive expiry never expires.
+	Set(ctx context.Context, key string, val []byte, expiry time.Duration) error
+	// Delete remove given key, deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// Stats return usage counters.
+	Stats() Stats
+	// Close release resources, like background goroutines.
+	Close() error
+}
+
+// Stats hold cache usage counters.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int64
+	Bytes     int64
 }
 
 const defaultCacheExpiry = 100 * time.Second
 
-// New is the cache factory to instantiate a new instance of cache.
+// New is the cache factory to instantiate a new instance of cache, drivers are resolved from RegisterCache.
 func New(conf config.Config) (Cache, error) {
 	// if conf.Processor == "redis" {
 	// 	opt, err := redis.ParseURL(conf.Redis.URL)
@@ -32,20 +54,15 @@ func New(conf config.Config) (Cache, error) {
 	// 	}, nil
 	// }
 
-	if conf.Cache == "file" {
-		return newFileCache(conf.File.Path, defaultCacheExpiry)
-	}
-
-	if conf.Cache == "memory" {
-		return &MemoryCache{
-			m:   map[string][]byte{},
-			mtx: sync.RWMutex{},
-		}, nil
+	name := conf.Cache
+	if name == "" {
+		name = "none"
 	}
 
-	if conf.Cache == "none" || conf.Cache == "" {
-		return &NoneCache{}, nil
+	factory, ok := lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unable to resolve given cache %s", conf.Cache)
 	}
 
-	return nil, fmt.Errorf("unable to resolve given cache %s", conf.Cache)
+	return factory(conf, conf.Drivers[name])
 }
@@ -1,8 +1,10 @@
 package cache_test
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/agravelot/imageopti/cache"
 	"github.com/agravelot/imageopti/config"
@@ -60,3 +62,53 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+type customCache struct {
+	cache.NoneCache
+	Prefix string `json:"prefix"`
+}
+
+func TestRegisterCache(t *testing.T) {
+	// Registrations last for the whole process, a unique name allows running tests several times.
+	name := fmt.Sprintf("custom-test-%d", time.Now().UnixNano())
+
+	cache.RegisterCache(name, func(_ config.Config, settings map[string]interface{}) (cache.Cache, error) {
+		c := &customCache{}
+		if err := config.DecodeSettings(settings, c); err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	})
+
+	got, err := cache.New(config.Config{
+		Cache: name,
+		Drivers: map[string]map[string]interface{}{
+			name: {"prefix": "images"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+
+	c, ok := got.(*customCache)
+	if !ok {
+		t.Fatalf("New() = %T, want *customCache", got)
+	}
+
+	if c.Prefix != "images" {
+		t.Errorf("New() settings prefix = %s, want images", c.Prefix)
+	}
+}
+
+func TestRegisterCache_Duplicate(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("RegisterCache() must panic on duplicate driver")
+		}
+	}()
+
+	cache.RegisterCache("memory", func(_ config.Config, _ map[string]interface{}) (cache.Cache, error) {
+		return &cache.NoneCache{}, nil
+	})
+}
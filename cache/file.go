@@ -3,28 +3,42 @@ package cache
 // Original source : https://github.com/traefik/plugin-simplecache
 
 import (
-	"encoding/binary"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/agravelot/imageopti/config"
 )
 
-var errCacheMiss = errors.New("cache miss")
+const (
+	tempFileSuffix = ".tmp"
+	tempFileMaxAge = 10 * time.Minute
+	// accessPersistInterval throttle access time updates on disk.
+	accessPersistInterval = time.Minute
+)
 
 type fileCache struct {
-	path string
-	pm   *pathMutex
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	path  string
+	index *fileIndex
+	store *fileStore
+	once  sync.Once
 }
 
-func newFileCache(path string, vacuum time.Duration) (*fileCache, error) {
-	info, err := os.Stat(path)
+func newFileCache(conf config.FileCacheConfig) (*fileCache, error) {
+	info, err := os.Stat(conf.Path)
 	if err != nil {
 		return nil, fmt.Errorf("invalid cache path: %w", err)
 	}
@@ -33,138 +47,272 @@ func newFileCache(path string, vacuum time.Duration) (*fileCache, error) {
 		return nil, errors.New("path must be a directory")
 	}
 
-	fc := &fileCache{
-		path: path,
-		pm:   &pathMutex{lock: map[string]*fileLock{}},
+	if conf.MaxBytes < 0 || conf.MaxFiles < 0 {
+		return nil, errors.New("file cache quota cannot be negative")
 	}
 
-	go fc.vacuum(vacuum)
+	interval := defaultCacheExpiry
 
-	return fc, nil
-}
+	if conf.VacuumInterval != "" {
+		interval, err = time.ParseDuration(conf.VacuumInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file cache vacuum interval: %w", err)
+		}
 
-func (c *fileCache) vacuum(interval time.Duration) {
-	timer := time.NewTicker(interval)
-	defer timer.Stop()
+		if interval <= 0 {
+			return nil, errors.New("file cache vacuum interval must be positive")
+		}
+	}
 
-	for range timer.C {
-		_ = filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
-			switch {
-			case err != nil:
-				return err
-			case info.IsDir():
-				return nil
-			}
+	rate := conf.VacuumRate
 
-			mu := c.pm.MutexAt(filepath.Base(path))
-			mu.Lock()
-			defer mu.Unlock()
+	switch {
+	case rate < 0:
+		return nil, errors.New("file cache vacuum rate cannot be negative")
+	case rate == 0:
+		rate = defaultVacuumRate
+	}
 
-			// Get the expiry.
-			var t [8]byte
-			f, err := os.Open(filepath.Clean(path))
-			if err != nil {
-				// Just skip the file in this case.
-				return nil
-			}
-			if n, err := f.Read(t[:]); err != nil && n != 8 {
-				return nil
-			}
-			_ = f.Close()
+	store, err := acquireFileStore(conf.Path, fileStoreOptions{
+		maxBytes:       conf.MaxBytes,
+		maxFiles:       conf.MaxFiles,
+		vacuumInterval: interval,
+		vacuumRate:     rate,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			expires := time.Unix(int64(binary.LittleEndian.Uint64(t[:])), 0)
-			if !expires.Before(time.Now()) {
-				return nil
-			}
+	return &fileCache{
+		path:  store.path,
+		index: store.index,
+		store: store,
+	}, nil
+}
 
-			// Delete the file.
-			_ = os.Remove(path)
-			return nil
-		})
-	}
+// Close release this instance, the vacuum stops once every instance sharing the directory is closed.
+func (c *fileCache) Close() error {
+	c.once.Do(c.store.release)
+
+	return nil
 }
 
-func (c *fileCache) Get(key string) ([]byte, error) {
-	mu := c.pm.MutexAt(key)
-	mu.RLock()
-	defer mu.RUnlock()
+func (c *fileCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	p := keyPath(c.path, key)
+
+	// Lock-free, entries are replaced atomically.
 	if info, err := os.Stat(p); err != nil || info.IsDir() {
-		return nil, errCacheMiss
+		c.index.remove(p)
+		atomic.AddUint64(&c.misses, 1)
+		return nil, ErrNotFound
 	}
 
 	b, err := ioutil.ReadFile(filepath.Clean(p))
+	if os.IsNotExist(err) {
+		// Evicted or vacuumed since checked above.
+		c.index.remove(p)
+		atomic.AddUint64(&c.misses, 1)
+		return nil, ErrNotFound
+	}
+
 	if err != nil {
 		return nil, fmt.Errorf("error reading file %q: %w", p, err)
 	}
 
-	expires := time.Unix(int64(binary.LittleEndian.Uint64(b[:8])), 0)
-	if expires.Before(time.Now()) {
-		_ = os.Remove(p)
-		return nil, errCacheMiss
+	h, storedKey, body, err := decodeFileEntry(b)
+	if err != nil || h.expired(time.Now()) {
+		// Expired, torn or corrupted entry, it will be rewritten on next miss.
+		c.store.removeIfStale(ctx, p)
+		atomic.AddUint64(&c.misses, 1)
+		return nil, ErrNotFound
+	}
+
+	if storedKey != key {
+		// Hash collision, the entry belongs to another key.
+		atomic.AddUint64(&c.misses, 1)
+		return nil, ErrNotFound
 	}
 
-	return b[8:], nil
+	if last, ok := c.index.touch(p); !ok {
+		c.index.add(p, int64(len(b)))
+	} else if time.Since(last) > accessPersistInterval {
+		// Keep access time on disk so the eviction order survives restarts.
+		now := time.Now()
+		_ = os.Chtimes(p, now, now)
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+
+	return body, nil
 }
 
-func (c *fileCache) Set(key string, val []byte, expiry time.Duration) error {
-	mu := c.pm.MutexAt(key)
-	mu.Lock()
-	defer mu.Unlock()
+// evict delete the entry file at given path once locked.
+func (c *fileCache) evict(ctx context.Context, p string) error {
+	unlock, err := c.store.lock(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	// A vacuum pass may have indexed the victim again meanwhile.
+	c.index.remove(p)
+
+	return nil
+}
+
+func (c *fileCache) Set(ctx context.Context, key string, val []byte, expiry time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var expires time.Time
+	if expiry > 0 {
+		expires = time.Now().Add(expiry)
+	}
 
 	p := keyPath(c.path, key)
+	h := encodeFileEntryHeader(key, expires, val)
+	size := int64(len(h) + len(val))
+
+	if !c.index.fits(size) {
+		return nil
+	}
+
+	// Evict before locking given path, locking several paths at once could deadlock.
+	for _, v := range c.index.victims(p, size) {
+		err := c.evict(ctx, v.path)
+
+		switch {
+		case err == nil:
+			atomic.AddUint64(&c.evictions, 1)
+		case !os.IsNotExist(err):
+			// The file is still on disk, keep accounting for it.
+			c.index.restore(v)
+		}
+	}
+
 	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
 		return fmt.Errorf("error creating file path: %w", err)
 	}
 
-	f, err := os.OpenFile(filepath.Clean(p), os.O_RDWR|os.O_CREATE, 0600)
+	unlock, err := c.store.lock(ctx, p)
 	if err != nil {
-		return fmt.Errorf("error creating file: %w", err)
+		return err
 	}
+	defer unlock()
 
-	defer func() {
-		_ = f.Close()
-	}()
+	if err := writeFileAtomic(p, h, val); err != nil {
+		return err
+	}
+
+	c.index.add(p, size)
 
-	timestamp := uint64(time.Now().Add(expiry).Unix())
+	return nil
+}
 
-	var t [8]byte
+// Delete remove entry of given key.
+func (c *fileCache) Delete(ctx context.Context, key string) error {
+	p := keyPath(c.path, key)
 
-	binary.LittleEndian.PutUint64(t[:], timestamp)
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		c.index.remove(p)
+		return nil
+	}
 
-	if _, err = f.Write(t[:]); err != nil {
-		return fmt.Errorf("error writing file: %w", err)
+	unlock, err := c.store.lock(ctx, p)
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	if _, err = f.Write(val); err != nil {
-		return fmt.Errorf("error writing file: %w", err)
+	if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing file: %w", err)
 	}
 
+	c.index.remove(p)
+
 	return nil
 }
 
-func keyHash(key string) [4]byte {
-	h := crc32.Checksum([]byte(key), crc32.IEEETable)
+// Stats return cache usage counters, including current disk usage.
+func (c *fileCache) Stats() Stats {
+	bytes, files := c.index.usage()
+
+	return Stats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Entries:   int64(files),
+		Bytes:     bytes,
+	}
+}
 
-	var b [4]byte
+// writeFileAtomic write given chunks into a temporary file of the same directory,
+// flush it to disk, then rename it over the destination so readers never see a partial file.
+func writeFileAtomic(p string, chunks ...[]byte) (err error) {
+	dir := filepath.Dir(p)
 
-	binary.LittleEndian.PutUint32(b[:], h)
+	f, err := ioutil.TempFile(dir, filepath.Base(p)+".*"+tempFileSuffix)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	for _, c := range chunks {
+		if _, err = f.Write(c); err != nil {
+			return fmt.Errorf("error writing file: %w", err)
+		}
+	}
+
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("error syncing file: %w", err)
+	}
+
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("error closing file: %w", err)
+	}
+
+	if err = os.Rename(f.Name(), p); err != nil {
+		return fmt.Errorf("error renaming file: %w", err)
+	}
+
+	// Persist the rename itself, not supported on every platform.
+	if d, dirErr := os.Open(filepath.Clean(dir)); dirErr == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+
+	return nil
+}
 
-	return b
+func isTempFile(path string) bool {
+	return strings.HasSuffix(path, tempFileSuffix)
 }
 
+// keyPath return entry location for given key, named after its SHA-256 so any key maps
+// to a fixed length name confined to the cache directory.
 func keyPath(path, key string) string {
-	h := keyHash(key)
-	key = strings.NewReplacer("/", "-", ":", "_").Replace(key)
+	h := sha256.Sum256([]byte(key))
 
 	return filepath.Join(
 		path,
 		hex.EncodeToString(h[0:1]),
 		hex.EncodeToString(h[1:2]),
-		hex.EncodeToString(h[2:3]),
-		hex.EncodeToString(h[3:4]),
-		key,
+		hex.EncodeToString(h[:]),
 	)
 }
 
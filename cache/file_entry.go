@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// On-disk entry layout, all integers are little endian:
+//
+//	magic    [4]byte
+//	version  uint16
+//	expires  int64 (unix seconds, zero never expires)
+//	keyLen   uint32
+//	length   uint64 (body length)
+//	checksum uint32 (crc32 castagnoli of key and body)
+//	key      [keyLen]byte
+//	body     [length]byte
+const (
+	fileEntryMagic      = "IOPC"
+	fileEntryVersion    = 2
+	fileEntryHeaderSize = 4 + 2 + 8 + 4 + 8 + 4
+)
+
+var errInvalidEntry = errors.New("invalid cache entry")
+
+// checksum return the crc32 castagnoli of given key and body.
+func checksum(key string, body []byte) uint32 {
+	// The table is computed once by the crc32 package.
+	table := crc32.MakeTable(crc32.Castagnoli)
+
+	return crc32.Update(crc32.Checksum([]byte(key), table), table, body)
+}
+
+type fileEntryHeader struct {
+	expires  time.Time // Zero never expires.
+	keyLen   uint32
+	length   uint64
+	checksum uint32
+}
+
+// expired report whether entry expired at given time.
+func (h fileEntryHeader) expired(now time.Time) bool {
+	return !h.expires.IsZero() && h.expires.Before(now)
+}
+
+// encodeFileEntryHeader return the fixed header followed by the key, the body is written after it.
+// A zero expires never expires.
+func encodeFileEntryHeader(key string, expires time.Time, body []byte) []byte {
+	b := make([]byte, fileEntryHeaderSize+len(key))
+
+	var unix int64
+	if !expires.IsZero() {
+		unix = expires.Unix()
+	}
+
+	crc := checksum(key, body)
+
+	copy(b[0:4], fileEntryMagic)
+	binary.LittleEndian.PutUint16(b[4:6], fileEntryVersion)
+	binary.LittleEndian.PutUint64(b[6:14], uint64(unix))
+	binary.LittleEndian.PutUint32(b[14:18], uint32(len(key)))
+	binary.LittleEndian.PutUint64(b[18:26], uint64(len(body)))
+	binary.LittleEndian.PutUint32(b[26:30], crc)
+	copy(b[fileEntryHeaderSize:], key)
+
+	return b
+}
+
+// decodeFileEntryHeader parse fixed header without verifying key and body.
+func decodeFileEntryHeader(b []byte) (fileEntryHeader, error) {
+	if len(b) < fileEntryHeaderSize {
+		return fileEntryHeader{}, fmt.Errorf("%w: truncated header", errInvalidEntry)
+	}
+
+	if string(b[0:4]) != fileEntryMagic {
+		return fileEntryHeader{}, fmt.Errorf("%w: bad magic number", errInvalidEntry)
+	}
+
+	if v := binary.LittleEndian.Uint16(b[4:6]); v != fileEntryVersion {
+		return fileEntryHeader{}, fmt.Errorf("%w: unsupported version %d", errInvalidEntry, v)
+	}
+
+	h := fileEntryHeader{
+		keyLen:   binary.LittleEndian.Uint32(b[14:18]),
+		length:   binary.LittleEndian.Uint64(b[18:26]),
+		checksum: binary.LittleEndian.Uint32(b[26:30]),
+	}
+
+	if unix := int64(binary.LittleEndian.Uint64(b[6:14])); unix != 0 {
+		h.expires = time.Unix(unix, 0)
+	}
+
+	return h, nil
+}
+
+// decodeFileEntry parse and verify a whole entry, returning its header, original key and body.
+func decodeFileEntry(b []byte) (fileEntryHeader, string, []byte, error) {
+	h, err := decodeFileEntryHeader(b)
+	if err != nil {
+		return h, "", nil, err
+	}
+
+	rest := b[fileEntryHeaderSize:]
+	if uint64(len(rest)) != uint64(h.keyLen)+h.length {
+		return h, "", nil, fmt.Errorf("%w: expected %d bytes, got %d", errInvalidEntry, uint64(h.keyLen)+h.length, len(rest))
+	}
+
+	if checksum(string(rest[:h.keyLen]), rest[h.keyLen:]) != h.checksum {
+		return h, "", nil, fmt.Errorf("%w: checksum mismatch", errInvalidEntry)
+	}
+
+	return h, string(rest[:h.keyLen]), rest[h.keyLen:], nil
+}
@@ -0,0 +1,209 @@
+package cache
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fileIndex track size and last access of each file cache entry to enforce disk quota.
+// Entries are kept ordered from the most to the least recently used.
+type fileIndex struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	bytes    int64
+	maxBytes int64 // Zero means unlimited.
+	maxFiles int   // Zero means unlimited.
+}
+
+type fileIndexEntry struct {
+	path       string
+	size       int64
+	lastAccess time.Time
+}
+
+func newFileIndex(maxBytes int64, maxFiles int) *fileIndex {
+	return &fileIndex{
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+	}
+}
+
+// load walk given directory and index every cache entry, using modification time as last access.
+func (idx *fileIndex) load(root string) error {
+	var found []fileIndexEntry
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case info.IsDir(), isTempFile(path), isLockFile(path):
+			return nil
+		}
+
+		found = append(found, fileIndexEntry{path: path, size: info.Size(), lastAccess: info.ModTime()})
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].lastAccess.After(found[j].lastAccess)
+	})
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for i := range found {
+		e := found[i]
+		idx.entries[e.path] = idx.lru.PushBack(&e)
+		idx.bytes += e.size
+	}
+
+	return nil
+}
+
+// add index given path as most recently used, replacing any previous record.
+func (idx *fileIndex) add(path string, size int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(path)
+
+	idx.entries[path] = idx.lru.PushFront(&fileIndexEntry{path: path, size: size, lastAccess: time.Now()})
+	idx.bytes += size
+}
+
+// touch mark given path as most recently used and return its previous access time.
+func (idx *fileIndex) touch(path string) (time.Time, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	el, ok := idx.entries[path]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	e := el.Value.(*fileIndexEntry)
+	last := e.lastAccess
+	e.lastAccess = time.Now()
+	idx.lru.MoveToFront(el)
+
+	return last, true
+}
+
+func (idx *fileIndex) remove(path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(path)
+}
+
+func (idx *fileIndex) removeLocked(path string) {
+	el, ok := idx.entries[path]
+	if !ok {
+		return
+	}
+
+	idx.bytes -= el.Value.(*fileIndexEntry).size
+	idx.lru.Remove(el)
+	delete(idx.entries, path)
+}
+
+// setLimits update quotas, applied on next write.
+func (idx *fileIndex) setLimits(maxBytes int64, maxFiles int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.maxBytes = maxBytes
+	idx.maxFiles = maxFiles
+}
+
+// fits report whether an entry of given size can be stored at all.
+func (idx *fileIndex) fits(size int64) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.maxBytes == 0 || size <= idx.maxBytes
+}
+
+// victims return least recently used entries to delete so that writing size bytes at given path stays within quota.
+// Returned entries are already removed from the index, so that concurrent writes pick other ones, callers restore
+// those they fail to delete.
+func (idx *fileIndex) victims(path string, size int64) []fileIndexEntry {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	bytes, files := idx.bytes+size, len(idx.entries)+1
+
+	if el, ok := idx.entries[path]; ok {
+		bytes -= el.Value.(*fileIndexEntry).size
+		files--
+	}
+
+	var victims []fileIndexEntry
+
+	for el := idx.lru.Back(); el != nil && idx.over(bytes, files); {
+		prev := el.Prev()
+
+		if e := el.Value.(*fileIndexEntry); e.path != path {
+			bytes -= e.size
+			files--
+
+			victims = append(victims, *e)
+			idx.removeLocked(e.path)
+		}
+
+		el = prev
+	}
+
+	return victims
+}
+
+// adopt index an entry found on disk, written by another process, unless already known. It is considered the least
+// recently used, as this process never served it.
+func (idx *fileIndex) adopt(path string, size int64, modTime time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.entries[path]; ok {
+		return
+	}
+
+	idx.entries[path] = idx.lru.PushBack(&fileIndexEntry{path: path, size: size, lastAccess: modTime})
+	idx.bytes += size
+}
+
+// restore put back given victim which could not be deleted, unless its path was written again meanwhile.
+func (idx *fileIndex) restore(e fileIndexEntry) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.entries[e.path]; ok {
+		return
+	}
+
+	// Victims are the least recently used entries.
+	idx.entries[e.path] = idx.lru.PushBack(&e)
+	idx.bytes += e.size
+}
+
+func (idx *fileIndex) over(bytes int64, files int) bool {
+	return (idx.maxBytes > 0 && bytes > idx.maxBytes) || (idx.maxFiles > 0 && files > idx.maxFiles)
+}
+
+// usage return indexed bytes and files count.
+func (idx *fileIndex) usage() (int64, int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.bytes, len(idx.entries)
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Entries may be shared by several processes mounting the same directory.
+// Reads are lock-free, entries are only ever replaced by rename so a reader always sees a whole file.
+// Mutations (write, removal) hold a lock file created with O_EXCL, which works across processes
+// without relying on flock, unavailable to the plugin interpreter.
+const (
+	lockFileSuffix = ".lock"
+	// lockStaleAge is the age after which a lock is considered abandoned by a crashed process.
+	lockStaleAge   = 30 * time.Second
+	lockTimeout    = 5 * time.Second
+	lockRetryDelay = 5 * time.Millisecond
+)
+
+var errLockTimeout = errors.New("timeout acquiring cache entry lock")
+
+// lockFile acquire the cross-process lock of given entry path, the returned func release it.
+// Lock files hold a nonce, so that a lock broken as stale and acquired by another process is never released by
+// its former owner.
+func lockFile(ctx context.Context, p string) (func(), error) {
+	lp := filepath.Clean(p + lockFileSuffix)
+	nonce := newLockNonce()
+	deadline := time.Now().Add(lockTimeout)
+
+	for {
+		f, err := os.OpenFile(lp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, _ = f.WriteString(nonce)
+			_ = f.Close()
+
+			return func() {
+				if b, err := ioutil.ReadFile(lp); err == nil && string(b) == nonce {
+					_ = os.Remove(lp)
+				}
+			}, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("error creating lock file: %w", err)
+		}
+
+		if info, statErr := os.Stat(lp); statErr == nil && time.Since(info.ModTime()) > lockStaleAge {
+			breakStaleLock(lp, nonce)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: %s", errLockTimeout, p)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryDelay):
+		}
+	}
+}
+
+// breakStaleLock remove given stale lock. It is renamed to a unique name first, so that processes breaking it at once
+// never remove a lock freshly acquired by one of them.
+func breakStaleLock(lp, nonce string) {
+	// Still a lock file, so that vacuum removes it if this process crash meanwhile.
+	broken := lp + "." + nonce + lockFileSuffix
+	if err := os.Rename(lp, broken); err != nil {
+		return
+	}
+
+	// Renaming keep the modification time, inodes may be reused.
+	if info, err := os.Stat(broken); err == nil && time.Since(info.ModTime()) <= lockStaleAge {
+		// Another process acquired the lock in between, give it back unless yet another one did.
+		_ = os.Link(broken, lp)
+	}
+
+	_ = os.Remove(broken)
+}
+
+// newLockNonce return a value unique to a lock acquisition.
+func newLockNonce() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+	}
+
+	return fmt.Sprintf("%d-%x", os.Getpid(), b)
+}
+
+func isLockFile(path string) bool {
+	return strings.HasSuffix(path, lockFileSuffix)
+}
@@ -0,0 +1,290 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultVacuumRate = 1000
+
+var errVacuumStopped = errors.New("vacuum stopped")
+
+// fileStores hold directories in use, Traefik instantiate a new middleware on each configuration
+// reload so caches pointing at the same path must share their locks, index and vacuum worker.
+// Nothing closes dropped middlewares, other caches and processors avoid background goroutines for that reason.
+var fileStores = struct { //nolint:gochecknoglobals // shared by every middleware instance of the process.
+	sync.Mutex
+	m map[string]*fileStore
+}{m: map[string]*fileStore{}}
+
+// fileStore is the state shared by every file cache using the same directory.
+type fileStore struct {
+	path  string
+	pm    *pathMutex
+	index *fileIndex
+
+	mu       sync.Mutex
+	refs     int
+	interval time.Duration
+	rate     int // Files per second, zero means unlimited.
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type fileStoreOptions struct {
+	maxBytes       int64
+	maxFiles       int
+	vacuumInterval time.Duration
+	vacuumRate     int
+}
+
+// acquireFileStore return the store of given directory, creating it and starting its vacuum if needed.
+// Options of the latest caller take precedence.
+func acquireFileStore(path string, opts fileStoreOptions) (*fileStore, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache path: %w", err)
+	}
+
+	fileStores.Lock()
+	defer fileStores.Unlock()
+
+	s, ok := fileStores.m[abs]
+	if !ok {
+		if s, err = newFileStore(path, opts); err != nil {
+			return nil, err
+		}
+
+		fileStores.m[abs] = s
+
+		go s.vacuum()
+	}
+
+	s.index.setLimits(opts.maxBytes, opts.maxFiles)
+
+	s.mu.Lock()
+	s.refs++
+	s.interval = opts.vacuumInterval
+	s.rate = opts.vacuumRate
+	s.mu.Unlock()
+
+	return s, nil
+}
+
+func newFileStore(path string, opts fileStoreOptions) (*fileStore, error) {
+	s := &fileStore{
+		path:  path,
+		pm:    &pathMutex{lock: map[string]*fileLock{}},
+		index: newFileIndex(opts.maxBytes, opts.maxFiles),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	if err := s.index.load(path); err != nil {
+		return nil, fmt.Errorf("unable to index cache path: %w", err)
+	}
+
+	return s, nil
+}
+
+// release drop a reference to the store, the last one stop the vacuum and wait for it.
+func (s *fileStore) release() {
+	fileStores.Lock()
+
+	s.mu.Lock()
+	s.refs--
+	last := s.refs == 0
+	s.mu.Unlock()
+
+	if !last {
+		fileStores.Unlock()
+		return
+	}
+
+	for k, v := range fileStores.m {
+		if v == s {
+			delete(fileStores.m, k)
+		}
+	}
+
+	fileStores.Unlock()
+
+	close(s.stop)
+	<-s.done
+}
+
+func (s *fileStore) settings() (time.Duration, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.interval, s.rate
+}
+
+func (s *fileStore) vacuum() {
+	defer close(s.done)
+
+	for {
+		interval, rate := s.settings()
+
+		timer := time.NewTimer(interval)
+
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := s.vacuumOnce(rate); errors.Is(err, errVacuumStopped) {
+			return
+		}
+	}
+}
+
+// vacuumOnce walk the directory and delete expired, invalid and stale temporary files,
+// checking at most rate files per second.
+func (s *fileStore) vacuumOnce(rate int) error {
+	var throttle <-chan time.Time
+
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+
+		throttle = ticker.C
+	}
+
+	return filepath.Walk(s.path, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case info.IsDir():
+			return nil
+		}
+
+		if err := s.wait(throttle); err != nil {
+			return err
+		}
+
+		s.vacuumFile(path, info)
+
+		return nil
+	})
+}
+
+// wait for given throttle, if any, it return errVacuumStopped once the store is released.
+func (s *fileStore) wait(throttle <-chan time.Time) error {
+	select {
+	case <-s.stop:
+		return errVacuumStopped
+	default:
+	}
+
+	if throttle == nil {
+		return nil
+	}
+
+	select {
+	case <-s.stop:
+		return errVacuumStopped
+	case <-throttle:
+		return nil
+	}
+}
+
+// vacuumFile delete given file if it is an expired or invalid entry, or a stale temporary file.
+func (s *fileStore) vacuumFile(path string, info os.FileInfo) {
+	if isTempFile(path) || isLockFile(path) {
+		// Leftover of an interrupted write or of a crashed process.
+		if time.Since(info.ModTime()) > tempFileMaxAge {
+			_ = os.Remove(path)
+		}
+
+		return
+	}
+
+	// Get the expiry.
+	b := make([]byte, fileEntryHeaderSize)
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		// Just skip the file in this case.
+		return
+	}
+	_, err = io.ReadFull(f, b)
+	_ = f.Close()
+
+	h, decodeErr := decodeFileEntryHeader(b)
+	if err == nil && decodeErr == nil && !h.expired(time.Now()) {
+		// Processes sharing the directory account for each other writes here.
+		s.adopt(path, info)
+
+		return
+	}
+
+	s.removeIfStale(context.Background(), path)
+}
+
+// lock acquire both in-process and cross-process locks of given entry path.
+func (s *fileStore) lock(ctx context.Context, p string) (func(), error) {
+	mu := s.pm.MutexAt(p)
+	mu.Lock()
+
+	unlock, err := lockFile(ctx, p)
+	if err != nil {
+		mu.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		unlock()
+		mu.Unlock()
+	}, nil
+}
+
+// adopt index given valid entry unless it was deleted meanwhile. The in-process path lock keeps it from racing with
+// evictions, which drop victims from the index before deleting them.
+func (s *fileStore) adopt(path string, info os.FileInfo) {
+	mu := s.pm.MutexAt(path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		s.index.adopt(path, info.Size(), info.ModTime())
+	}
+}
+
+// removeIfStale delete entry at given path if it is still expired or invalid once locked,
+// another process may have replaced it meanwhile.
+func (s *fileStore) removeIfStale(ctx context.Context, p string) {
+	unlock, err := s.lock(ctx, p)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	b, err := ioutil.ReadFile(filepath.Clean(p))
+	if os.IsNotExist(err) {
+		s.index.remove(p)
+		return
+	}
+
+	if h, _, _, err := decodeFileEntry(b); err == nil && !h.expired(time.Now()) {
+		return
+	}
+
+	s.remove(p)
+}
+
+// remove delete entry file at given path, must be called with path locks held.
+// The index is updated first, so that a removed file is never still accounted for.
+func (s *fileStore) remove(p string) {
+	s.index.remove(p)
+	_ = os.Remove(p)
+}
@@ -3,13 +3,18 @@ package cache
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/agravelot/imageopti/config"
 )
 
 const testCacheKey = "GETlocalhost:8080/test/path"
@@ -17,24 +22,24 @@ const testCacheKey = "GETlocalhost:8080/test/path"
 func TestFileCache(t *testing.T) {
 	dir := createTempDir(t)
 
-	fc, err := newFileCache(dir, time.Second)
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: dir})
 	if err != nil {
 		t.Errorf("unexpected newFileCache error: %v", err)
 	}
 
-	_, err = fc.Get(testCacheKey)
+	_, err = fc.Get(context.Background(), testCacheKey)
 	if err == nil {
 		t.Error("unexpected cache content")
 	}
 
 	cacheContent := []byte("some random cache content that should be exact")
 
-	err = fc.Set(testCacheKey, cacheContent, time.Second)
+	err = fc.Set(context.Background(), testCacheKey, cacheContent, time.Second)
 	if err != nil {
 		t.Errorf("unexpected cache set error: %v", err)
 	}
 
-	got, err := fc.Get(testCacheKey)
+	got, err := fc.Get(context.Background(), testCacheKey)
 	if err != nil {
 		t.Errorf("unexpected cache get error: %v", err)
 	}
@@ -44,6 +49,485 @@ func TestFileCache(t *testing.T) {
 	}
 }
 
+func TestFileCache_NonPositiveExpiry(t *testing.T) {
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: createTempDir(t)})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	for _, expiry := range []time.Duration{0, -time.Minute} {
+		if err = fc.Set(context.Background(), testCacheKey, []byte("content"), expiry); err != nil {
+			t.Fatalf("unexpected cache set error: %v", err)
+		}
+
+		if got, err := fc.Get(context.Background(), testCacheKey); err != nil || string(got) != "content" {
+			t.Errorf("Get() after expiry %v = %q, %v, want never expiring content", expiry, got, err)
+		}
+	}
+}
+
+func TestFileCache_Delete(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: dir})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if err = fc.Delete(context.Background(), testCacheKey); err != nil {
+		t.Errorf("unexpected delete error on missing key: %v", err)
+	}
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	if err = fc.Delete(context.Background(), testCacheKey); err != nil {
+		t.Fatalf("unexpected delete error: %v", err)
+	}
+
+	if _, err = fc.Get(context.Background(), testCacheKey); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected cache get error: want %v, got %v", ErrNotFound, err)
+	}
+
+	if st := fc.Stats(); st.Entries != 0 || st.Bytes != 0 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestFileCache_CanceledContext(t *testing.T) {
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: createTempDir(t)})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err = fc.Set(ctx, testCacheKey, []byte("content"), time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected cache set error: want %v, got %v", context.Canceled, err)
+	}
+
+	if _, err = fc.Get(ctx, testCacheKey); errors.Is(err, ErrNotFound) || err == nil {
+		t.Errorf("canceled get must not be reported as a miss: %v", err)
+	}
+}
+
+func TestFileCache_OverwriteWithShorterValue(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: dir})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("a rather long cache content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("short"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	got, err := fc.Get(context.Background(), testCacheKey)
+	if err != nil {
+		t.Fatalf("unexpected cache get error: %v", err)
+	}
+
+	if !bytes.Equal(got, []byte("short")) {
+		t.Errorf("unexpected cache content: want short, got %s", got)
+	}
+}
+
+func TestFileCache_InvalidEntries(t *testing.T) {
+	valid := append(encodeFileEntryHeader(testCacheKey, time.Now().Add(time.Minute), []byte("content")), []byte("content")...)
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{name: "should miss on empty file", content: []byte{}},
+		{name: "should miss on truncated header", content: valid[:fileEntryHeaderSize-1]},
+		{name: "should miss on truncated body", content: valid[:len(valid)-1]},
+		{name: "should miss on trailing garbage", content: append(append([]byte{}, valid...), 'x')},
+		{name: "should miss on bad magic", content: append([]byte("XXXX"), valid[4:]...)},
+		{
+			name:    "should miss on corrupted body",
+			content: append(append([]byte{}, valid[:len(valid)-1]...), 'X'),
+		},
+		{
+			name:    "should miss on legacy format",
+			content: append([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, []byte("content")...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := createTempDir(t)
+
+			fc, err := newTestFileCache(t, config.FileCacheConfig{Path: dir})
+			if err != nil {
+				t.Fatalf("unexpected newFileCache error: %v", err)
+			}
+
+			p := keyPath(dir, testCacheKey)
+			if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = ioutil.WriteFile(p, tt.content, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = fc.Get(context.Background(), testCacheKey); !errors.Is(err, ErrNotFound) {
+				t.Errorf("unexpected cache get error: want %v, got %v", ErrNotFound, err)
+			}
+
+			if _, err = os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("invalid entry must be removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestFileCache_KeyCollision(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: dir})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	// Simulate another key stored at the same location.
+	p := keyPath(dir, testCacheKey)
+	if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	other := "GETlocalhost:8080/other/path"
+	content := append(encodeFileEntryHeader(other, time.Now().Add(time.Minute), []byte("content")), []byte("content")...)
+
+	if err = ioutil.WriteFile(p, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fc.Get(context.Background(), testCacheKey); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected cache get error: want %v, got %v", ErrNotFound, err)
+	}
+}
+
+func TestKeyPath(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{name: "should handle regular key", key: testCacheKey},
+		{name: "should handle key longer than NAME_MAX", key: "GET:http:localhost:/" + strings.Repeat("a", 1024)},
+		{name: "should not escape cache directory with dot segments", key: "../../../../etc/passwd"},
+		{name: "should handle NUL bytes", key: "GET:http:localhost:/img\x00.jpeg"},
+		{name: "should handle empty key", key: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := "cache-root"
+			got := keyPath(dir, tt.key)
+
+			rel, err := filepath.Rel(dir, got)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				t.Fatalf("keyPath() = %s escape %s", got, dir)
+			}
+
+			if name := filepath.Base(got); len(name) != 64 || strings.ContainsAny(name, "./\\:\x00") {
+				t.Errorf("keyPath() unexpected file name %q", name)
+			}
+
+			if keyPath(dir, tt.key) != got {
+				t.Error("keyPath() must be deterministic")
+			}
+		})
+	}
+}
+
+func TestFileCache_Quota(t *testing.T) {
+	entrySize := int64(fileEntryHeaderSize + len("a") + len("content"))
+
+	tests := []struct {
+		name string
+		conf config.FileCacheConfig
+	}{
+		{name: "should evict least recently used entry over files quota", conf: config.FileCacheConfig{MaxFiles: 3}},
+		{name: "should evict least recently used entry over bytes quota", conf: config.FileCacheConfig{MaxBytes: 3 * entrySize}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.Path = createTempDir(t)
+
+			fc, err := newTestFileCache(t, tt.conf)
+			if err != nil {
+				t.Fatalf("unexpected newFileCache error: %v", err)
+			}
+
+			setEntries(t, fc, time.Minute, "a", "b", "c")
+
+			// Touch "a" so "b" becomes the least recently used entry.
+			if _, err = fc.Get(context.Background(), "a"); err != nil {
+				t.Fatalf("unexpected cache get error: %v", err)
+			}
+
+			setEntries(t, fc, time.Minute, "d")
+
+			if _, err = fc.Get(context.Background(), "b"); err == nil {
+				t.Error("least recently used entry must be evicted")
+			}
+
+			if _, err = os.Stat(keyPath(tt.conf.Path, "b")); !os.IsNotExist(err) {
+				t.Errorf("evicted entry file must be removed: %v", err)
+			}
+
+			for _, k := range []string{"a", "c", "d"} {
+				if _, err = fc.Get(context.Background(), k); err != nil {
+					t.Errorf("entry %s must be kept: %v", k, err)
+				}
+			}
+
+			st := fc.Stats()
+			if st.Entries != 3 || st.Bytes != 3*entrySize || st.Evictions != 1 {
+				t.Errorf("unexpected stats: %+v", st)
+			}
+		})
+	}
+}
+
+func TestFileCache_QuotaLockedVictim(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: dir, MaxFiles: 1})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	setEntries(t, fc, time.Minute, "a")
+
+	// Another process hold the victim lock past the request deadline.
+	unlock, err := lockFile(context.Background(), keyPath(dir, "a"))
+	if err != nil {
+		t.Fatalf("unexpected lock error: %v", err)
+	}
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_ = fc.Set(ctx, "b", []byte("content"), time.Minute)
+
+	if !fileExists(keyPath(dir, "a")) {
+		t.Fatal("locked victim must not be removed")
+	}
+
+	// The new entry may still be written once the eviction gave up.
+	onDisk := int64(1)
+	if fileExists(keyPath(dir, "b")) {
+		onDisk++
+	}
+
+	if st := fc.Stats(); st.Entries != onDisk || st.Evictions != 0 {
+		t.Errorf("victim left on disk must stay indexed and not be counted as evicted: %+v", st)
+	}
+}
+
+func TestFileCache_QuotaTooLargeEntry(t *testing.T) {
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: createTempDir(t), MaxBytes: 10})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	if _, err = fc.Get(context.Background(), testCacheKey); err == nil {
+		t.Error("entry larger than quota must not be stored")
+	}
+}
+
+func TestFileCache_IndexLoadedAtStartup(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: dir})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	for _, k := range []string{"a", "b"} {
+		if err = fc.Set(context.Background(), k, []byte("content"), time.Minute); err != nil {
+			t.Fatalf("unexpected cache set error: %v", err)
+		}
+	}
+
+	_ = fc.Close()
+
+	// Make "a" the oldest entry on disk.
+	old := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(keyPath(dir, "a"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	fc, err = newTestFileCache(t, config.FileCacheConfig{Path: dir, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if st := fc.Stats(); st.Entries != 2 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	if err = fc.Set(context.Background(), "c", []byte("content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	if _, err = fc.Get(context.Background(), "a"); err == nil {
+		t.Error("oldest entry must be evicted")
+	}
+
+	if _, err = fc.Get(context.Background(), "b"); err != nil {
+		t.Errorf("unexpected cache get error: %v", err)
+	}
+}
+
+func TestNewFileCache_InvalidConfig(t *testing.T) {
+	dir := createTempDir(t)
+
+	tests := []struct {
+		name string
+		conf config.FileCacheConfig
+	}{
+		{name: "should not be able to create without existing path", conf: config.FileCacheConfig{Path: dir + "/missing"}},
+		{name: "should not be able to create with negative quota", conf: config.FileCacheConfig{Path: dir, MaxBytes: -1}},
+		{name: "should not be able to create with invalid interval", conf: config.FileCacheConfig{Path: dir, VacuumInterval: "daily"}},
+		{name: "should not be able to create with negative interval", conf: config.FileCacheConfig{Path: dir, VacuumInterval: "-1s"}},
+		{name: "should not be able to create with negative rate", conf: config.FileCacheConfig{Path: dir, VacuumRate: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTestFileCache(t, tt.conf); err == nil {
+				t.Error("newFileCache() expected error")
+			}
+		})
+	}
+}
+
+func TestFileCache_SharedStore(t *testing.T) {
+	dir := createTempDir(t)
+
+	first, err := newTestFileCache(t, config.FileCacheConfig{Path: dir})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	second, err := newTestFileCache(t, config.FileCacheConfig{Path: "./" + dir + "/"})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if first.store != second.store {
+		t.Fatal("caches using the same path must share their store")
+	}
+
+	_ = first.Close()
+	_ = first.Close()
+
+	select {
+	case <-first.store.done:
+		t.Fatal("vacuum must run while a cache still use the store")
+	default:
+	}
+
+	_ = second.Close()
+
+	select {
+	case <-first.store.done:
+	case <-time.After(time.Second):
+		t.Fatal("vacuum must stop once every cache is closed")
+	}
+
+	third, err := newTestFileCache(t, config.FileCacheConfig{Path: dir})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if third.store == first.store {
+		t.Error("closed store must not be reused")
+	}
+}
+
+func TestFileCache_Vacuum(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: dir, VacuumInterval: "10ms", VacuumRate: 100})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	setEntries(t, fc, time.Minute, "valid")
+	setEntries(t, fc, 0, "never")
+
+	// Set never writes expired entries, they are left by past writes.
+	expired := keyPath(dir, "expired")
+	writeTestFile(t, expired, append(encodeFileEntryHeader("expired", time.Now().Add(-time.Minute), []byte("content")), "content"...), time.Time{})
+
+	invalid := keyPath(dir, "invalid")
+	writeTestFile(t, invalid, []byte("garbage"), time.Time{})
+
+	staleTemp := invalid + ".123" + tempFileSuffix
+	writeTestFile(t, staleTemp, []byte("partial"), time.Now().Add(-2*tempFileMaxAge))
+
+	removed := []string{expired, invalid, staleTemp}
+
+	waitFor(t, 2*time.Second, func() bool {
+		return !fileExists(expired) && !fileExists(invalid) && !fileExists(staleTemp) && fc.Stats().Entries == 2
+	})
+
+	for _, p := range removed {
+		if fileExists(p) {
+			t.Errorf("vacuum must remove %s", p)
+		}
+	}
+
+	for _, k := range []string{"valid", "never"} {
+		if !fileExists(keyPath(dir, k)) {
+			t.Errorf("vacuum must keep %s entry", k)
+		}
+	}
+
+	if st := fc.Stats(); st.Entries != 2 {
+		t.Errorf("vacuum must update index: %+v", st)
+	}
+}
+
+func TestFileCache_VacuumRate(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: dir, VacuumInterval: "1h", VacuumRate: 20})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err = fc.Set(context.Background(), fmt.Sprint(i), []byte("content"), time.Minute); err != nil {
+			t.Fatalf("unexpected cache set error: %v", err)
+		}
+	}
+
+	start := time.Now()
+
+	if err = fc.store.vacuumOnce(20); err != nil {
+		t.Fatalf("unexpected vacuum error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("vacuum must be rate limited, took %s for 5 files at 20 files/s", elapsed)
+	}
+}
+
 func TestFileCache_ConcurrentAccess(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -56,7 +540,7 @@ func TestFileCache_ConcurrentAccess(t *testing.T) {
 
 	dir := createTempDir(t)
 
-	fc, err := newFileCache(dir, time.Second)
+	fc, err := newTestFileCache(t, config.FileCacheConfig{Path: dir})
 	if err != nil {
 		t.Errorf("unexpected newFileCache error: %v", err)
 	}
@@ -71,7 +555,7 @@ func TestFileCache_ConcurrentAccess(t *testing.T) {
 		defer wg.Done()
 
 		for {
-			got, _ := fc.Get(testCacheKey)
+			got, _ := fc.Get(context.Background(), testCacheKey)
 			if got != nil && !bytes.Equal(got, cacheContent) {
 				panic(fmt.Errorf("unexpected cache content: want %s, got %s", cacheContent, got))
 			}
@@ -88,7 +572,7 @@ func TestFileCache_ConcurrentAccess(t *testing.T) {
 		defer wg.Done()
 
 		for {
-			err = fc.Set(testCacheKey, cacheContent, time.Second)
+			err = fc.Set(context.Background(), testCacheKey, cacheContent, time.Second)
 			if err != nil {
 				panic(fmt.Errorf("unexpected cache set error: %w", err))
 			}
@@ -104,6 +588,235 @@ func TestFileCache_ConcurrentAccess(t *testing.T) {
 	wg.Wait()
 }
 
+// newProcessFileCache return a cache with its own store, as another process sharing the directory would.
+func newProcessFileCache(tb testing.TB, conf config.FileCacheConfig) *fileCache {
+	tb.Helper()
+
+	s, err := newFileStore(conf.Path, fileStoreOptions{
+		maxFiles:       conf.MaxFiles,
+		vacuumInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	s.refs = 1
+
+	go s.vacuum()
+
+	fc := &fileCache{path: s.path, index: s.index, store: s}
+
+	tb.Cleanup(func() {
+		_ = fc.Close()
+	})
+
+	return fc
+}
+
+func TestFileCache_SharedQuota(t *testing.T) {
+	dir := createTempDir(t)
+
+	writer := newProcessFileCache(t, config.FileCacheConfig{Path: dir, MaxFiles: 2})
+	fc := newProcessFileCache(t, config.FileCacheConfig{Path: dir, MaxFiles: 2})
+
+	setEntries(t, writer, time.Minute, "a", "b")
+
+	waitFor(t, 2*time.Second, func() bool { return fc.Stats().Entries == 2 })
+
+	if st := fc.Stats(); st.Entries != 2 {
+		t.Fatalf("vacuum must index entries written by other processes: %+v", st)
+	}
+
+	setEntries(t, fc, time.Minute, "c")
+
+	if fileExists(keyPath(dir, "a")) && fileExists(keyPath(dir, "b")) {
+		t.Error("entries written by other processes must be evicted over quota")
+	}
+
+	if st := fc.Stats(); st.Entries != 2 || st.Evictions != 1 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+// multiProcessOp run the i-th operation of the ci-th simulated process.
+func multiProcessOp(fc *fileCache, i, ci int) error {
+	key := fmt.Sprintf("key-%d", i%6)
+	content := bytes.Repeat([]byte(key), 1+i%7)
+
+	switch (i + ci) % 3 {
+	case 0:
+		// Short expiry so vacuums of every process remove entries concurrently.
+		if err := fc.Set(context.Background(), key, content, 5*time.Millisecond); err != nil {
+			return fmt.Errorf("unexpected cache set error: %w", err)
+		}
+	case 1:
+		if err := fc.Set(context.Background(), key, content, time.Minute); err != nil {
+			return fmt.Errorf("unexpected cache set error: %w", err)
+		}
+	default:
+		got, err := fc.Get(context.Background(), key)
+		if err != nil {
+			return nil
+		}
+
+		if len(got) == 0 || len(got)%len(key) != 0 || !bytes.Equal(got, bytes.Repeat([]byte(key), len(got)/len(key))) {
+			return fmt.Errorf("corrupted entry for %s: %q", key, got)
+		}
+	}
+
+	return nil
+}
+
+func TestFileCache_MultiProcess(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	dir := createTempDir(t)
+
+	caches := []*fileCache{
+		newProcessFileCache(t, config.FileCacheConfig{Path: dir, MaxFiles: 4}),
+		newProcessFileCache(t, config.FileCacheConfig{Path: dir, MaxFiles: 4}),
+		newProcessFileCache(t, config.FileCacheConfig{Path: dir, MaxFiles: 4}),
+	}
+
+	if caches[0].store.pm == caches[1].store.pm {
+		t.Fatal("simulated processes must not share in-process locks")
+	}
+
+	var (
+		wg       sync.WaitGroup
+		failures uint32
+	)
+
+	for ci, fc := range caches {
+		wg.Add(1)
+
+		go func(ci int, fc *fileCache) {
+			defer wg.Done()
+
+			for i := 0; ctx.Err() == nil && atomic.LoadUint32(&failures) == 0; i++ {
+				if err := multiProcessOp(fc, i, ci); err != nil {
+					t.Error(err)
+					atomic.AddUint32(&failures, 1)
+				}
+			}
+		}(ci, fc)
+	}
+
+	wg.Wait()
+
+	// Vacuums may still hold locks, closing waits for them.
+	for _, fc := range caches {
+		_ = fc.Close()
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && isLockFile(path) {
+			t.Errorf("lock file left behind: %s", path)
+		}
+
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	p := filepath.Join(createTempDir(t), "entry")
+
+	unlock, err := lockFile(context.Background(), p)
+	if err != nil {
+		t.Fatalf("unexpected lock error: %v", err)
+	}
+
+	var locked uint32
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		unlock, err := lockFile(context.Background(), p)
+		if err != nil {
+			t.Errorf("unexpected lock error: %v", err)
+			return
+		}
+
+		atomic.AddUint32(&locked, 1)
+		unlock()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	if atomic.LoadUint32(&locked) != 0 {
+		t.Error("unexpected second lock")
+	}
+
+	unlock()
+	<-done
+
+	if atomic.LoadUint32(&locked) != 1 {
+		t.Error("lock must be acquired once released")
+	}
+
+	// Lock abandoned by a crashed process.
+	if err = ioutil.WriteFile(p+lockFileSuffix, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * lockStaleAge)
+	if err = os.Chtimes(p+lockFileSuffix, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err = lockFile(context.Background(), p)
+	if err != nil {
+		t.Fatalf("stale lock must be broken: %v", err)
+	}
+
+	// Lock broken as stale and acquired by another process meanwhile.
+	if err = ioutil.WriteFile(p+lockFileSuffix, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock()
+
+	if !fileExists(p + lockFileSuffix) {
+		t.Error("unlock must not remove a lock acquired by another process")
+	}
+}
+
+func TestBreakStaleLock(t *testing.T) {
+	lp := filepath.Join(createTempDir(t), "entry"+lockFileSuffix)
+
+	// Another process broke the stale lock and acquired it first.
+	if err := ioutil.WriteFile(lp, []byte("fresh"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	breakStaleLock(lp, "nonce")
+
+	if b, err := ioutil.ReadFile(lp); err != nil || string(b) != "fresh" {
+		t.Errorf("fresh lock must be kept, got %q, %v", b, err)
+	}
+
+	if fileExists(lp + ".nonce" + lockFileSuffix) {
+		t.Error("renamed lock must be removed")
+	}
+
+	old := time.Now().Add(-2 * lockStaleAge)
+	if err := os.Chtimes(lp, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	breakStaleLock(lp, "nonce")
+
+	if fileExists(lp) || fileExists(lp+".nonce"+lockFileSuffix) {
+		t.Error("stale lock must be removed")
+	}
+}
+
 func TestPathMutex(t *testing.T) {
 	pm := &pathMutex{lock: map[string]*fileLock{}}
 
@@ -144,21 +857,81 @@ func TestPathMutex(t *testing.T) {
 func BenchmarkFileCache_Get(b *testing.B) {
 	dir := createTempDir(b)
 
-	fc, err := newFileCache(dir, time.Minute)
+	fc, err := newTestFileCache(b, config.FileCacheConfig{Path: dir})
 	if err != nil {
 		b.Errorf("unexpected newFileCache error: %v", err)
 	}
 
-	_ = fc.Set(testCacheKey, []byte("some random cache content that should be exact"), time.Minute)
+	_ = fc.Set(context.Background(), testCacheKey, []byte("some random cache content that should be exact"), time.Minute)
 
 	b.ReportAllocs()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_, _ = fc.Get(testCacheKey)
+		_, _ = fc.Get(context.Background(), testCacheKey)
 	}
 }
 
+func newTestFileCache(tb testing.TB, conf config.FileCacheConfig) (*fileCache, error) {
+	tb.Helper()
+
+	fc, err := newFileCache(conf)
+	if err == nil {
+		tb.Cleanup(func() {
+			_ = fc.Close()
+		})
+	}
+
+	return fc, err
+}
+
+// setEntries store "content" under given keys.
+func setEntries(tb testing.TB, c Cache, expiry time.Duration, keys ...string) {
+	tb.Helper()
+
+	for _, k := range keys {
+		if err := c.Set(context.Background(), k, []byte("content"), expiry); err != nil {
+			tb.Fatalf("unexpected cache set error: %v", err)
+		}
+	}
+}
+
+// writeTestFile write given file and its parent directories, modTime is set unless zero.
+func writeTestFile(tb testing.TB, p string, content []byte, modTime time.Time) {
+	tb.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(p, content, 0600); err != nil {
+		tb.Fatal(err)
+	}
+
+	if modTime.IsZero() {
+		return
+	}
+
+	if err := os.Chtimes(p, modTime, modTime); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// waitFor poll cond until it is true or timeout expire, callers check the outcome themselves.
+func waitFor(tb testing.TB, timeout time.Duration, cond func() bool) {
+	tb.Helper()
+
+	for deadline := time.Now().Add(timeout); !cond() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+
+	return err == nil
+}
+
 func createTempDir(tb testing.TB) string {
 	dir, err := ioutil.TempDir("./", "example")
 	if err != nil {
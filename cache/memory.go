@@ -1,47 +1,294 @@
 package cache
 
 import (
+	"container/list"
+	"context"
 	"fmt"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+const (
+	defaultMemoryMaxBytes        = 64 << 20
+	defaultMemoryMaxEntries      = 10000
+	defaultMemoryShards          = 16
+	defaultMemoryCleanupInterval = time.Minute
 )
 
 // MemoryCache in-memory cache system struct.
+// Values are spread over independently locked shards, each one bounded in bytes and entries.
+// Eviction follows the CLOCK algorithm, an LRU approximation letting reads run under a shared lock.
+// Expired entries are swept by writes.
 type MemoryCache struct {
-	mtx sync.RWMutex
-	m   map[string][]byte
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	shards   []*memoryShard
+	interval int64 // Nanoseconds between expired entries sweeps of a shard.
+}
+
+type memoryEntry struct {
+	key     string
+	val     []byte
+	expires int64 // Unix nanoseconds, zero means no expiry.
+	ref     uint32
+	elem    *list.Element
+}
+
+func (e *memoryEntry) size() int64 {
+	return int64(len(e.key) + len(e.val))
+}
+
+func (e *memoryEntry) expired(now int64) bool {
+	return e.expires != 0 && e.expires <= now
+}
+
+type memoryShard struct {
+	mtx        sync.RWMutex
+	items      map[string]*memoryEntry
+	ring       *list.List
+	hand       *list.Element
+	bytes      int64
+	maxBytes   int64
+	maxEntries int
+	swept      int64 // Unix nanoseconds of the last expired entries sweep.
+}
+
+// NewMemoryCache instantiate a new in-memory cache with given config.
+func NewMemoryCache(conf config.MemoryCacheConfig) (*MemoryCache, error) {
+	maxBytes := conf.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultMemoryMaxBytes
+	}
+
+	maxEntries := conf.MaxEntries
+	if maxEntries == 0 {
+		maxEntries = defaultMemoryMaxEntries
+	}
+
+	shards := conf.Shards
+	if shards == 0 {
+		shards = defaultMemoryShards
+	}
+
+	if maxBytes < 0 || maxEntries < 0 || shards < 0 {
+		return nil, fmt.Errorf("memory cache limits cannot be negative")
+	}
+
+	if int64(shards) > maxBytes || shards > maxEntries {
+		return nil, fmt.Errorf("memory cache limits must be greater than shards count %d", shards)
+	}
+
+	interval, err := memoryCleanupInterval(conf.CleanupInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &MemoryCache{
+		shards:   make([]*memoryShard, shards),
+		interval: int64(interval),
+	}
+
+	for i := range c.shards {
+		c.shards[i] = &memoryShard{
+			items:      map[string]*memoryEntry{},
+			ring:       list.New(),
+			maxBytes:   maxBytes / int64(shards),
+			maxEntries: maxEntries / shards,
+		}
+	}
+
+	return c, nil
+}
+
+// memoryCleanupInterval parse given duration string, empty for the default one.
+func memoryCleanupInterval(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultMemoryCleanupInterval, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory cache cleanup interval: %w", err)
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("memory cache cleanup interval must be positive")
+	}
+
+	return d, nil
+}
+
+func (c *MemoryCache) shard(key string) *memoryShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
 }
 
 // Get return cached image with given key.
-func (c *MemoryCache) Get(key string) ([]byte, error) {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
+func (c *MemoryCache) Get(_ context.Context, key string) ([]byte, error) {
+	s := c.shard(key)
 
-	v, ok := c.m[key]
-	if !ok {
-		return nil, fmt.Errorf("no result found with key = %s", key)
+	s.mtx.RLock()
+	e, ok := s.items[key]
+
+	if ok && !e.expired(time.Now().UnixNano()) {
+		atomic.StoreUint32(&e.ref, 1)
+		v := e.val
+		s.mtx.RUnlock()
+
+		atomic.AddUint64(&c.hits, 1)
+
+		return v, nil
 	}
 
-	return v, nil
+	s.mtx.RUnlock()
+
+	if ok {
+		s.mtx.Lock()
+		// The entry may have been replaced since the read lock was released.
+		if cur, found := s.items[key]; found && cur == e {
+			s.remove(e)
+		}
+		s.mtx.Unlock()
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
 }
 
-// Set add a value into in-memory with custom expiry.
-func (c *MemoryCache) Set(key string, v []byte, expiry time.Duration) error {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
+// Set add a value into in-memory with custom expiry, a non positive expiry never expires.
+// Values larger than a shard budget, MaxBytes divided by Shards, are not stored.
+func (c *MemoryCache) Set(_ context.Context, key string, v []byte, expiry time.Duration) error {
+	e := &memoryEntry{key: key, val: v}
+	if expiry > 0 {
+		e.expires = time.Now().Add(expiry).UnixNano()
+	}
+
+	s := c.shard(key)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if old, ok := s.items[key]; ok {
+		s.remove(old)
+	}
+
+	if e.size() > s.maxBytes {
+		return nil
+	}
+
+	if s.hand == nil {
+		e.elem = s.ring.PushBack(e)
+	} else {
+		// Inserting right behind the hand makes the new entry the last one to be swept.
+		e.elem = s.ring.InsertBefore(e, s.hand)
+	}
+
+	s.items[key] = e
+	s.bytes += e.size()
 
-	c.m[key] = v
+	now := time.Now().UnixNano()
 
-	time.AfterFunc(expiry, func() {
-		c.delete(key)
-	})
+	if now-s.swept >= c.interval {
+		s.removeExpired(now)
+		s.swept = now
+	}
+
+	evicted := s.evict(now)
+	atomic.AddUint64(&c.evictions, evicted)
+
+	return nil
+}
+
+// Stats return cache usage counters.
+func (c *MemoryCache) Stats() Stats {
+	st := Stats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+
+	for _, s := range c.shards {
+		s.mtx.RLock()
+		st.Entries += int64(len(s.items))
+		st.Bytes += s.bytes
+		s.mtx.RUnlock()
+	}
+
+	return st
+}
 
+// Close is a no-op, the cache hold no background resources.
+func (c *MemoryCache) Close() error {
 	return nil
 }
 
-func (c *MemoryCache) delete(key string) {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
+// Delete remove value of given key.
+func (c *MemoryCache) Delete(_ context.Context, key string) error {
+	s := c.shard(key)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		s.remove(e)
+	}
+
+	return nil
+}
+
+// evict sweep the clock until the shard fits its budget, must be called with write lock held.
+func (s *memoryShard) evict(now int64) uint64 {
+	var evicted uint64
+
+	for s.bytes > s.maxBytes || len(s.items) > s.maxEntries {
+		if s.hand == nil {
+			s.hand = s.ring.Front()
+		}
+
+		e := s.hand.Value.(*memoryEntry)
+
+		if !e.expired(now) && atomic.CompareAndSwapUint32(&e.ref, 1, 0) {
+			// Recently used, give it a second chance.
+			s.hand = s.hand.Next()
+
+			continue
+		}
+
+		s.remove(e)
+		evicted++
+	}
+
+	return evicted
+}
+
+func (s *memoryShard) removeExpired(now int64) {
+	for el := s.ring.Front(); el != nil; {
+		next := el.Next()
+
+		if e := el.Value.(*memoryEntry); e.expired(now) {
+			s.remove(e)
+		}
+
+		el = next
+	}
+}
+
+// remove unlink given entry, must be called with write lock held.
+func (s *memoryShard) remove(e *memoryEntry) {
+	if s.hand == e.elem {
+		s.hand = e.elem.Next()
+	}
 
-	delete(c.m, key)
+	s.ring.Remove(e.elem)
+	delete(s.items, e.key)
+	s.bytes -= e.size()
 }
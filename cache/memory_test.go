@@ -2,13 +2,73 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/agravelot/imageopti/config"
 )
 
+func newTestMemoryCache(tb testing.TB, conf config.MemoryCacheConfig) *MemoryCache {
+	tb.Helper()
+
+	c, err := NewMemoryCache(conf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		_ = c.Close()
+	})
+
+	return c
+}
+
+func TestNewMemoryCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    config.MemoryCacheConfig
+		wantErr bool
+	}{
+		{
+			name:    "should be able to create with default config",
+			conf:    config.MemoryCacheConfig{},
+			wantErr: false,
+		},
+		{
+			name:    "should not be able to create with negative size",
+			conf:    config.MemoryCacheConfig{MaxBytes: -1},
+			wantErr: true,
+		},
+		{
+			name:    "should not be able to create with less entries than shards",
+			conf:    config.MemoryCacheConfig{MaxEntries: 2, Shards: 4},
+			wantErr: true,
+		},
+		{
+			name:    "should not be able to create with invalid cleanup interval",
+			conf:    config.MemoryCacheConfig{CleanupInterval: "often"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewMemoryCache(tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewMemoryCache() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if c != nil {
+				_ = c.Close()
+			}
+		})
+	}
+}
+
 func TestMemoryCache_Get(t *testing.T) {
 	type fields struct {
 		m map[string][]byte
@@ -44,15 +104,19 @@ func TestMemoryCache_Get(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &MemoryCache{
-				mtx: sync.RWMutex{},
-				m:   tt.fields.m,
+			c := newTestMemoryCache(t, config.MemoryCacheConfig{})
+			for k, v := range tt.fields.m {
+				_ = c.Set(context.Background(), k, v, time.Minute)
 			}
-			got, err := c.Get(tt.args.key)
+
+			got, err := c.Get(context.Background(), tt.args.key)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("MemoryCache.Get() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				t.Errorf("MemoryCache.Get() error = %v, want %v", err, ErrNotFound)
+			}
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("MemoryCache.Get() = %v, want %v", got, tt.want)
 			}
@@ -93,26 +157,27 @@ func TestMemoryCache_Set(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &MemoryCache{
-				mtx: sync.RWMutex{},
-				m:   tt.fields.m,
+			c := newTestMemoryCache(t, config.MemoryCacheConfig{})
+			for k, v := range tt.fields.m {
+				_ = c.Set(context.Background(), k, v, time.Minute)
 			}
-			if err := c.Set(tt.args.key, tt.args.v, 100*time.Millisecond); (err != nil) != tt.wantErr {
+
+			if err := c.Set(context.Background(), tt.args.key, tt.args.v, 100*time.Millisecond); (err != nil) != tt.wantErr {
 				t.Errorf("MemoryCache.Set() error = %v, wantErr %v", err, tt.wantErr)
 			}
 
-			v, err := c.Get(tt.args.key)
+			v, err := c.Get(context.Background(), tt.args.key)
 			if err != nil {
-				panic(err)
+				t.Fatal(err)
 			}
 
 			if !bytes.Equal(v, tt.args.v) {
 				t.Errorf("result differ")
 			}
 
-			time.Sleep(1 * time.Second)
+			time.Sleep(200 * time.Millisecond)
 
-			_, err = c.Get(tt.args.key)
+			_, err = c.Get(context.Background(), tt.args.key)
 			if err == nil {
 				t.Errorf("value must be deleted after expiry")
 			}
@@ -120,61 +185,181 @@ func TestMemoryCache_Set(t *testing.T) {
 	}
 }
 
+func TestMemoryCache_OverwriteKeepsNewExpiry(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{})
+
+	_ = c.Set(context.Background(), "/test.jpeg", []byte("old"), 50*time.Millisecond)
+	_ = c.Set(context.Background(), "/test.jpeg", []byte("new"), time.Minute)
+
+	time.Sleep(100 * time.Millisecond)
+
+	v, err := c.Get(context.Background(), "/test.jpeg")
+	if err != nil {
+		t.Fatalf("overwritten value must not expire with the previous expiry: %v", err)
+	}
+
+	if !bytes.Equal(v, []byte("new")) {
+		t.Errorf("MemoryCache.Get() = %s, want new", v)
+	}
+}
+
+func TestMemoryCache_EvictLeastRecentlyUsed(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxEntries: 3, Shards: 1})
+
+	_ = c.Set(context.Background(), "a", []byte("a"), 0)
+	_ = c.Set(context.Background(), "b", []byte("b"), 0)
+	_ = c.Set(context.Background(), "c", []byte("c"), 0)
+
+	// Touch "a" so "b" becomes the eviction candidate.
+	if _, err := c.Get(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = c.Set(context.Background(), "d", []byte("d"), 0)
+
+	if _, err := c.Get(context.Background(), "b"); err == nil {
+		t.Error("least recently used value must be evicted")
+	}
+
+	for _, k := range []string{"a", "c", "d"} {
+		if _, err := c.Get(context.Background(), k); err != nil {
+			t.Errorf("value %s must be kept: %v", k, err)
+		}
+	}
+
+	if st := c.Stats(); st.Evictions != 1 || st.Entries != 3 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestMemoryCache_MaxBytes(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxBytes: 20, Shards: 1})
+
+	_ = c.Set(context.Background(), "a", bytes.Repeat([]byte("a"), 9), 0)
+	_ = c.Set(context.Background(), "b", bytes.Repeat([]byte("b"), 9), 0)
+
+	if st := c.Stats(); st.Bytes != 20 || st.Entries != 2 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	_ = c.Set(context.Background(), "c", bytes.Repeat([]byte("c"), 9), 0)
+
+	if st := c.Stats(); st.Bytes > 20 || st.Entries != 2 || st.Evictions != 1 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+
+	_ = c.Set(context.Background(), "d", bytes.Repeat([]byte("d"), 100), 0)
+
+	if _, err := c.Get(context.Background(), "d"); err == nil {
+		t.Error("value larger than the budget must not be stored")
+	}
+}
+
+func TestMemoryCache_Stats(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{})
+
+	_ = c.Set(context.Background(), "a", []byte("value"), 0)
+	_, _ = c.Get(context.Background(), "a")
+	_, _ = c.Get(context.Background(), "a")
+	_, _ = c.Get(context.Background(), "b")
+
+	st := c.Stats()
+	want := Stats{Hits: 2, Misses: 1, Evictions: 0, Entries: 1, Bytes: 6}
+
+	if st != want {
+		t.Errorf("MemoryCache.Stats() = %+v, want %+v", st, want)
+	}
+}
+
+func TestMemoryCache_SweepOnSet(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{CleanupInterval: "10ms", Shards: 1})
+
+	_ = c.Set(context.Background(), "a", []byte("value"), time.Millisecond)
+
+	time.Sleep(20 * time.Millisecond)
+
+	_ = c.Set(context.Background(), "b", []byte("value"), 0)
+
+	if st := c.Stats(); st.Entries != 1 || st.Bytes != int64(len("b")+len("value")) {
+		t.Errorf("expired values must be swept by writes: %+v", st)
+	}
+}
+
+func TestMemoryCache_ConcurrentAccess(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxEntries: 64, Shards: 4})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 1000; j++ {
+				key := fmt.Sprintf("key-%d", (i*j)%100)
+				_ = c.Set(context.Background(), key, []byte(key), time.Second)
+
+				if v, err := c.Get(context.Background(), key); err == nil && !bytes.Equal(v, []byte(key)) {
+					t.Errorf("unexpected value for %s: %s", key, v)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if st := c.Stats(); st.Entries > 64 {
+		t.Errorf("entries limit exceeded: %+v", st)
+	}
+}
+
 func BenchmarkMemoryCache_Get(b *testing.B) {
 	testCacheKey := "test-key"
 
-	c := &MemoryCache{
-		mtx: sync.RWMutex{},
-		m:   map[string][]byte{},
-	}
+	c := newTestMemoryCache(b, config.MemoryCacheConfig{})
 
-	_ = c.Set(testCacheKey, []byte("a good media value"), 0)
+	_ = c.Set(context.Background(), testCacheKey, []byte("a good media value"), 0)
 
 	b.ReportAllocs()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_, _ = c.Get(testCacheKey)
+		_, _ = c.Get(context.Background(), testCacheKey)
 	}
 }
 
 func BenchmarkMemoryCache_SetSameKey(b *testing.B) {
 	testCacheKey := "test-key"
 
-	c := &MemoryCache{
-		mtx: sync.RWMutex{},
-		m:   map[string][]byte{},
-	}
+	c := newTestMemoryCache(b, config.MemoryCacheConfig{})
 
-	_ = c.Set(testCacheKey, []byte("a good media value"), 0)
+	_ = c.Set(context.Background(), testCacheKey, []byte("a good media value"), 0)
 
 	b.ReportAllocs()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_ = c.Set(testCacheKey, []byte("a good media value"), 0)
+		_ = c.Set(context.Background(), testCacheKey, []byte("a good media value"), 0)
 	}
 }
 
 func BenchmarkMemoryCache_SetNewKey(b *testing.B) {
 	testCacheKey := "test-key"
 
-	c := &MemoryCache{
-		mtx: sync.RWMutex{},
-		m:   map[string][]byte{},
-	}
+	c := newTestMemoryCache(b, config.MemoryCacheConfig{})
 
-	_ = c.Set(testCacheKey, []byte("a good media value"), 0)
+	_ = c.Set(context.Background(), testCacheKey, []byte("a good media value"), 0)
 
 	b.ReportAllocs()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_ = c.Set(fmt.Sprintf("%s-%d", testCacheKey, i), []byte("a good media value"), 0)
+		_ = c.Set(context.Background(), fmt.Sprintf("%s-%d", testCacheKey, i), []byte("a good media value"), 0)
 	}
 }
 
-func TestMemoryCache_delete(t *testing.T) {
+func TestMemoryCache_Delete(t *testing.T) {
 	type fields struct {
 		m map[string][]byte
 	}
@@ -206,17 +391,21 @@ func TestMemoryCache_delete(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &MemoryCache{
-				mtx: sync.RWMutex{},
-				m:   tt.fields.m,
+			c := newTestMemoryCache(t, config.MemoryCacheConfig{})
+			for k, v := range tt.fields.m {
+				_ = c.Set(context.Background(), k, v, 0)
 			}
 
-			c.delete(tt.args.key)
+			if err := c.Delete(context.Background(), tt.args.key); err != nil {
+				t.Fatalf("MemoryCache.Delete() unexpected error: %v", err)
+			}
 
-			_, ok := c.m[tt.args.key]
+			if _, err := c.Get(context.Background(), tt.args.key); err == nil {
+				t.Errorf("MemoryCache.Delete() key must be deleted : %v", tt.args.key)
+			}
 
-			if ok {
-				t.Errorf("MemoryCache.delete() key must be deleted : %v", tt.args.key)
+			if st := c.Stats(); st.Entries != 0 || st.Bytes != 0 {
+				t.Errorf("MemoryCache.Delete() must release accounting: %+v", st)
 			}
 		})
 	}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
@@ -9,11 +10,26 @@ import (
 type NoneCache struct{}
 
 // Get always return nil with not found error.
-func (c *NoneCache) Get(key string) ([]byte, error) {
-	return nil, fmt.Errorf("no result found with key = %s", key)
+func (c *NoneCache) Get(_ context.Context, key string) ([]byte, error) {
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
 }
 
 // Set always return nil.
-func (c *NoneCache) Set(_ string, _ []byte, _ time.Duration) error {
+func (c *NoneCache) Set(_ context.Context, _ string, _ []byte, _ time.Duration) error {
+	return nil
+}
+
+// Delete always return nil.
+func (c *NoneCache) Delete(_ context.Context, _ string) error {
+	return nil
+}
+
+// Stats always return zero counters.
+func (c *NoneCache) Stats() Stats {
+	return Stats{}
+}
+
+// Close always return nil.
+func (c *NoneCache) Close() error {
 	return nil
 }
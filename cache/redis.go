@@ -1,16 +1,19 @@
 package cache
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // RedisCache hold redis client.
 type RedisCache struct{} // client *redis.Client
 
 // Get return cached media with given key from redis.
-func (c *RedisCache) Get(key string) ([]byte, error) {
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, error) {
 	// v, err := c.client.Get(ctx, key).Bytes()
 
 	// if err == redis.Nil {
-	// 	return nil, fmt.Errorf("no result found with key = %s", key)
+	// 	return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
 	// } else if err != nil {
 	// 	return nil, err
 	// }
@@ -21,7 +24,24 @@ func (c *RedisCache) Get(key string) ([]byte, error) {
 }
 
 // Set add a new image in cache with custom expiry.
-func (c *RedisCache) Set(key string, v []byte, expiry time.Duration) error {
+func (c *RedisCache) Set(ctx context.Context, key string, v []byte, expiry time.Duration) error {
 	// return c.client.Set(ctx, key, v, expiry).Err()
 	return nil
 }
+
+// Delete remove given key from redis.
+func (c *RedisCache) Delete(ctx context.Context, key string) error {
+	// return c.client.Del(ctx, key).Err()
+	return nil
+}
+
+// Stats return cache usage counters.
+func (c *RedisCache) Stats() Stats {
+	return Stats{}
+}
+
+// Close close redis client.
+func (c *RedisCache) Close() error {
+	// return c.client.Close()
+	return nil
+}
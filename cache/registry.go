@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+// Factory instantiate a cache, settings is the raw configuration section of the driver
+// found under its name in config.Config.Drivers, nil if not defined.
+type Factory func(conf config.Config, settings map[string]interface{}) (Cache, error)
+
+// registry hold drivers available to every middleware instance of the process, builtin ones are added on first use.
+var registry struct { //nolint:gochecknoglobals // RegisterCache extend it process wide.
+	sync.RWMutex
+	once      sync.Once
+	factories map[string]Factory
+}
+
+func loadBuiltins() {
+	registry.once.Do(func() {
+		registry.factories = builtinCaches()
+	})
+}
+
+// builtinCaches return factories of the drivers shipped with the plugin.
+func builtinCaches() map[string]Factory {
+	return map[string]Factory{
+		"file": func(conf config.Config, _ map[string]interface{}) (Cache, error) {
+			c, err := newFileCache(conf.File)
+			if err != nil {
+				return nil, err
+			}
+
+			return c, nil
+		},
+		"memory": func(conf config.Config, _ map[string]interface{}) (Cache, error) {
+			c, err := NewMemoryCache(conf.Memory)
+			if err != nil {
+				return nil, err
+			}
+
+			return c, nil
+		},
+		"none": func(_ config.Config, _ map[string]interface{}) (Cache, error) {
+			return &NoneCache{}, nil
+		},
+	}
+}
+
+// RegisterCache make a cache available by name in the configuration.
+// It panics if name is empty, factory is nil or name is already registered.
+func RegisterCache(name string, factory Factory) {
+	loadBuiltins()
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if name == "" || factory == nil {
+		panic("cache: register requires a name and a factory")
+	}
+
+	if _, ok := registry.factories[name]; ok {
+		panic(fmt.Sprintf("cache: register called twice for driver %s", name))
+	}
+
+	registry.factories[name] = factory
+}
+
+// Drivers return sorted names of registered caches.
+func Drivers() []string {
+	loadBuiltins()
+
+	registry.RLock()
+	defer registry.RUnlock()
+
+	names := make([]string, 0, len(registry.factories))
+	for name := range registry.factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func lookup(name string) (Factory, bool) {
+	loadBuiltins()
+
+	registry.RLock()
+	defer registry.RUnlock()
+
+	f, ok := registry.factories[name]
+
+	return f, ok
+}
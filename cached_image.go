@@ -0,0 +1,72 @@
+package imageopti
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// cachedImageMagic prefix cached values, entries without it come from an older version.
+const cachedImageMagic = "imageopti/1\n"
+
+var errInvalidCachedImage = errors.New("invalid cached image")
+
+// cachedImage is an optimized image stored with the response headers needed to serve it again,
+// as processors may produce another format than the requested one.
+type cachedImage struct {
+	header http.Header
+	body   []byte
+}
+
+// encode serialize headers as "Key: value" lines followed by an empty line and the body.
+func (ci cachedImage) encode() []byte {
+	var buf bytes.Buffer
+
+	buf.Grow(len(cachedImageMagic) + 128 + len(ci.body))
+	buf.WriteString(cachedImageMagic)
+
+	for k, values := range ci.header {
+		for _, v := range values {
+			buf.WriteString(k + ": " + v + "\n")
+		}
+	}
+
+	buf.WriteByte('\n')
+	buf.Write(ci.body)
+
+	return buf.Bytes()
+}
+
+func decodeCachedImage(b []byte) (cachedImage, error) {
+	if !bytes.HasPrefix(b, []byte(cachedImageMagic)) {
+		return cachedImage{}, errInvalidCachedImage
+	}
+
+	b = b[len(cachedImageMagic):]
+	ci := cachedImage{header: http.Header{}}
+
+	if bytes.HasPrefix(b, []byte("\n")) {
+		ci.body = b[1:]
+
+		return ci, nil
+	}
+
+	end := bytes.Index(b, []byte("\n\n"))
+	if end < 0 {
+		return cachedImage{}, errInvalidCachedImage
+	}
+
+	for _, line := range strings.Split(string(b[:end]), "\n") {
+		i := strings.Index(line, ": ")
+		if i <= 0 {
+			return cachedImage{}, errInvalidCachedImage
+		}
+
+		ci.header.Add(line[:i], line[i+2:])
+	}
+
+	ci.body = b[end+2:]
+
+	return ci, nil
+}
@@ -0,0 +1,39 @@
+package imageopti
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestCachedImage_Encode(t *testing.T) {
+	tests := []struct {
+		name  string
+		image cachedImage
+	}{
+		{name: "should round trip headers and body", image: cachedImage{header: http.Header{contentType: {"image/jpeg"}}, body: []byte("a\n\nb")}},
+		{name: "should round trip without headers", image: cachedImage{header: http.Header{}, body: []byte("\n\nbody")}},
+		{name: "should round trip empty body", image: cachedImage{header: http.Header{contentType: {"image/webp"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCachedImage(tt.image.encode())
+			if err != nil {
+				t.Fatalf("decodeCachedImage() unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(got.body, tt.image.body) || got.header.Get(contentType) != tt.image.header.Get(contentType) {
+				t.Errorf("decodeCachedImage() = %+v, want %+v", got, tt.image)
+			}
+		})
+	}
+}
+
+func TestDecodeCachedImage_Invalid(t *testing.T) {
+	for _, v := range []string{"raw image from an older version", cachedImageMagic + "Content-Type image/webp\n\nbody", cachedImageMagic + "Content-Type: image/webp\n"} {
+		if _, err := decodeCachedImage([]byte(v)); !errors.Is(err, errInvalidCachedImage) {
+			t.Errorf("decodeCachedImage(%q) error = %v, want %v", v, err, errInvalidCachedImage)
+		}
+	}
+}
@@ -1,9 +1,122 @@
 // Package config provide configurations structs for imageopti middleware.
 package config
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 // ImaginaryProcessorConfig define imaginary image processor configurations.
 type ImaginaryProcessorConfig struct {
+	// URL of imaginary, either http(s)://host:port or unix:///path/to/socket.
+	URL string `json:"url" yaml:"url" toml:"url"`
+	// URLs of additional imaginary replicas to balance requests on.
+	URLs []string `json:"urls,omitempty" yaml:"urls,omitempty" toml:"urls,omitempty"`
+	// Balancer is one of "roundrobin" (default), "leastinflight" or "hash" (affinity by cache key).
+	Balancer string `json:"balancer,omitempty" yaml:"balancer,omitempty" toml:"balancer,omitempty"`
+	// HealthCheckInterval is the minimum period between /health checks, run along with requests, as a duration string like "10s".
+	HealthCheckInterval string `json:"healthCheckInterval,omitempty" yaml:"healthCheckInterval,omitempty" toml:"healthCheckInterval,omitempty"`
+	// MaxFailures is the number of consecutive failures ejecting an endpoint.
+	MaxFailures int `json:"maxFailures,omitempty" yaml:"maxFailures,omitempty" toml:"maxFailures,omitempty"`
+	// EjectionTime is how long an ejected endpoint is left out, as a duration string like "30s".
+	EjectionTime string `json:"ejectionTime,omitempty" yaml:"ejectionTime,omitempty" toml:"ejectionTime,omitempty"`
+	// SourceBaseURL enable URL-fetch mode, imaginary download sources itself from this base URL followed by
+	// the request path instead of receiving them in the request body. It must reach the backend directly,
+	// not through this middleware.
+	SourceBaseURL string `json:"sourceBaseUrl,omitempty" yaml:"sourceBaseUrl,omitempty" toml:"sourceBaseUrl,omitempty"`
+	// MaxResponseBytes is the largest accepted imaginary response body, 64MiB by default.
+	MaxResponseBytes int64 `json:"maxResponseBytes,omitempty" yaml:"maxResponseBytes,omitempty" toml:"maxResponseBytes,omitempty"`
+	// Timeout of a whole imaginary request, as a duration string like "5s".
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitempty"`
+	// APIKey is sent as imaginary "key" query parameter, or in APIKeyHeader when defined.
+	APIKey       string `json:"apiKey,omitempty" yaml:"apiKey,omitempty" toml:"apiKey,omitempty"`
+	APIKeyHeader string `json:"apiKeyHeader,omitempty" yaml:"apiKeyHeader,omitempty" toml:"apiKeyHeader,omitempty"`
+	// Headers are added to every imaginary request.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty" toml:"headers,omitempty"`
+	// CAFile is a PEM bundle trusted in addition to system roots.
+	CAFile string `json:"caFile,omitempty" yaml:"caFile,omitempty" toml:"caFile,omitempty"`
+	// CertFile and KeyFile are the PEM client certificate and key for mutual TLS.
+	CertFile string `json:"certFile,omitempty" yaml:"certFile,omitempty" toml:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty" yaml:"keyFile,omitempty" toml:"keyFile,omitempty"`
+	// InsecureSkipVerify disable server certificate verification, for development only.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty" toml:"insecureSkipVerify,omitempty"`
+	// Connection pool tuning, zero values use Go defaults.
+	MaxIdleConns        int    `json:"maxIdleConns,omitempty" yaml:"maxIdleConns,omitempty" toml:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost int    `json:"maxIdleConnsPerHost,omitempty" yaml:"maxIdleConnsPerHost,omitempty" toml:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost     int    `json:"maxConnsPerHost,omitempty" yaml:"maxConnsPerHost,omitempty" toml:"maxConnsPerHost,omitempty"`
+	IdleConnTimeout     string `json:"idleConnTimeout,omitempty" yaml:"idleConnTimeout,omitempty" toml:"idleConnTimeout,omitempty"`
+}
+
+// ImgproxyProcessorConfig define imgproxy image processor configurations.
+type ImgproxyProcessorConfig struct {
+	// URL of imgproxy, like http://imgproxy:8080.
 	URL string `json:"url" yaml:"url" toml:"url"`
+	// Key and Salt are the hex encoded IMGPROXY_KEY and IMGPROXY_SALT, URLs are not signed when empty.
+	Key  string `json:"key,omitempty" yaml:"key,omitempty" toml:"key,omitempty"`
+	Salt string `json:"salt,omitempty" yaml:"salt,omitempty" toml:"salt,omitempty"`
+	// SourceBaseURL is where imgproxy fetch sources, followed by the request path. It must reach the backend
+	// directly, not through this middleware.
+	SourceBaseURL string `json:"sourceBaseUrl" yaml:"sourceBaseUrl" toml:"sourceBaseUrl"`
+	// ResizeType is one of "fit" (default), "fill", "fill-down", "force" or "auto".
+	ResizeType string `json:"resizeType,omitempty" yaml:"resizeType,omitempty" toml:"resizeType,omitempty"`
+	// Gravity used when cropping, like "ce" or "sm" for smart, imgproxy default when empty.
+	Gravity string `json:"gravity,omitempty" yaml:"gravity,omitempty" toml:"gravity,omitempty"`
+	// Timeout of a whole imgproxy request, as a duration string like "5s".
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitempty"`
+	// MaxResponseBytes is the largest accepted imgproxy response body, 64MiB by default.
+	MaxResponseBytes int64 `json:"maxResponseBytes,omitempty" yaml:"maxResponseBytes,omitempty" toml:"maxResponseBytes,omitempty"`
+}
+
+// ThumborProcessorConfig define thumbor image processor configurations.
+type ThumborProcessorConfig struct {
+	// URL of thumbor, like http://thumbor:8888.
+	URL string `json:"url" yaml:"url" toml:"url"`
+	// Key is the thumbor SECURITY_KEY, "unsafe" URLs are used when empty.
+	Key string `json:"key,omitempty" yaml:"key,omitempty" toml:"key,omitempty"`
+	// Source is the template of the source image URL given to thumbor, where {path}, {query} and {uri}
+	// are replaced by the request path, raw query and both, like "http://backend:8080{uri}".
+	// It must reach the backend directly, not through this middleware.
+	Source string `json:"source" yaml:"source" toml:"source"`
+	// Smart enable thumbor smart cropping.
+	Smart bool `json:"smart,omitempty" yaml:"smart,omitempty" toml:"smart,omitempty"`
+	// Timeout of a whole thumbor request, as a duration string like "5s".
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitempty"`
+	// MaxResponseBytes is the largest accepted thumbor response body, 64MiB by default.
+	MaxResponseBytes int64 `json:"maxResponseBytes,omitempty" yaml:"maxResponseBytes,omitempty" toml:"maxResponseBytes,omitempty"`
+}
+
+// ExecCommandConfig define an external encoder command.
+type ExecCommandConfig struct {
+	// Args is the command line, where {input}, {output}, {quality}, {width} and {height} are replaced.
+	// The source is piped through stdin unless {input} is used, the result is read from stdout unless {output} is used.
+	// Only the started process is killed on timeout, shell wrappers must exec the encoder.
+	Args []string `json:"args" yaml:"args" toml:"args"`
+}
+
+// ExecProcessorConfig define external commands image processor configurations.
+type ExecProcessorConfig struct {
+	// Commands by target format name, like webp, avif, jpeg, png or gif.
+	Commands map[string]ExecCommandConfig `json:"commands" yaml:"commands" toml:"commands"`
+	// Timeout of a command run, as a duration string like "30s".
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitempty"`
+	// MaxOutputBytes is the largest accepted command output, 64MiB by default.
+	MaxOutputBytes int64 `json:"maxOutputBytes,omitempty" yaml:"maxOutputBytes,omitempty" toml:"maxOutputBytes,omitempty"`
+	// TempDir is where input and output files are written, the system default when empty.
+	TempDir string `json:"tempDir,omitempty" yaml:"tempDir,omitempty" toml:"tempDir,omitempty"`
+}
+
+// LocalProcessorConfig define local image processor configurations.
+type LocalProcessorConfig struct {
+	// Filter is the resampling filter, one of "box", "bilinear", "catmullrom" (default) or "lanczos".
+	Filter string `json:"filter,omitempty" yaml:"filter,omitempty" toml:"filter,omitempty"`
+}
+
+// StripProcessorConfig define metadata stripping processor configurations.
+type StripProcessorConfig struct {
+	// KeepICC keep embedded color profiles, dropped by default.
+	KeepICC bool `json:"keepIcc,omitempty" yaml:"keepIcc,omitempty" toml:"keepIcc,omitempty"`
+	// Next is the processor given the stripped image, like "imaginary", none by default.
+	Next string `json:"next,omitempty" yaml:"next,omitempty" toml:"next,omitempty"`
 }
 
 // RedisCacheConfig define redis cache system configurations.
@@ -14,14 +127,111 @@ type RedisCacheConfig struct {
 // FileCacheConfig define file cache system configurations.
 type FileCacheConfig struct {
 	Path string `json:"path" yaml:"path" toml:"path"`
+	// MaxBytes is the disk quota in bytes, zero means unlimited. Entries written by other processes sharing Path
+	// are accounted for from the next vacuum pass.
+	MaxBytes int64 `json:"maxBytes,omitempty" yaml:"maxBytes,omitempty" toml:"maxBytes,omitempty"`
+	// MaxFiles is the maximum number of cached files, zero means unlimited.
+	MaxFiles int `json:"maxFiles,omitempty" yaml:"maxFiles,omitempty" toml:"maxFiles,omitempty"`
+	// VacuumInterval is the delay between expired entries removal passes, as a duration string like "5m".
+	VacuumInterval string `json:"vacuumInterval,omitempty" yaml:"vacuumInterval,omitempty" toml:"vacuumInterval,omitempty"`
+	// VacuumRate is the maximum number of files checked per second during a vacuum pass.
+	VacuumRate int `json:"vacuumRate,omitempty" yaml:"vacuumRate,omitempty" toml:"vacuumRate,omitempty"`
+}
+
+// MemoryCacheConfig define in-memory cache system configurations.
+type MemoryCacheConfig struct {
+	// MaxBytes is the total size budget of cached values, split evenly across shards.
+	// Values larger than a shard budget, 4MiB with defaults, are never cached.
+	MaxBytes int64 `json:"maxBytes,omitempty" yaml:"maxBytes,omitempty" toml:"maxBytes,omitempty"`
+	// MaxEntries is the total number of cached values, split evenly across shards.
+	MaxEntries int `json:"maxEntries,omitempty" yaml:"maxEntries,omitempty" toml:"maxEntries,omitempty"`
+	// Shards is the number of independently locked partitions.
+	Shards int `json:"shards,omitempty" yaml:"shards,omitempty" toml:"shards,omitempty"`
+	// CleanupInterval is the minimum period between expired entries removals, done by writes,
+	// as a duration string like "1m".
+	CleanupInterval string `json:"cleanupInterval,omitempty" yaml:"cleanupInterval,omitempty" toml:"cleanupInterval,omitempty"`
+}
+
+// RetryConfig define retries of transient processor failures, like refused connections or 502, 503 and 504 statuses.
+type RetryConfig struct {
+	// MaxAttempts is the number of tries of a processor call, 1 disables retries.
+	MaxAttempts int `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty" toml:"maxAttempts,omitempty"`
+	// InitialBackoff is the delay before the first retry, doubled on each attempt, as a duration string like "50ms".
+	InitialBackoff string `json:"initialBackoff,omitempty" yaml:"initialBackoff,omitempty" toml:"initialBackoff,omitempty"`
+	// MaxBackoff caps the delay between two attempts.
+	MaxBackoff string `json:"maxBackoff,omitempty" yaml:"maxBackoff,omitempty" toml:"maxBackoff,omitempty"`
+	// Budget is the total time allowed to a processor call, attempts and delays included.
+	Budget string `json:"budget,omitempty" yaml:"budget,omitempty" toml:"budget,omitempty"`
+}
+
+// BreakerConfig define the circuit breaker guarding a processor.
+type BreakerConfig struct {
+	// Disabled let every call reach the processor whatever its error rate.
+	Disabled bool `json:"disabled,omitempty" yaml:"disabled,omitempty" toml:"disabled,omitempty"`
+	// ErrorRate is the failed calls ratio, between 0 and 1, opening the breaker.
+	ErrorRate float64 `json:"errorRate,omitempty" yaml:"errorRate,omitempty" toml:"errorRate,omitempty"`
+	// MinRequests is the number of calls within Window required before the error rate is considered.
+	MinRequests int `json:"minRequests,omitempty" yaml:"minRequests,omitempty" toml:"minRequests,omitempty"`
+	// Window is the period over which calls are counted, as a duration string like "30s".
+	Window string `json:"window,omitempty" yaml:"window,omitempty" toml:"window,omitempty"`
+	// OpenTimeout is how long the breaker stay open before letting a probe call through.
+	OpenTimeout string `json:"openTimeout,omitempty" yaml:"openTimeout,omitempty" toml:"openTimeout,omitempty"`
+}
+
+// LimitsConfig define caps protecting processors from oversized inputs and decompression bombs.
+// Originals are served untouched when exceeded.
+type LimitsConfig struct {
+	// MaxSourceBytes is the largest buffered source, larger responses are streamed through, 32MiB by default.
+	MaxSourceBytes int64 `json:"maxSourceBytes,omitempty" yaml:"maxSourceBytes,omitempty" toml:"maxSourceBytes,omitempty"`
+	// MaxPixels is the largest decoded source, read from image headers, 50 megapixels by default.
+	MaxPixels int64 `json:"maxPixels,omitempty" yaml:"maxPixels,omitempty" toml:"maxPixels,omitempty"`
+	// MaxOutputWidth is the largest produced image width, 16383 by default as WebP images cannot be larger.
+	MaxOutputWidth int `json:"maxOutputWidth,omitempty" yaml:"maxOutputWidth,omitempty" toml:"maxOutputWidth,omitempty"`
+	// MaxOutputHeight is the largest produced image height, 16383 by default.
+	MaxOutputHeight int `json:"maxOutputHeight,omitempty" yaml:"maxOutputHeight,omitempty" toml:"maxOutputHeight,omitempty"`
+}
+
+// ProcessorStageConfig define a pipeline stage, its processors are tried in order until one succeeds.
+type ProcessorStageConfig struct {
+	Processors []string `json:"processors" yaml:"processors" toml:"processors"`
 }
 
 // Config the plugin configuration.
 type Config struct {
-	Processor string                   `json:"processor" yaml:"processor" toml:"processor"`
+	Processor string `json:"processor" yaml:"processor" toml:"processor"`
+	// Pipeline replace Processor with stages run in order, each one given the output of the previous one.
+	Pipeline  []ProcessorStageConfig   `json:"pipeline,omitempty" yaml:"pipeline,omitempty" toml:"pipeline,omitempty"`
 	Imaginary ImaginaryProcessorConfig `json:"imaginary,omitempty" yaml:"imaginary,omitempty" toml:"imaginary,omitempty"`
+	Imgproxy  ImgproxyProcessorConfig  `json:"imgproxy,omitempty" yaml:"imgproxy,omitempty" toml:"imgproxy,omitempty"`
+	Thumbor   ThumborProcessorConfig   `json:"thumbor,omitempty" yaml:"thumbor,omitempty" toml:"thumbor,omitempty"`
+	Exec      ExecProcessorConfig      `json:"exec,omitempty" yaml:"exec,omitempty" toml:"exec,omitempty"`
+	Local     LocalProcessorConfig     `json:"local,omitempty" yaml:"local,omitempty" toml:"local,omitempty"`
+	Strip     StripProcessorConfig     `json:"strip,omitempty" yaml:"strip,omitempty" toml:"strip,omitempty"`
+	Retry     RetryConfig              `json:"retry,omitempty" yaml:"retry,omitempty" toml:"retry,omitempty"`
+	Breaker   BreakerConfig            `json:"breaker,omitempty" yaml:"breaker,omitempty" toml:"breaker,omitempty"`
+	// InputFormats allow processing of sources detected as these formats, like jpeg or png.
+	// Raster formats other than ico are allowed by default.
+	InputFormats []string     `json:"inputFormats,omitempty" yaml:"inputFormats,omitempty" toml:"inputFormats,omitempty"`
+	Limits       LimitsConfig `json:"limits,omitempty" yaml:"limits,omitempty" toml:"limits,omitempty"`
 	// Cache
-	Cache string           `json:"cache" yaml:"cache" toml:"cache"`
-	Redis RedisCacheConfig `json:"redis,omitempty" yaml:"redis,omitempty" toml:"redis,omitempty"`
-	File  FileCacheConfig  `json:"file,omitempty" yaml:"file,omitempty" toml:"file,omitempty"`
+	Cache  string            `json:"cache" yaml:"cache" toml:"cache"`
+	Redis  RedisCacheConfig  `json:"redis,omitempty" yaml:"redis,omitempty" toml:"redis,omitempty"`
+	File   FileCacheConfig   `json:"file,omitempty" yaml:"file,omitempty" toml:"file,omitempty"`
+	Memory MemoryCacheConfig `json:"memory,omitempty" yaml:"memory,omitempty" toml:"memory,omitempty"`
+	// Drivers hold raw settings of registered drivers, keyed by driver name.
+	Drivers map[string]map[string]interface{} `json:"drivers,omitempty" yaml:"drivers,omitempty" toml:"drivers,omitempty"`
+}
+
+// DecodeSettings fill v, a pointer to a driver specific struct, from its raw settings using json tags.
+func DecodeSettings(settings map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("unable to encode driver settings: %w", err)
+	}
+
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("unable to decode driver settings: %w", err)
+	}
+
+	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -31,6 +32,7 @@ func CreateConfig() *Config {
 			Imaginary: config.ImaginaryProcessorConfig{URL: ""},
 			Redis:     config.RedisCacheConfig{URL: ""},
 			File:      config.FileCacheConfig{Path: ""},
+			Memory:    config.MemoryCacheConfig{},
 		},
 	}
 }
@@ -41,38 +43,101 @@ type ImageOptimizer struct {
 	name string
 	p    processor.Processor
 	c    cache.Cache
+
+	inputFormats  map[string]bool
+	limits        limits
+	fetchesSource bool
 }
 
 // New created a new ImageOptimizer plugin.
 func New(ctx context.Context, next http.Handler, conf *Config, name string) (http.Handler, error) {
 	log.Println("Loading image optimization plugin...")
 
-	if conf.Processor == "" {
+	if conf.Processor == "" && len(conf.Pipeline) == 0 {
 		return nil, fmt.Errorf("processor must be defined")
 	}
 
+	formats, err := inputFormats(conf.InputFormats)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := newLimits(conf.Limits)
+	if err != nil {
+		return nil, err
+	}
+
 	c, err := cache.New(conf.Config)
 	if err != nil {
 		panic(err)
 	}
 
-	p, err := processor.New(conf.Config)
+	p, err := processor.New(name, conf.Config)
 	if err != nil {
 		panic(err)
 	}
 
+	// Pipeline processors are already guarded one by one.
+	if len(conf.Pipeline) == 0 {
+		if p, err = processor.NewResilient(name+"/"+conf.Processor, p, conf.Config); err != nil {
+			return nil, err
+		}
+	}
+
 	return &ImageOptimizer{
 		p:    p,
 		c:    c,
 		next: next,
 		name: name,
+
+		inputFormats:  formats,
+		limits:        l,
+		fetchesSource: processor.FetchesSource(p),
 	}, nil
 }
 
+// defaultInputFormats are processed when no allowlist is configured,
+// vector images and icons rarely benefit from raster processors.
+func defaultInputFormats() []string {
+	return []string{
+		processor.FormatJPEG,
+		processor.FormatPNG,
+		processor.FormatGIF,
+		processor.FormatWebP,
+		processor.FormatAVIF,
+		processor.FormatHEIF,
+		processor.FormatBMP,
+		processor.FormatTIFF,
+	}
+}
+
+// inputFormats return the set of source formats to process from given names.
+func inputFormats(names []string) (map[string]bool, error) {
+	if len(names) == 0 {
+		names = defaultInputFormats()
+	}
+
+	formats := make(map[string]bool, len(names))
+
+	for _, n := range names {
+		f := processor.ParseFormat(n)
+		if !processor.IsDetectable(f) {
+			return nil, fmt.Errorf("unsupported input format %q", n)
+		}
+
+		formats[f] = true
+	}
+
+	return formats, nil
+}
+
 const (
 	contentLength   = "Content-Length"
 	contentType     = "Content-Type"
 	cacheStatus     = "Cache-Status"
+	serverTiming    = "Server-Timing"
+	originalWidth   = "X-Original-Width"
+	originalHeight  = "X-Original-Height"
 	cacheHitStatus  = "hit"
 	cacheMissStatus = "miss"
 	cacheExpiry     = 100 * time.Second
@@ -86,15 +151,12 @@ func (a *ImageOptimizer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		panic(err)
 	}
 	// Return cached result here.
-	if v, err := a.c.Get(key); err == nil {
-		rw.Header().Set(contentLength, fmt.Sprint(len(v)))
-		rw.Header().Set(contentType, targetFormat)
-		rw.Header().Set(cacheStatus, cacheHitStatus)
-		_, err = rw.Write(v)
-
-		if err != nil {
-			panic(err)
-		}
+	if a.serveCached(rw, req, key) {
+		return
+	}
+
+	if a.fetchesSource {
+		a.serveFetched(rw, req, key)
 
 		return
 	}
@@ -104,44 +166,229 @@ func (a *ImageOptimizer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		bypassHeader:   true,
 		wroteHeader:    false,
 		buffer:         bytes.Buffer{},
+		maxBuffered:    a.limits.maxSourceBytes,
 	}
 
 	a.next.ServeHTTP(wrappedWriter, req)
 
+	if wrappedWriter.passThrough {
+		log.Printf("%s: source exceeds %d bytes, original streamed untouched", a.name, a.limits.maxSourceBytes)
+		return
+	}
+
 	wrappedWriter.bypassHeader = false
 	bodyBytes := wrappedWriter.buffer.Bytes()
 
-	// If not image response, forward original and leave it here.
-	if !isImageResponse(rw) {
-		_, err = rw.Write(bodyBytes)
-		if err != nil {
-			panic(err)
-		}
+	format, width, ok := a.inspectSource(rw, req, wrappedWriter)
+	if !ok {
+		a.serveOriginal(rw, wrappedWriter.status(), bodyBytes)
 
 		return
 	}
 
+	res, ok := a.optimize(req, key, format, width, bodyBytes)
+	if !ok {
+		a.serveOriginal(rw, wrappedWriter.status(), bodyBytes)
+
+		return
+	}
+
+	a.serveOptimized(rw, req, key, res, bodyBytes)
+}
+
+// inspectSource return the format of given upstream response and the width to produce, it return false when
+// the original must be served untouched.
+func (a *ImageOptimizer) inspectSource(rw http.ResponseWriter, req *http.Request,
+	upstream *responseWriter,
+) (string, int, bool) {
+	body := upstream.buffer.Bytes()
+
+	// Errors, redirects and partial contents are not images to process.
+	if upstream.status() != http.StatusOK {
+		return "", 0, false
+	}
+
+	// Content-Type is not trusted, backends may serve images as application/octet-stream or mislabel them.
+	format := processor.DetectFormat(body)
+	if !a.inputFormats[format] {
+		return "", 0, false
+	}
+
 	width, err := imageWidthRequest(req)
 	if err != nil {
 		panic(err)
 	}
 
-	optimized, ct, err := a.p.Optimize(bodyBytes, rw.Header().Get(contentType), targetFormat, 75, width)
+	// Dimensions are read from headers only, vector images have none.
+	sw, sh, err := processor.Probe(body, format)
+
+	switch {
+	case err == nil:
+		rw.Header().Set(originalWidth, strconv.Itoa(sw))
+		rw.Header().Set(originalHeight, strconv.Itoa(sh))
+
+		// Never upscale.
+		if width > sw {
+			width = sw
+		}
+	case !errors.Is(err, processor.ErrProbeUnsupported) && a.limits.maxPixels > 0:
+		log.Printf("%s: unable to read source dimensions, serving original: %v", a.name, err)
+
+		return "", 0, false
+	}
+
+	if reason := a.limits.checkSource(sw, sh, width); reason != "" {
+		log.Printf("%s: %s, serving original", a.name, reason)
+
+		return "", 0, false
+	}
+
+	return format, width, true
+}
+
+// optimize process given source, nil when processors fetch it themselves, into the target format. Failures and
+// results exceeding limits are logged, it return false when the original must be served untouched.
+func (a *ImageOptimizer) optimize(req *http.Request, key, format string, width int,
+	src []byte,
+) (processor.Result, bool) {
+	res, err := a.p.Optimize(req.Context(), processor.Request{
+		Source: src,
+		Format: format,
+		Key:    key,
+		Path:   req.URL.RequestURI(),
+		Spec: processor.Spec{
+			TargetFormat: targetFormat,
+			Quality:      75,
+			Width:        width,
+		},
+	})
+	if err != nil {
+		// Serve the original rather than failing the request, the breaker already logged its opening.
+		if !errors.Is(err, processor.ErrCircuitOpen) {
+			log.Printf("%s: unable to optimize image, serving original: %v", a.name, err)
+		}
+
+		return processor.Result{}, false
+	}
+
+	// Processors may ignore the requested size, dimensions are only known when they report them.
+	if reason := a.limits.checkOutput(res.Width, res.Height); reason != "" {
+		log.Printf("%s: %s, serving original", a.name, reason)
+
+		return processor.Result{}, false
+	}
+
+	return res, true
+}
+
+// serveFetched process images with a processor downloading sources itself, upstream responses of images are not
+// requested as the origin would serve them twice. Formats are told by path extensions, other requests and failures
+// are served by the next handler untouched.
+func (a *ImageOptimizer) serveFetched(rw http.ResponseWriter, req *http.Request, key string) {
+	ext := strings.TrimPrefix(path.Ext(req.URL.Path), ".")
+	format := processor.ParseFormat(ext)
+
+	if ext == "" || !a.inputFormats[format] {
+		a.next.ServeHTTP(rw, req)
+
+		return
+	}
+
+	width, err := imageWidthRequest(req)
 	if err != nil {
 		panic(err)
 	}
 
-	rw.Header().Set(contentLength, fmt.Sprint(len(optimized)))
-	rw.Header().Set(contentType, ct)
+	// Source dimensions are unknown, processors would still be asked for any requested width.
+	if reason := a.limits.checkSource(0, 0, width); reason != "" {
+		log.Printf("%s: %s, serving original", a.name, reason)
+		a.next.ServeHTTP(rw, req)
+
+		return
+	}
+
+	res, ok := a.optimize(req, key, format, width, nil)
+	if !ok {
+		a.next.ServeHTTP(rw, req)
+
+		return
+	}
+
+	a.serveOptimized(rw, req, key, res, nil)
+}
+
+// serveOptimized write given result and cache it, unless it is a fallback or given original untouched.
+func (a *ImageOptimizer) serveOptimized(rw http.ResponseWriter, req *http.Request, key string, res processor.Result,
+	original []byte,
+) {
+	rw.Header().Set(contentLength, fmt.Sprint(len(res.Bytes)))
+	rw.Header().Set(contentType, res.Format)
 	rw.Header().Set(cacheStatus, cacheMissStatus)
 
-	_, err = rw.Write(optimized)
-	if err != nil {
+	if len(res.Stages) > 0 {
+		rw.Header().Set(serverTiming, serverTimingValue(res.Stages))
+	}
+
+	if _, err := rw.Write(res.Bytes); err != nil {
 		panic(err)
 	}
 
-	err = a.c.Set(key, optimized, cacheExpiry)
+	// Fallbacks and untouched images must not outlive the outage or misconfiguration which produced them.
+	if res.FellBack() || bytes.Equal(res.Bytes, original) {
+		return
+	}
+
+	cached := cachedImage{header: http.Header{contentType: {res.Format}}, body: res.Bytes}
+
+	// Hits skip probing, source dimensions are served from the cache along with the body.
+	for _, k := range []string{originalWidth, originalHeight} {
+		if v := rw.Header().Get(k); v != "" {
+			cached.header.Set(k, v)
+		}
+	}
+
+	if err := a.c.Set(req.Context(), key, cached.encode(), cacheExpiry); err != nil {
+		log.Printf("%s: unable to cache image: %v", a.name, err)
+	}
+}
+
+// serveCached write the cached image of given key along with its stored headers, it return false on cache miss.
+func (a *ImageOptimizer) serveCached(rw http.ResponseWriter, req *http.Request, key string) bool {
+	v, err := a.c.Get(req.Context(), key)
 	if err != nil {
+		if !errors.Is(err, cache.ErrNotFound) {
+			// Cache outage must not break responses, process as a miss.
+			log.Printf("%s: unable to get cached image, bypassing cache: %v", a.name, err)
+		}
+
+		return false
+	}
+
+	ci, err := decodeCachedImage(v)
+	if err != nil {
+		log.Printf("%s: unable to decode cached image, processing it again: %v", a.name, err)
+		return false
+	}
+
+	for k, values := range ci.header {
+		rw.Header()[k] = values
+	}
+
+	rw.Header().Set(contentLength, fmt.Sprint(len(ci.body)))
+	rw.Header().Set(cacheStatus, cacheHitStatus)
+
+	if _, err = rw.Write(ci.body); err != nil {
+		panic(err)
+	}
+
+	return true
+}
+
+// serveOriginal write the untouched upstream status and body.
+func (a *ImageOptimizer) serveOriginal(rw http.ResponseWriter, status int, body []byte) {
+	rw.WriteHeader(status)
+
+	if _, err := rw.Write(body); err != nil {
 		panic(err)
 	}
 }
@@ -166,7 +413,18 @@ func imageWidthRequest(req *http.Request) (int, error) {
 	return v, nil
 }
 
-// isImageResponse Determine with Content-Type header if the response is an image.
-func isImageResponse(rw http.ResponseWriter) bool {
-	return strings.HasPrefix(rw.Header().Get(contentType), "image/")
+// serverTimingValue format processor stages as Server-Timing metrics, failed ones are flagged.
+func serverTimingValue(stages []processor.Stage) string {
+	metrics := make([]string, 0, len(stages))
+
+	for _, s := range stages {
+		m := fmt.Sprintf("%s;dur=%.1f", s.Name, float64(s.Duration.Microseconds())/1000)
+		if s.Err != nil {
+			m += `;desc="failed"`
+		}
+
+		metrics = append(metrics, m)
+	}
+
+	return strings.Join(metrics, ", ")
 }
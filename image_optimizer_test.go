@@ -3,13 +3,38 @@ package imageopti
 import (
 	"bytes"
 	"context"
+	"errors"
+	"image"
+	"image/jpeg"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/agravelot/imageopti/cache"
 	"github.com/agravelot/imageopti/config"
+	"github.com/agravelot/imageopti/processor"
 )
 
+// testJPEG encode a decodable JPEG image.
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
 func TestImageOptimizer_ServeHTTP(t *testing.T) {
 	type args struct {
 		config config.Config
@@ -23,6 +48,7 @@ func TestImageOptimizer_ServeHTTP(t *testing.T) {
 		wantedSecondCacheStatus   string
 		remoteResponseContentType string
 		remoteResponseContent     []byte
+		processed                 bool
 		want                      bool
 		wantErr                   bool
 	}{
@@ -77,7 +103,7 @@ func TestImageOptimizer_ServeHTTP(t *testing.T) {
 		// 	remoteResponseContent:     []byte("dummy image"),
 		// },
 		{
-			name: "should not modify image with none driver and cache file driver with cache status",
+			name: "should process image with local driver and serve it from memory cache with its format",
 			args: args{
 				config: config.Config{
 					Processor: "local",
@@ -91,9 +117,22 @@ func TestImageOptimizer_ServeHTTP(t *testing.T) {
 			wantErr:                   false,
 			wantedCacheStatus:         "miss",
 			wantedSecondCacheStatus:   "hit",
-			wantedContentType:         "image/webp",
+			wantedContentType:         "image/jpeg", // WebP cannot be encoded by the local driver.
 			remoteResponseContentType: "image/jpeg",
-			remoteResponseContent:     []byte("dummy image"),
+			remoteResponseContent:     testJPEG(t),
+			processed:                 true,
+		},
+		{
+			name: "should not cache undecodable image with local driver",
+			args: args{
+				config: config.Config{
+					Processor: "local",
+					Cache:     "memory",
+				},
+			},
+			wantedContentType:         "image/jpeg",
+			remoteResponseContentType: "image/jpeg",
+			remoteResponseContent:     dummyJPEG, // Served untouched and not cached.
 		},
 		{
 			name: "should return original response if not image request and return no cache status header",
@@ -151,8 +190,9 @@ func TestImageOptimizer_ServeHTTP(t *testing.T) {
 
 			handler.ServeHTTP(recorder, req)
 
-			if !bytes.Equal(recorder.Body.Bytes(), tt.remoteResponseContent) {
-				t.Fatal("response are not equals")
+			first := recorder.Body.Bytes()
+			if bytes.Equal(first, tt.remoteResponseContent) == tt.processed {
+				t.Fatalf("response processed expected: %v", tt.processed)
 			}
 
 			if recorder.Header().Get("content-type") != tt.wantedContentType {
@@ -167,7 +207,7 @@ func TestImageOptimizer_ServeHTTP(t *testing.T) {
 
 			handler.ServeHTTP(recorder, req)
 
-			if !bytes.Equal(recorder.Body.Bytes(), tt.remoteResponseContent) {
+			if !bytes.Equal(recorder.Body.Bytes(), first) {
 				t.Fatal("response are not equals")
 			}
 
@@ -186,52 +226,736 @@ func TestImageOptimizer_ServeHTTP(t *testing.T) {
 	}
 }
 
-func TestIsImageResponse(t *testing.T) {
-	type args struct {
+// dummyJPEG is detected as JPEG from its leading bytes without being decodable.
+var dummyJPEG = []byte("\xff\xd8\xff\xe0dummy image")
+
+type failingCache struct {
+	cache.NoneCache
+}
+
+func (c *failingCache) Get(_ context.Context, _ string) ([]byte, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func (c *failingCache) Set(_ context.Context, _ string, _ []byte, _ time.Duration) error {
+	return errors.New("backend unavailable")
+}
+
+func TestImageOptimizer_ServeHTTPCacheOutage(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Add("content-type", "image/jpeg")
+		_, _ = rw.Write(dummyJPEG)
+	})
+
+	handler := &ImageOptimizer{
+		next: next,
+		name: "demo-plugin",
+		p:    &processor.NoneProcessor{},
+		c:    &failingCache{},
+
+		inputFormats: map[string]bool{processor.FormatJPEG: true},
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(recorder, req)
+
+	if !bytes.Equal(recorder.Body.Bytes(), dummyJPEG) {
+		t.Fatalf("response must be served despite cache outage, got %q", recorder.Body.Bytes())
+	}
+
+	if recorder.Header().Get("cache-status") != "miss" {
+		t.Errorf("response cache-status expected: miss got: %v", recorder.Header().Get("cache-status"))
+	}
+}
+
+type failingProcessor struct {
+	calls int
+}
+
+func (p *failingProcessor) Optimize(_ context.Context, _ processor.Request) (processor.Result, error) {
+	p.calls++
+
+	return processor.Result{}, errors.New("processor unavailable")
+}
+
+func TestImageOptimizer_ServeHTTPProcessorFailure(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Add("content-type", "image/jpeg")
+		_, _ = rw.Write(dummyJPEG)
+	})
+
+	fp := &failingProcessor{}
+
+	p, err := processor.NewResilient("demo-plugin/failing", fp, config.Config{
+		Breaker: config.BreakerConfig{MinRequests: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &ImageOptimizer{
+		next: next,
+		name: "demo-plugin",
+		p:    p,
+		c:    &cache.NoneCache{},
+
+		inputFormats: map[string]bool{processor.FormatJPEG: true},
+	}
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, req)
+
+		if !bytes.Equal(recorder.Body.Bytes(), dummyJPEG) {
+			t.Fatalf("original must be served on processor failure, got %q", recorder.Body.Bytes())
+		}
+
+		if recorder.Header().Get("content-type") != "image/jpeg" {
+			t.Errorf("response content-type expected: image/jpeg got: %v", recorder.Header().Get("content-type"))
+		}
+	}
+
+	if fp.calls != 1 {
+		t.Errorf("open breaker must serve originals without calling the processor, got %d calls", fp.calls)
+	}
+}
+
+func TestImageOptimizer_ServeHTTPPipeline(t *testing.T) {
+	// Metadata free JPEG left as is by strip, served without image content type.
+	body := testJPEG(t)
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Add("content-type", "application/octet-stream")
+		_, _ = rw.Write(body)
+	})
+
+	cfg := CreateConfig()
+	cfg.Cache = "none"
+	cfg.Pipeline = []config.ProcessorStageConfig{
+		{Processors: []string{"strip"}},
+		{Processors: []string{"none"}},
+	}
+
+	handler, err := New(context.Background(), next, cfg, "demo-plugin")
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(recorder, req)
+
+	if !bytes.Equal(recorder.Body.Bytes(), body) {
+		t.Fatalf("response are not equals, got %q", recorder.Body.Bytes())
+	}
+
+	timing := recorder.Header().Get("server-timing")
+	if !strings.HasPrefix(timing, "strip;dur=") || !strings.Contains(timing, ", none;dur=") {
+		t.Errorf("response server-timing expected strip then none stages, got: %v", timing)
+	}
+}
+
+type funcProcessor func(ctx context.Context, r processor.Request) (processor.Result, error)
+
+func (f funcProcessor) Optimize(ctx context.Context, r processor.Request) (processor.Result, error) {
+	return f(ctx, r)
+}
+
+// fetchingProcessor download sources itself.
+type fetchingProcessor struct {
+	recordingProcessor
+
+	err error
+}
+
+func (p *fetchingProcessor) FetchesSource() bool {
+	return true
+}
+
+func (p *fetchingProcessor) Optimize(_ context.Context, r processor.Request) (processor.Result, error) {
+	p.requests = append(p.requests, r)
+
+	return processor.Result{Bytes: []byte("fetched"), Format: "image/webp"}, p.err
+}
+
+func TestImageOptimizer_ServeHTTPSourceFetcher(t *testing.T) {
+	tests := []struct {
+		name          string
+		url           string
+		err           error
+		wantUpstream  bool
+		wantProcessed bool
+		wantRequests  int
+	}{
+		{
+			name:          "should process image without requesting upstream",
+			url:           "http://localhost/img/photo.JPG?w=10",
+			wantProcessed: true,
+			wantRequests:  1,
+		},
+		{
+			name:         "should serve unknown extension from upstream",
+			url:          "http://localhost/index.html",
+			wantUpstream: true,
+		},
+		{
+			name:         "should serve path without extension from upstream",
+			url:          "http://localhost/img",
+			wantUpstream: true,
+		},
+		{
+			name:         "should serve original from upstream on processor failure",
+			url:          "http://localhost/photo.png",
+			err:          errors.New("boom"),
+			wantUpstream: true,
+			wantRequests: 1,
+		},
+		{
+			name:         "should serve original from upstream when requested width exceeds limits",
+			url:          "http://localhost/photo.jpg?w=900000",
+			wantUpstream: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstream int
+
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				upstream++
+				_, _ = rw.Write([]byte("original"))
+			})
+
+			fp := &fetchingProcessor{err: tt.err}
+			handler := &ImageOptimizer{
+				next: next,
+				name: "demo-plugin",
+				p:    fp,
+				c:    &cache.NoneCache{},
+
+				inputFormats:  map[string]bool{processor.FormatJPEG: true, processor.FormatPNG: true},
+				limits:        limits{maxOutputWidth: 4096},
+				fetchesSource: true,
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+
+			if (upstream == 1) != tt.wantUpstream {
+				t.Errorf("upstream requests = %d, want requested %v", upstream, tt.wantUpstream)
+			}
+
+			want := "original"
+			if tt.wantProcessed {
+				want = "fetched"
+
+				if len(fp.requests) != 1 || fp.requests[0].Source != nil || fp.requests[0].Format != processor.FormatJPEG ||
+					fp.requests[0].Path != "/img/photo.JPG?w=10" || fp.requests[0].Spec.Width != 10 {
+					t.Errorf("processor requests = %+v, want a single jpeg request without source", fp.requests)
+				}
+			}
+
+			if len(fp.requests) != tt.wantRequests {
+				t.Errorf("processor requests = %+v, want %d", fp.requests, tt.wantRequests)
+			}
+
+			if recorder.Body.String() != want {
+				t.Errorf("response body = %q, want %q", recorder.Body.String(), want)
+			}
+		})
+	}
+}
+
+type recordingProcessor struct {
+	requests []processor.Request
+
+	// Reported output dimensions.
+	width, height int
+}
+
+func (p *recordingProcessor) formats() []string {
+	formats := make([]string, 0, len(p.requests))
+	for _, r := range p.requests {
+		formats = append(formats, r.Format)
+	}
+
+	return formats
+}
+
+func (p *recordingProcessor) Optimize(_ context.Context, r processor.Request) (processor.Result, error) {
+	p.requests = append(p.requests, r)
+
+	return processor.Result{Bytes: r.Source, Format: r.Format, Width: p.width, Height: p.height}, nil
+}
+
+func TestImageOptimizer_ServeHTTPFormatDetection(t *testing.T) {
+	tests := []struct {
+		name        string
 		contentType string
+		body        string
+		formats     []string
+		wantFormats []string
+	}{
+		{
+			name:        "should process image served as octet-stream",
+			contentType: "application/octet-stream",
+			body:        "GIF89a dummy",
+			wantFormats: []string{"image/gif"},
+		},
+		{
+			name:        "should pass detected format of mislabeled image",
+			contentType: "image/jpeg",
+			body:        "\x89PNG\r\n\x1a\n dummy",
+			wantFormats: []string{"image/png"},
+		},
+		{
+			name:        "should not process non image labeled as image",
+			contentType: "image/jpeg",
+			body:        "<html></html>",
+		},
+		{
+			name:        "should not process format missing from default allowlist",
+			contentType: "image/svg+xml",
+			body:        `<svg xmlns="http://www.w3.org/2000/svg"></svg>`,
+		},
+		{
+			name:        "should process format from configured allowlist",
+			contentType: "image/svg+xml",
+			body:        `<svg xmlns="http://www.w3.org/2000/svg"></svg>`,
+			formats:     []string{"svg"},
+			wantFormats: []string{"image/svg+xml"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formats, err := inputFormats(tt.formats)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rp := &recordingProcessor{}
+			handler := &ImageOptimizer{
+				next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					rw.Header().Add("content-type", tt.contentType)
+					_, _ = rw.Write([]byte(tt.body))
+				}),
+				name: "demo-plugin",
+				p:    rp,
+				c:    &cache.NoneCache{},
+
+				inputFormats: formats,
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Body.String() != tt.body {
+				t.Errorf("response are not equals, got %q", recorder.Body.Bytes())
+			}
+
+			if strings.Join(rp.formats(), ",") != strings.Join(tt.wantFormats, ",") {
+				t.Errorf("processed formats = %v, want %v", rp.formats(), tt.wantFormats)
+			}
+		})
 	}
+}
+
+func TestImageOptimizer_ServeHTTPDimensions(t *testing.T) {
+	// GIF logical screen of 640x480, enough for probing.
+	body := []byte("GIF89a\x80\x02\xe0\x01")
 
 	tests := []struct {
-		name    string
-		args    args
-		want    bool
-		wantErr bool
+		name      string
+		url       string
+		wantWidth int
+	}{
+		{name: "should keep smaller width", url: "http://localhost/?w=300", wantWidth: 300},
+		{name: "should clamp width to source width", url: "http://localhost/?w=1920", wantWidth: 640},
+		{name: "should keep missing width", url: "http://localhost/", wantWidth: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := &recordingProcessor{}
+			handler := &ImageOptimizer{
+				next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					rw.Header().Add("content-type", "image/gif")
+					_, _ = rw.Write(body)
+				}),
+				name: "demo-plugin",
+				p:    rp,
+				c:    &cache.NoneCache{},
+
+				inputFormats: map[string]bool{processor.FormatGIF: true},
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+
+			if len(rp.requests) != 1 || rp.requests[0].Spec.Width != tt.wantWidth {
+				t.Fatalf("processed requests = %+v, want width %d", rp.requests, tt.wantWidth)
+			}
+
+			if w, h := recorder.Header().Get("x-original-width"), recorder.Header().Get("x-original-height"); w != "640" || h != "480" {
+				t.Errorf("response original dimensions expected: 640x480 got: %sx%s", w, h)
+			}
+		})
+	}
+}
+
+func TestImageOptimizer_ServeHTTPCachedDimensions(t *testing.T) {
+	c, err := cache.NewMemoryCache(config.MemoryCacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = c.Close() })
+
+	handler := &ImageOptimizer{
+		next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Add("content-type", "image/gif")
+			_, _ = rw.Write([]byte("GIF89a\x80\x02\xe0\x01"))
+		}),
+		name: "demo-plugin",
+		p: funcProcessor(func(_ context.Context, _ processor.Request) (processor.Result, error) {
+			return processor.Result{Bytes: []byte("optimized"), Format: "image/webp"}, nil
+		}),
+		c: c,
+
+		inputFormats: map[string]bool{processor.FormatGIF: true},
+	}
+
+	for _, wantStatus := range []string{"miss", "hit"} {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/?w=300", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, req)
+
+		if got := recorder.Header().Get("cache-status"); got != wantStatus {
+			t.Fatalf("response cache status expected: %s got: %s", wantStatus, got)
+		}
+
+		if w, h := recorder.Header().Get("x-original-width"), recorder.Header().Get("x-original-height"); w != "640" || h != "480" {
+			t.Errorf("%s response original dimensions expected: 640x480 got: %sx%s", wantStatus, w, h)
+		}
+	}
+}
+
+func TestImageOptimizer_ServeHTTPLimits(t *testing.T) {
+	// PNG header of a 60000x60000 image, a few bytes decoding to gigabytes.
+	bomb := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR\x00\x00\xea\x60\x00\x00\xea\x60\x08\x06\x00\x00\x00")
+	small := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR\x00\x00\x00\x10\x00\x00\x00\x08\x08\x06\x00\x00\x00")
+	// BMP info header of a 60000x60000 image.
+	bmpBomb := []byte("BM\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x28\x00\x00\x00\x60\xea\x00\x00\x60\xea\x00\x00")
+
+	tests := []struct {
+		name          string
+		body          []byte
+		contentLength bool
+		limits        limits
+		outputWidth   int
+		wantCalls     int
 	}{
 		{
-			name:    "should return false with empty string",
-			args:    args{contentType: ""},
-			want:    false,
-			wantErr: false,
+			name:      "should process source within limits",
+			body:      small,
+			limits:    limits{maxSourceBytes: 1024, maxPixels: 1000},
+			wantCalls: 1,
 		},
 		{
-			name:    "should return true with jpeg content type",
-			args:    args{contentType: "image/jpeg"},
-			want:    true,
-			wantErr: false,
+			name:   "should serve original of source with unknown dimensions",
+			body:   dummyJPEG,
+			limits: limits{maxPixels: 1000},
 		},
 		{
-			name:    "should return true with webp content type",
-			args:    args{contentType: "image/webp"},
-			want:    true,
-			wantErr: false,
+			name:      "should process source with unknown dimensions without pixel limit",
+			body:      dummyJPEG,
+			wantCalls: 1,
 		},
 		{
-			name:    "should return false with json content type",
-			args:    args{contentType: "application/json"},
-			want:    false,
-			wantErr: false,
+			name:          "should stream source announced larger than limit",
+			body:          dummyJPEG,
+			contentLength: true,
+			limits:        limits{maxSourceBytes: 4},
+		},
+		{
+			name:   "should stream source growing larger than limit",
+			body:   dummyJPEG,
+			limits: limits{maxSourceBytes: 4},
+		},
+		{
+			name:   "should serve original of decompression bomb",
+			body:   bomb,
+			limits: limits{maxPixels: 50 * 1000 * 1000},
+		},
+		{
+			name:   "should serve original of bmp decompression bomb",
+			body:   bmpBomb,
+			limits: limits{maxPixels: 50 * 1000 * 1000},
+		},
+		{
+			name:        "should serve original when output is too large",
+			body:        dummyJPEG,
+			limits:      limits{maxOutputWidth: 1000, maxOutputHeight: 1000},
+			outputWidth: 2000,
+			wantCalls:   1,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			rp := &recordingProcessor{width: tt.outputWidth}
+			handler := &ImageOptimizer{
+				next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					rw.Header().Add("content-type", "image/jpeg")
+					if tt.contentLength {
+						rw.Header().Add("content-length", strconv.Itoa(len(tt.body)))
+					}
+
+					_, _ = rw.Write(tt.body[:3])
+					_, _ = rw.Write(tt.body[3:])
+				}),
+				name: "demo-plugin",
+				p:    rp,
+				c:    &cache.NoneCache{},
+
+				inputFormats: map[string]bool{processor.FormatJPEG: true, processor.FormatPNG: true, processor.FormatBMP: true},
+				limits:       tt.limits,
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
 			recorder := httptest.NewRecorder()
-			recorder.Header().Add("Content-Type", tt.args.contentType)
 
-			got := isImageResponse(recorder)
+			handler.ServeHTTP(recorder, req)
 
-			if got != tt.want {
-				t.Errorf("IsImageResponse() = %v, want %v", got, tt.want)
+			if !bytes.Equal(recorder.Body.Bytes(), tt.body) {
+				t.Errorf("original must be served, got %q", recorder.Body.Bytes())
+			}
+
+			if len(rp.requests) != tt.wantCalls {
+				t.Errorf("processor calls = %d, want %d", len(rp.requests), tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestImageOptimizer_ServeHTTPStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		wantProcessed bool
+	}{
+		{name: "should process implicit ok", wantProcessed: true},
+		{name: "should process explicit ok", status: http.StatusOK, wantProcessed: true},
+		{name: "should forward not found image untouched", status: http.StatusNotFound},
+		{name: "should forward partial content untouched", status: http.StatusPartialContent},
+		{name: "should forward server error untouched", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := testJPEG(t)
+			rp := &recordingProcessor{}
+
+			handler := &ImageOptimizer{
+				next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					if tt.status != 0 {
+						rw.WriteHeader(tt.status)
+					}
+
+					_, _ = rw.Write(body)
+				}),
+				name: "demo-plugin",
+				p:    rp,
+				c:    &cache.NoneCache{},
+
+				inputFormats: map[string]bool{processor.FormatJPEG: true},
+				limits:       limits{maxPixels: defaultMaxPixels},
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+
+			want := tt.status
+			if want == 0 {
+				want = http.StatusOK
+			}
+
+			if recorder.Code != want {
+				t.Errorf("response status = %d, want %d", recorder.Code, want)
+			}
+
+			if processed := len(rp.requests) > 0; processed != tt.wantProcessed {
+				t.Errorf("processed = %v, want %v", processed, tt.wantProcessed)
+			}
+
+			if !bytes.Equal(recorder.Body.Bytes(), body) {
+				t.Error("response body must be the upstream one")
+			}
+		})
+	}
+}
+
+func TestImageOptimizer_ServeHTTPCaching(t *testing.T) {
+	tests := []struct {
+		name       string
+		result     processor.Result
+		wantCached bool
+	}{
+		{
+			name:       "should cache optimized image",
+			result:     processor.Result{Bytes: []byte("optimized"), Format: "image/webp"},
+			wantCached: true,
+		},
+		{
+			name: "should not cache result of a fallback",
+			result: processor.Result{
+				Bytes:  []byte("optimized"),
+				Format: "image/webp",
+				Stages: []processor.Stage{{Name: "imaginary", Err: errors.New("unavailable")}, {Name: "none"}},
+			},
+		},
+		{
+			name:   "should not cache untouched image",
+			result: processor.Result{Bytes: dummyJPEG, Format: "image/jpeg"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := cache.NewMemoryCache(config.MemoryCacheConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Cleanup(func() { _ = c.Close() })
+
+			handler := &ImageOptimizer{
+				next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					rw.Header().Add("content-type", "image/jpeg")
+					_, _ = rw.Write(dummyJPEG)
+				}),
+				name: "demo-plugin",
+				p: funcProcessor(func(_ context.Context, _ processor.Request) (processor.Result, error) {
+					return tt.result, nil
+				}),
+				c: c,
+
+				inputFormats: map[string]bool{processor.FormatJPEG: true},
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got := c.Stats().Entries == 1; got != tt.wantCached {
+				t.Errorf("image cached = %v, want %v", got, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestServerTimingValue(t *testing.T) {
+	got := serverTimingValue([]processor.Stage{
+		{Name: "imaginary", Duration: 1500 * time.Microsecond, Err: processor.ErrCircuitOpen},
+		{Name: "local", Duration: 42 * time.Millisecond},
+	})
+
+	want := `imaginary;dur=1.5;desc="failed", local;dur=42.0`
+	if got != want {
+		t.Errorf("serverTimingValue() = %s, want %s", got, want)
+	}
+}
+
+func TestInputFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "should default to raster formats",
+			want: defaultInputFormats(),
+		},
+		{
+			name:  "should accept names, aliases and MIME types",
+			names: []string{"jpg", "PNG", "image/svg+xml"},
+			want:  []string{"image/jpeg", "image/png", "image/svg+xml"},
+		},
+		{
+			name:    "should not accept unknown format",
+			names:   []string{"jpeg", "psd"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := inputFormats(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("inputFormats() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("inputFormats() = %v, want %v", got, tt.want)
+			}
+
+			for _, f := range tt.want {
+				if !got[f] {
+					t.Errorf("inputFormats() = %v, missing %s", got, f)
+				}
 			}
 		})
 	}
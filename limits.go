@@ -0,0 +1,83 @@
+package imageopti
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+const (
+	defaultMaxSourceBytes = 32 << 20
+	defaultMaxPixels      = 50 * 1000 * 1000
+	// defaultMaxOutputSide is the largest WebP width and height.
+	defaultMaxOutputSide = 16383
+)
+
+// limits are resolved caps of a middleware, zero values mean unlimited.
+type limits struct {
+	maxSourceBytes  int64
+	maxPixels       int64
+	maxOutputWidth  int
+	maxOutputHeight int
+}
+
+// newLimits resolve given caps, zero values being replaced by defaults.
+func newLimits(conf config.LimitsConfig) (limits, error) {
+	if conf.MaxSourceBytes < 0 || conf.MaxPixels < 0 || conf.MaxOutputWidth < 0 || conf.MaxOutputHeight < 0 {
+		return limits{}, errors.New("limits cannot be negative")
+	}
+
+	l := limits{
+		maxSourceBytes:  conf.MaxSourceBytes,
+		maxPixels:       conf.MaxPixels,
+		maxOutputWidth:  conf.MaxOutputWidth,
+		maxOutputHeight: conf.MaxOutputHeight,
+	}
+
+	if l.maxSourceBytes == 0 {
+		l.maxSourceBytes = defaultMaxSourceBytes
+	}
+
+	if l.maxPixels == 0 {
+		l.maxPixels = defaultMaxPixels
+	}
+
+	if l.maxOutputWidth == 0 {
+		l.maxOutputWidth = defaultMaxOutputSide
+	}
+
+	if l.maxOutputHeight == 0 {
+		l.maxOutputHeight = defaultMaxOutputSide
+	}
+
+	return l, nil
+}
+
+// checkSource return why a source of given dimensions must not be processed into given width,
+// or an empty string. Unknown dimensions are zero.
+func (l limits) checkSource(srcWidth, srcHeight, width int) string {
+	if l.maxPixels > 0 && int64(srcWidth)*int64(srcHeight) > l.maxPixels {
+		return fmt.Sprintf("source of %dx%d exceeds %d pixels", srcWidth, srcHeight, l.maxPixels)
+	}
+
+	outWidth, outHeight := srcWidth, srcHeight
+	if width > 0 {
+		outWidth = width
+
+		if srcWidth > 0 {
+			outHeight = int(int64(srcHeight) * int64(width) / int64(srcWidth))
+		}
+	}
+
+	return l.checkOutput(outWidth, outHeight)
+}
+
+// checkOutput return why an image of given dimensions must not be served, or an empty string.
+func (l limits) checkOutput(width, height int) string {
+	if (l.maxOutputWidth > 0 && width > l.maxOutputWidth) || (l.maxOutputHeight > 0 && height > l.maxOutputHeight) {
+		return fmt.Sprintf("output of %dx%d exceeds %dx%d", width, height, l.maxOutputWidth, l.maxOutputHeight)
+	}
+
+	return ""
+}
@@ -0,0 +1,55 @@
+package imageopti
+
+import (
+	"testing"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+func TestNewLimits(t *testing.T) {
+	l, err := newLimits(config.LimitsConfig{MaxPixels: 100})
+	if err != nil {
+		t.Fatalf("newLimits() unexpected error: %v", err)
+	}
+
+	want := limits{
+		maxSourceBytes:  defaultMaxSourceBytes,
+		maxPixels:       100,
+		maxOutputWidth:  defaultMaxOutputSide,
+		maxOutputHeight: defaultMaxOutputSide,
+	}
+	if l != want {
+		t.Errorf("newLimits() = %+v, want %+v", l, want)
+	}
+
+	if _, err = newLimits(config.LimitsConfig{MaxSourceBytes: -1}); err == nil {
+		t.Error("newLimits() expected error with negative limit")
+	}
+}
+
+func TestLimits_CheckSource(t *testing.T) {
+	l := limits{maxPixels: 1000 * 1000, maxOutputWidth: 800, maxOutputHeight: 600}
+
+	tests := []struct {
+		name       string
+		srcWidth   int
+		srcHeight  int
+		width      int
+		wantReason string
+	}{
+		{name: "should accept source within limits", srcWidth: 800, srcHeight: 600},
+		{name: "should accept downscaled source", srcWidth: 1000, srcHeight: 1000, width: 600},
+		{name: "should accept unknown dimensions", width: 800},
+		{name: "should not accept too many pixels", srcWidth: 60000, srcHeight: 60000, width: 100, wantReason: "source of 60000x60000 exceeds 1000000 pixels"},
+		{name: "should not accept too wide output", srcWidth: 1000, srcHeight: 500, wantReason: "output of 1000x500 exceeds 800x600"},
+		{name: "should not accept too high output", srcWidth: 500, srcHeight: 1000, width: 400, wantReason: "output of 400x800 exceeds 800x600"},
+		{name: "should not accept too wide requested width", width: 1000, wantReason: "output of 1000x0 exceeds 800x600"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.checkSource(tt.srcWidth, tt.srcHeight, tt.width); got != tt.wantReason {
+				t.Errorf("checkSource() = %q, want %q", got, tt.wantReason)
+			}
+		})
+	}
+}
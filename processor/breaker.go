@@ -0,0 +1,211 @@
+package processor
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+const (
+	defaultBreakerErrorRate   = 0.5
+	defaultBreakerMinRequests = 20
+	defaultBreakerWindow      = 30 * time.Second
+	defaultBreakerOpenTimeout = 30 * time.Second
+)
+
+// BreakerState is the state of a processor circuit breaker.
+type BreakerState int
+
+// Circuit breaker states.
+const (
+	// BreakerClosed let every call through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen reject every call until its timeout elapse.
+	BreakerOpen
+	// BreakerHalfOpen let a single probe call through, its outcome close or open again the breaker.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+// breakerOutcome is the result of a call as seen by the breaker.
+type breakerOutcome int
+
+const (
+	outcomeSuccess breakerOutcome = iota
+	outcomeFailure
+	// outcomeIgnored is a call which tells nothing about the processor health, like a client cancellation.
+	outcomeIgnored
+)
+
+// breaker open after too many failed calls within a window, sparing the request path from a failing processor.
+type breaker struct {
+	name string
+
+	errorRate   float64
+	minRequests int
+	window      time.Duration
+	openTimeout time.Duration
+	now         func() time.Time
+
+	mu          sync.Mutex
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+}
+
+func newBreaker(name string, conf config.BreakerConfig) (*breaker, error) {
+	errorRate := conf.ErrorRate
+	switch {
+	case errorRate < 0 || errorRate > 1:
+		return nil, fmt.Errorf("breaker error rate must be between 0 and 1, got %v", errorRate)
+	case errorRate == 0:
+		errorRate = defaultBreakerErrorRate
+	}
+
+	minRequests := conf.MinRequests
+	switch {
+	case minRequests < 0:
+		return nil, fmt.Errorf("breaker min requests cannot be negative")
+	case minRequests == 0:
+		minRequests = defaultBreakerMinRequests
+	}
+
+	window, err := parseDuration(conf.Window, defaultBreakerWindow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid breaker window: %w", err)
+	}
+
+	openTimeout, err := parseDuration(conf.OpenTimeout, defaultBreakerOpenTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid breaker open timeout: %w", err)
+	}
+
+	return &breaker{
+		name:        name,
+		errorRate:   errorRate,
+		minRequests: minRequests,
+		window:      window,
+		openTimeout: openTimeout,
+		now:         time.Now,
+		windowStart: time.Now(),
+	}, nil
+}
+
+// State return current breaker state, an open breaker past its timeout is reported half-open.
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.openTimeout {
+		return BreakerHalfOpen
+	}
+
+	return b.state
+}
+
+// allow report whether a call may proceed, its outcome must then be given to record.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.openTimeout {
+			return false
+		}
+
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+
+		b.probing = true
+
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) record(o breakerOutcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+
+		switch o {
+		case outcomeSuccess:
+			b.reset(now)
+			b.setState(BreakerClosed)
+		case outcomeFailure:
+			b.open(now)
+		}
+
+		return
+	}
+
+	if b.state != BreakerClosed || o == outcomeIgnored {
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.window {
+		b.reset(now)
+	}
+
+	b.requests++
+	if o == outcomeFailure {
+		b.failures++
+	}
+
+	if b.requests >= b.minRequests && float64(b.failures)/float64(b.requests) >= b.errorRate {
+		b.open(now)
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.openedAt = now
+	b.reset(now)
+	b.setState(BreakerOpen)
+}
+
+func (b *breaker) reset(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+// setState change state and log transitions, must be called with lock held.
+func (b *breaker) setState(s BreakerState) {
+	if b.state == s {
+		return
+	}
+
+	log.Printf("%s: circuit breaker %s -> %s", b.name, b.state, s)
+
+	b.state = s
+}
@@ -0,0 +1,160 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestBreaker(t *testing.T, conf config.BreakerConfig) (*breaker, *fakeClock) {
+	t.Helper()
+
+	b, err := newBreaker("test", conf)
+	if err != nil {
+		t.Fatalf("newBreaker() unexpected error: %v", err)
+	}
+
+	clock := &fakeClock{t: time.Now()}
+	b.now = clock.now
+	b.windowStart = clock.t
+
+	return b, clock
+}
+
+func TestNewBreaker_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.BreakerConfig
+	}{
+		{name: "should not accept error rate above 1", conf: config.BreakerConfig{ErrorRate: 1.5}},
+		{name: "should not accept negative error rate", conf: config.BreakerConfig{ErrorRate: -0.1}},
+		{name: "should not accept negative min requests", conf: config.BreakerConfig{MinRequests: -1}},
+		{name: "should not accept invalid window", conf: config.BreakerConfig{Window: "1"}},
+		{name: "should not accept invalid open timeout", conf: config.BreakerConfig{OpenTimeout: "-1s"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newBreaker("test", tt.conf); err == nil {
+				t.Error("newBreaker() expected error")
+			}
+		})
+	}
+}
+
+func TestBreaker_Open(t *testing.T) {
+	b, _ := newTestBreaker(t, config.BreakerConfig{ErrorRate: 0.5, MinRequests: 4})
+
+	for _, o := range []breakerOutcome{outcomeSuccess, outcomeFailure, outcomeSuccess} {
+		if !b.allow() {
+			t.Fatal("allow() = false, want true while closed")
+		}
+
+		b.record(o)
+	}
+
+	if b.State() != BreakerClosed {
+		t.Fatalf("State() = %s, want closed below min requests", b.State())
+	}
+
+	b.allow()
+	b.record(outcomeFailure)
+
+	if b.State() != BreakerOpen {
+		t.Fatalf("State() = %s, want open", b.State())
+	}
+
+	if b.allow() {
+		t.Error("allow() = true, want false while open")
+	}
+}
+
+func TestBreaker_IgnoredOutcomes(t *testing.T) {
+	b, _ := newTestBreaker(t, config.BreakerConfig{MinRequests: 1})
+
+	b.allow()
+	b.record(outcomeIgnored)
+
+	if b.State() != BreakerClosed {
+		t.Errorf("State() = %s, ignored outcomes must not open the breaker", b.State())
+	}
+}
+
+func TestBreaker_Window(t *testing.T) {
+	b, clock := newTestBreaker(t, config.BreakerConfig{ErrorRate: 0.5, MinRequests: 2, Window: "10s"})
+
+	b.allow()
+	b.record(outcomeFailure)
+
+	clock.t = clock.t.Add(11 * time.Second)
+
+	b.allow()
+	b.record(outcomeFailure)
+
+	if b.State() != BreakerClosed {
+		t.Errorf("State() = %s, failures of previous window must not be counted", b.State())
+	}
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	b, clock := newTestBreaker(t, config.BreakerConfig{MinRequests: 1, OpenTimeout: "5s"})
+
+	b.allow()
+	b.record(outcomeFailure)
+
+	clock.t = clock.t.Add(5 * time.Second)
+
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("State() = %s, want half-open after timeout", b.State())
+	}
+
+	if !b.allow() {
+		t.Fatal("allow() = false, a probe must be let through")
+	}
+
+	if b.allow() {
+		t.Fatal("allow() = true, only one probe must be let through")
+	}
+
+	b.record(outcomeFailure)
+
+	if b.State() != BreakerOpen {
+		t.Fatalf("State() = %s, failed probe must open the breaker again", b.State())
+	}
+
+	clock.t = clock.t.Add(5 * time.Second)
+
+	b.allow()
+	b.record(outcomeIgnored)
+
+	if !b.allow() {
+		t.Fatal("allow() = false, an ignored probe must release the probe slot")
+	}
+
+	b.record(outcomeSuccess)
+
+	if b.State() != BreakerClosed {
+		t.Errorf("State() = %s, successful probe must close the breaker", b.State())
+	}
+}
+
+func TestBreakerState_String(t *testing.T) {
+	for s, want := range map[BreakerState]string{
+		BreakerClosed:   "closed",
+		BreakerOpen:     "open",
+		BreakerHalfOpen: "half-open",
+		BreakerState(9): "BreakerState(9)",
+	} {
+		if s.String() != want {
+			t.Errorf("String() = %s, want %s", s.String(), want)
+		}
+	}
+}
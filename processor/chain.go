@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+type namedProcessor struct {
+	name string
+	p    Processor
+}
+
+// ChainProcessor run processors stages in order, each stage falling back to its next processor
+// when one fails or its circuit breaker is open.
+type ChainProcessor struct {
+	stages [][]namedProcessor
+}
+
+func newChain(name string, conf config.Config) (*ChainProcessor, error) {
+	c := &ChainProcessor{}
+
+	for i, stage := range conf.Pipeline {
+		if len(stage.Processors) == 0 {
+			return nil, fmt.Errorf("pipeline stage %d has no processor", i)
+		}
+
+		var ps []namedProcessor
+
+		for _, pn := range stage.Processors {
+			pc := conf
+			pc.Processor = pn
+			pc.Pipeline = nil
+
+			p, err := New(name, pc)
+			if err != nil {
+				return nil, fmt.Errorf("pipeline stage %d: %w", i, err)
+			}
+
+			// Each processor has its own breaker, an open one fall back immediately.
+			rp, err := NewResilient(name+"/"+pn, p, conf)
+			if err != nil {
+				return nil, err
+			}
+
+			ps = append(ps, namedProcessor{name: pn, p: rp})
+		}
+
+		if err := checkSourceFetchers(i, ps); err != nil {
+			return nil, err
+		}
+
+		c.stages = append(c.stages, ps)
+	}
+
+	return c, nil
+}
+
+// checkSourceFetchers reject processors downloading sources themselves past the first stage, they would
+// discard the output of previous stages. First stage processors must all fetch sources or none, as fallbacks
+// are given the same request.
+func checkSourceFetchers(i int, ps []namedProcessor) error {
+	for _, np := range ps {
+		fetches := FetchesSource(np.p)
+
+		switch {
+		case fetches && i > 0:
+			return fmt.Errorf("pipeline stage %d: %s fetches sources itself and would discard previous stages output", i, np.name)
+		case fetches != FetchesSource(ps[0].p):
+			return fmt.Errorf("pipeline stage %d: %s cannot fall back to %s, only one of them fetches sources itself",
+				i, ps[0].name, np.name)
+		}
+	}
+
+	return nil
+}
+
+// FetchesSource report whether first stage processors download sources themselves.
+func (c *ChainProcessor) FetchesSource() bool {
+	return len(c.stages) > 0 && FetchesSource(c.stages[0][0].p)
+}
+
+// Optimize run every stage, feeding each one with the output of the previous one.
+func (c *ChainProcessor) Optimize(ctx context.Context, req Request) (Result, error) {
+	var (
+		res    Result
+		stages []Stage
+	)
+
+	for i, ps := range c.stages {
+		var err error
+
+		res, stages, err = runStage(ctx, ps, req, stages)
+		if err != nil {
+			return Result{}, fmt.Errorf("pipeline stage %d failed: %w", i, err)
+		}
+
+		req.Source = res.Bytes
+		req.Format = res.Format
+	}
+
+	res.Stages = stages
+
+	return res, nil
+}
+
+// runStage try given processors in order until one succeeds, appending their reports to stages.
+func runStage(ctx context.Context, ps []namedProcessor, req Request, stages []Stage) (Result, []Stage, error) {
+	var err error
+
+	for _, np := range ps {
+		start := time.Now()
+
+		var res Result
+
+		res, err = np.p.Optimize(ctx, req)
+		stages = append(stages, Stage{Name: np.name, Duration: time.Since(start), Err: err})
+
+		if err == nil {
+			return res, stages, nil
+		}
+
+		if ctx.Err() != nil {
+			return Result{}, stages, ctx.Err()
+		}
+	}
+
+	return Result{}, stages, err
+}
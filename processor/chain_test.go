@@ -0,0 +1,250 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+func stagesNames(stages []Stage) []string {
+	names := make([]string, 0, len(stages))
+
+	for _, s := range stages {
+		name := s.Name
+		if s.Err != nil {
+			name += "!"
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func appendProcessor(suffix string) Processor {
+	return funcProcessor(func(_ context.Context, req Request) (Result, error) {
+		return Result{Bytes: append(append([]byte{}, req.Source...), suffix...), Format: req.Format + suffix}, nil
+	})
+}
+
+func failingProcessor(err error) Processor {
+	return funcProcessor(func(_ context.Context, _ Request) (Result, error) {
+		return Result{}, err
+	})
+}
+
+func TestChainProcessor_Optimize(t *testing.T) {
+	boom := errors.New("boom")
+
+	tests := []struct {
+		name         string
+		stages       [][]namedProcessor
+		want         string
+		wantStages   []string
+		wantFellBack bool
+		wantErr      error
+	}{
+		{
+			name: "should run stages in order",
+			stages: [][]namedProcessor{
+				{{name: "a", p: appendProcessor("-a")}},
+				{{name: "b", p: appendProcessor("-b")}},
+			},
+			want:       "src-a-b",
+			wantStages: []string{"a", "b"},
+		},
+		{
+			name: "should fall back to next processor",
+			stages: [][]namedProcessor{
+				{{name: "a", p: appendProcessor("-a")}},
+				{{name: "b", p: failingProcessor(boom)}, {name: "c", p: failingProcessor(ErrCircuitOpen)}, {name: "d", p: appendProcessor("-d")}},
+			},
+			want:         "src-a-d",
+			wantStages:   []string{"a", "b!", "c!", "d"},
+			wantFellBack: true,
+		},
+		{
+			name: "should fail when every fallback fail",
+			stages: [][]namedProcessor{
+				{{name: "b", p: failingProcessor(errors.New("first"))}, {name: "c", p: failingProcessor(boom)}},
+				{{name: "d", p: appendProcessor("-d")}},
+			},
+			wantErr: boom,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ChainProcessor{stages: tt.stages}
+
+			got, err := c.Optimize(context.Background(), Request{Source: []byte("src"), Format: "src"})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Optimize() error = %v, want %v", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Optimize() unexpected error: %v", err)
+			}
+
+			if string(got.Bytes) != tt.want || got.Format != tt.want {
+				t.Errorf("Optimize() = %s %s, want %s", got.Bytes, got.Format, tt.want)
+			}
+
+			if names := stagesNames(got.Stages); !reflect.DeepEqual(names, tt.wantStages) {
+				t.Errorf("Optimize() stages = %v, want %v", names, tt.wantStages)
+			}
+
+			if got.FellBack() != tt.wantFellBack {
+				t.Errorf("Optimize() fell back = %v, want %v", got.FellBack(), tt.wantFellBack)
+			}
+		})
+	}
+}
+
+func TestChainProcessor_BreakerNames(t *testing.T) {
+	got, err := New("demo-plugin", config.Config{
+		Pipeline: []config.ProcessorStageConfig{{Processors: []string{"strip", "none"}}},
+	})
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+
+	c, ok := got.(*ChainProcessor)
+	if !ok {
+		t.Fatalf("New() = %T, want *ChainProcessor", got)
+	}
+
+	for _, np := range c.stages[0] {
+		rp, ok := np.p.(*ResilientProcessor)
+		if !ok {
+			t.Fatalf("stage processor %s = %T, want *ResilientProcessor", np.name, np.p)
+		}
+
+		if want := "demo-plugin/" + np.name; rp.name != want {
+			t.Errorf("breaker name = %s, want %s", rp.name, want)
+		}
+	}
+}
+
+func TestChainProcessor_FetchesSource(t *testing.T) {
+	c, err := New("test", config.Config{
+		Imgproxy: config.ImgproxyProcessorConfig{URL: "http://imgproxy:8080", SourceBaseURL: "http://backend"},
+		Pipeline: []config.ProcessorStageConfig{{Processors: []string{"imgproxy"}}, {Processors: []string{"strip"}}},
+	})
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+
+	if !FetchesSource(c) {
+		t.Error("chain must fetch sources when its first stage does")
+	}
+
+	if FetchesSource(&ChainProcessor{stages: [][]namedProcessor{{{name: "none", p: &NoneProcessor{}}}}}) {
+		t.Error("chain must not fetch sources when its first stage does not")
+	}
+}
+
+func TestChainProcessor_OptimizeCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+
+	c := &ChainProcessor{stages: [][]namedProcessor{{
+		{name: "a", p: funcProcessor(func(ctx context.Context, _ Request) (Result, error) {
+			return Result{}, ctx.Err()
+		})},
+		{name: "b", p: funcProcessor(func(_ context.Context, _ Request) (Result, error) {
+			called = true
+			return Result{}, nil
+		})},
+	}}}
+
+	if _, err := c.Optimize(ctx, Request{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Optimize() error = %v, want %v", err, context.Canceled)
+	}
+
+	if called {
+		t.Error("canceled request must not fall back")
+	}
+}
+
+func TestNew_Pipeline(t *testing.T) {
+	imgproxyConf := config.Config{Imgproxy: config.ImgproxyProcessorConfig{URL: "http://imgproxy:8080", SourceBaseURL: "http://backend"}}
+
+	tests := []struct {
+		name     string
+		pipeline []config.ProcessorStageConfig
+		conf     config.Config
+		wantErr  bool
+	}{
+		{
+			name:     "should build chain",
+			pipeline: []config.ProcessorStageConfig{{Processors: []string{"strip"}}, {Processors: []string{"local", "none"}}},
+		},
+		{
+			name:     "should not accept empty stage",
+			pipeline: []config.ProcessorStageConfig{{}},
+			wantErr:  true,
+		},
+		{
+			name:     "should not accept unknown processor",
+			pipeline: []config.ProcessorStageConfig{{Processors: []string{"unsupported"}}},
+			wantErr:  true,
+		},
+		{
+			name:     "should not accept both processor and pipeline",
+			pipeline: []config.ProcessorStageConfig{{Processors: []string{"none"}}},
+			conf:     config.Config{Processor: "none"},
+			wantErr:  true,
+		},
+		{
+			name:     "should not accept source fetcher after another stage",
+			pipeline: []config.ProcessorStageConfig{{Processors: []string{"strip"}}, {Processors: []string{"imgproxy"}}},
+			conf:     imgproxyConf,
+			wantErr:  true,
+		},
+		{
+			name:     "should not accept source fetcher falling back to uploading processor",
+			pipeline: []config.ProcessorStageConfig{{Processors: []string{"imgproxy", "local"}}, {Processors: []string{"none"}}},
+			conf:     imgproxyConf,
+			wantErr:  true,
+		},
+		{
+			name:     "should not accept invalid resilience config",
+			pipeline: []config.ProcessorStageConfig{{Processors: []string{"none"}}},
+			conf:     config.Config{Retry: config.RetryConfig{MaxAttempts: -1}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := tt.conf
+			conf.Pipeline = tt.pipeline
+
+			got, err := New("test", conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				if got != nil {
+					t.Errorf("New() = %v, want nil on error", got)
+				}
+
+				return
+			}
+
+			c, ok := got.(*ChainProcessor)
+			if !ok || len(c.stages) != 2 || len(c.stages[1]) != 2 || c.stages[1][0].name != "local" {
+				t.Errorf("New() = %#v, want chain of configured stages", got)
+			}
+		})
+	}
+}
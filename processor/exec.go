@@ -0,0 +1,268 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+const (
+	defaultExecTimeout = 30 * time.Second
+	defaultExecQuality = 75
+)
+
+// execCommand is an encoder command line template.
+type execCommand struct {
+	args      []string
+	useInput  bool
+	useOutput bool
+}
+
+// ExecProcessor process images with external commands like cwebp, avifenc or jpegoptim, chosen by target format.
+type ExecProcessor struct {
+	commands       map[string]execCommand
+	timeout        time.Duration
+	maxOutputBytes int64
+	tempDir        string
+}
+
+// NewExec instantiate a new exec processor with given config.
+func NewExec(conf config.Config) (*ExecProcessor, error) {
+	c := conf.Exec
+
+	if len(c.Commands) == 0 {
+		return nil, errors.New("exec commands cannot be empty")
+	}
+
+	timeout, err := parseDuration(c.Timeout, defaultExecTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exec timeout: %w", err)
+	}
+
+	maxOutputBytes, err := responseLimit("exec max output bytes", c.MaxOutputBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ep := &ExecProcessor{
+		commands:       map[string]execCommand{},
+		timeout:        timeout,
+		maxOutputBytes: maxOutputBytes,
+		tempDir:        c.TempDir,
+	}
+
+	for name, cmd := range c.Commands {
+		if len(cmd.Args) == 0 || cmd.Args[0] == "" {
+			return nil, fmt.Errorf("exec command of %s cannot be empty", name)
+		}
+
+		ec := execCommand{args: cmd.Args}
+
+		for _, a := range cmd.Args {
+			ec.useInput = ec.useInput || strings.Contains(a, "{input}")
+			ec.useOutput = ec.useOutput || strings.Contains(a, "{output}")
+		}
+
+		ep.commands[ParseFormat(name)] = ec
+	}
+
+	return ep, nil
+}
+
+// formatExtension return the file extension of given MIME type, some encoders infer formats from it.
+func formatExtension(format string) string {
+	ext := strings.TrimPrefix(mimeType(format), "image/")
+
+	switch ext {
+	case "jpeg":
+		return ".jpg"
+	case "", "svg+xml":
+		return ".img"
+	default:
+		return "." + ext
+	}
+}
+
+// Optimize run the command of the target format, or of the source format when none matches.
+func (ep *ExecProcessor) Optimize(ctx context.Context, r Request) (Result, error) {
+	tf := mimeType(r.Spec.TargetFormat)
+	if tf == "" {
+		tf = mimeType(r.Format)
+	}
+
+	cmd, ok := ep.commands[tf]
+	if !ok {
+		tf = mimeType(r.Format)
+
+		if cmd, ok = ep.commands[tf]; !ok {
+			return Result{}, fmt.Errorf("no exec command for %q", r.Spec.TargetFormat)
+		}
+	}
+
+	out, err := ep.run(ctx, cmd, r, tf)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Bytes:    out,
+		Format:   tf,
+		Metadata: map[string]string{"processor": "exec"},
+	}, nil
+}
+
+// run execute given command, going through temporary files only when its arguments ask for them.
+func (ep *ExecProcessor) run(ctx context.Context, cmd execCommand, r Request, tf string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ep.timeout)
+	defer cancel()
+
+	input, output, cleanup, err := ep.tempFiles(cmd, r, tf)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	args := cmd.expand(r, input, output)
+
+	// Only the started process is killed on timeout, plugins cannot use syscall to start it in its own
+	// process group. Wrapper scripts must exec encoders, otherwise they keep running and Run waits for
+	// them to close stdout.
+	// #nosec G204 -- commands come from the middleware configuration, arguments are never passed to a shell.
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+
+	stdout := &cappedBuffer{max: ep.maxOutputBytes}
+	stderr := &cappedBuffer{max: maxErrorBodySize}
+	c.Stdout, c.Stderr = stdout, stderr
+
+	if !cmd.useInput {
+		c.Stdin = bytes.NewReader(r.Source)
+	}
+
+	if err = c.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("exec %s: %w", args[0], ctx.Err())
+		}
+
+		return nil, fmt.Errorf("exec %s: %w: %s", args[0], err, strings.TrimSpace(stderr.buf.String()))
+	}
+
+	if cmd.useOutput {
+		return ep.readOutput(args[0], output)
+	}
+
+	if stdout.overflow {
+		return nil, fmt.Errorf("exec %s output: %w", args[0], errResponseTooLarge)
+	}
+
+	if stdout.buf.Len() == 0 {
+		return nil, fmt.Errorf("exec %s wrote no output", args[0])
+	}
+
+	return stdout.buf.Bytes(), nil
+}
+
+// tempFiles return paths of the input, written with the source, and output files of given command when its
+// arguments ask for them, along with a func removing them.
+func (ep *ExecProcessor) tempFiles(cmd execCommand, r Request, tf string) (string, string, func(), error) {
+	if !cmd.useInput && !cmd.useOutput {
+		return "", "", func() {}, nil
+	}
+
+	dir, err := ioutil.TempDir(ep.tempDir, "imageopti-exec-")
+	if err != nil {
+		return "", "", nil, fmt.Errorf("unable to create exec temporary directory: %w", err)
+	}
+
+	cleanup := func() {
+		_ = os.RemoveAll(dir)
+	}
+
+	input := filepath.Join(dir, "input"+formatExtension(r.Format))
+	output := filepath.Join(dir, "output"+formatExtension(tf))
+
+	if cmd.useInput {
+		if err = ioutil.WriteFile(input, r.Source, 0600); err != nil {
+			cleanup()
+
+			return "", "", nil, fmt.Errorf("unable to write exec input: %w", err)
+		}
+	}
+
+	return input, output, cleanup, nil
+}
+
+// expand replace placeholders of the command arguments.
+func (cmd execCommand) expand(r Request, input, output string) []string {
+	quality := r.Spec.Quality
+	if quality <= 0 {
+		quality = defaultExecQuality
+	}
+
+	replacer := strings.NewReplacer(
+		"{input}", input,
+		"{output}", output,
+		"{quality}", strconv.Itoa(quality),
+		"{width}", strconv.Itoa(r.Spec.Width),
+		"{height}", strconv.Itoa(r.Spec.Height),
+	)
+
+	args := make([]string, len(cmd.args))
+	for i, a := range cmd.args {
+		args[i] = replacer.Replace(a)
+	}
+
+	return args
+}
+
+// readOutput read the output file of given command, within the output size limit.
+func (ep *ExecProcessor) readOutput(name, path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("exec %s did not write its output: %w", name, err)
+	}
+
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("exec %s wrote no output", name)
+	}
+
+	if info.Size() > ep.maxOutputBytes {
+		return nil, fmt.Errorf("exec %s output: %w", name, errResponseTooLarge)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read exec output: %w", err)
+	}
+
+	return b, nil
+}
+
+// cappedBuffer keep at most max bytes, discarding the rest so that commands are never blocked on a full pipe.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - int64(b.buf.Len()); int64(len(p)) > room {
+		b.overflow = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+
+		return len(p), nil
+	}
+
+	return b.buf.Write(p)
+}
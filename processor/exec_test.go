@@ -0,0 +1,176 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+// writeScript write an executable shell script standing in for an encoder.
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "encoder.sh")
+	if err := ioutil.WriteFile(p, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func newTestExec(t *testing.T, conf config.ExecProcessorConfig) *ExecProcessor {
+	t.Helper()
+
+	p, err := NewExec(config.Config{Exec: conf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestNewExec_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.ExecProcessorConfig
+	}{
+		{name: "should not accept missing commands", conf: config.ExecProcessorConfig{}},
+		{
+			name: "should not accept empty command",
+			conf: config.ExecProcessorConfig{Commands: map[string]config.ExecCommandConfig{"webp": {}}},
+		},
+		{
+			name: "should not accept invalid timeout",
+			conf: config.ExecProcessorConfig{Commands: map[string]config.ExecCommandConfig{"webp": {Args: []string{"cwebp"}}}, Timeout: "1"},
+		},
+		{
+			name: "should not accept negative output limit",
+			conf: config.ExecProcessorConfig{Commands: map[string]config.ExecCommandConfig{"webp": {Args: []string{"cwebp"}}}, MaxOutputBytes: -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewExec(config.Config{Exec: tt.conf}); err == nil {
+				t.Error("NewExec() expected error")
+			}
+		})
+	}
+}
+
+func TestExecProcessor_Optimize(t *testing.T) {
+	piped := writeScript(t, `printf '%s %s %s ' "$1" "$2" "$3"; cat`)
+	files := writeScript(t, `case "$2" in *.webp) ;; *) exit 1 ;; esac; cp "$1" "$2"; printf ' q=%s' "$3" >> "$2"`)
+
+	tests := []struct {
+		name       string
+		commands   map[string]config.ExecCommandConfig
+		request    Request
+		wantBytes  string
+		wantFormat string
+	}{
+		{
+			name:       "should pipe through stdin and stdout",
+			commands:   map[string]config.ExecCommandConfig{"webp": {Args: []string{piped, "{quality}", "{width}", "{height}"}}},
+			request:    Request{Source: []byte("original"), Format: "image/jpeg", Spec: Spec{TargetFormat: "image/webp", Quality: 80, Width: 300}},
+			wantBytes:  "80 300 0 original",
+			wantFormat: "image/webp",
+		},
+		{
+			name:       "should go through temporary files",
+			commands:   map[string]config.ExecCommandConfig{"image/webp": {Args: []string{files, "{input}", "{output}", "{quality}"}}},
+			request:    Request{Source: []byte("original"), Format: "image/jpeg", Spec: Spec{TargetFormat: "image/webp"}},
+			wantBytes:  "original q=75",
+			wantFormat: "image/webp",
+		},
+		{
+			name:       "should fall back to source format command",
+			commands:   map[string]config.ExecCommandConfig{"jpg": {Args: []string{piped, "{quality}", "{width}", "{height}"}}},
+			request:    Request{Source: []byte("original"), Format: "image/jpeg", Spec: Spec{TargetFormat: "image/avif", Quality: 60}},
+			wantBytes:  "60 0 0 original",
+			wantFormat: "image/jpeg",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			p := newTestExec(t, config.ExecProcessorConfig{Commands: tt.commands, TempDir: tmp})
+
+			got, err := p.Optimize(context.Background(), tt.request)
+			if err != nil {
+				t.Fatalf("Optimize() unexpected error: %v", err)
+			}
+
+			if string(got.Bytes) != tt.wantBytes || got.Format != tt.wantFormat || got.Metadata["processor"] != "exec" {
+				t.Errorf("Optimize() = %q %s %v, want %q %s", got.Bytes, got.Format, got.Metadata, tt.wantBytes, tt.wantFormat)
+			}
+
+			if entries, _ := ioutil.ReadDir(tmp); len(entries) != 0 {
+				t.Errorf("Optimize() must remove temporary files, found %d", len(entries))
+			}
+		})
+	}
+}
+
+func TestExecProcessor_OptimizeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		args    []string
+		conf    config.ExecProcessorConfig
+		target  string
+		wantErr error
+		wantMsg string
+	}{
+		{name: "should report command failure", script: "echo boom >&2; exit 3", wantMsg: "boom"},
+		{name: "should report missing output", script: "cat > /dev/null"},
+		{name: "should report missing output file", script: "true", args: []string{"{output}"}},
+		{name: "should enforce timeout", script: "exec sleep 5", conf: config.ExecProcessorConfig{Timeout: "50ms"}, wantErr: context.DeadlineExceeded},
+		{
+			name:    "should enforce stdout size limit",
+			script:  "head -c 100 /dev/zero",
+			conf:    config.ExecProcessorConfig{MaxOutputBytes: 10},
+			wantErr: errResponseTooLarge,
+		},
+		{
+			name:    "should enforce output file size limit",
+			script:  `head -c 100 /dev/zero > "$1"`,
+			args:    []string{"{output}"},
+			conf:    config.ExecProcessorConfig{MaxOutputBytes: 10},
+			wantErr: errResponseTooLarge,
+		},
+		{name: "should not accept format without command", script: "cat", target: "image/avif"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := tt.conf
+			conf.Commands = map[string]config.ExecCommandConfig{"webp": {Args: append([]string{writeScript(t, tt.script)}, tt.args...)}}
+
+			target := tt.target
+			if target == "" {
+				target = "image/webp"
+			}
+
+			_, err := newTestExec(t, conf).Optimize(context.Background(), Request{
+				Source: []byte("original"),
+				Format: "image/png",
+				Spec:   Spec{TargetFormat: target},
+			})
+			if err == nil {
+				t.Fatal("Optimize() expected error")
+			}
+
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Optimize() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("Optimize() error = %v, want message %q", err, tt.wantMsg)
+			}
+		})
+	}
+}
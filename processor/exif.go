@@ -0,0 +1,184 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// EXIF orientations, as stored in the Orientation tag of IFD0.
+const (
+	orientationNormal     = 1
+	orientationFlipH      = 2
+	orientationRotate180  = 3
+	orientationFlipV      = 4
+	orientationTranspose  = 5
+	orientationRotate90   = 6 // Clockwise.
+	orientationTransverse = 7
+	orientationRotate270  = 8 // Clockwise.
+)
+
+const (
+	exifOrientationTag = 0x0112
+	exifTypeShort      = 3
+	exifIFDEntrySize   = 12
+	tiffHeaderSize     = 8
+)
+
+const exifHeader = "Exif\x00\x00"
+
+// exifOrientation return the EXIF orientation of given JPEG or PNG image, normal when unknown or invalid.
+func exifOrientation(b []byte) int {
+	var tiff []byte
+
+	switch {
+	case len(b) >= 2 && b[0] == 0xff && b[1] == markerSOI:
+		_, _ = scanJPEG(b, func(s markerSegment) bool {
+			if s.marker == markerAPP1 && bytes.HasPrefix(s.payload, []byte(exifHeader)) {
+				tiff = s.payload[len(exifHeader):]
+				return false
+			}
+
+			return true
+		})
+	case bytes.HasPrefix(b, []byte(pngSignature)):
+		tiff = pngChunkData(b, "eXIf")
+	}
+
+	return tiffOrientation(tiff)
+}
+
+// pngChunkData return data of the first chunk of given type, nil if not found.
+func pngChunkData(b []byte, typ string) []byte {
+	for i := len(pngSignature); i+12 <= len(b); {
+		length := binary.BigEndian.Uint32(b[i:])
+		if uint64(length) > uint64(len(b)-i-12) {
+			return nil
+		}
+
+		end := i + 12 + int(length)
+
+		switch string(b[i+4 : i+8]) {
+		case typ:
+			return b[i+8 : end-4]
+		case "IDAT", "IEND":
+			// Metadata chunks come before image data.
+			return nil
+		}
+
+		i = end
+	}
+
+	return nil
+}
+
+// tiffOrientation read the Orientation tag from IFD0 of given TIFF structured EXIF data.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < tiffHeaderSize {
+		return orientationNormal
+	}
+
+	var order binary.ByteOrder
+
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return orientationNormal
+	}
+
+	ifd := int64(order.Uint32(tiff[4:]))
+	if ifd+2 > int64(len(tiff)) {
+		return orientationNormal
+	}
+
+	count := int64(order.Uint16(tiff[ifd:]))
+
+	for k := int64(0); k < count; k++ {
+		off := ifd + 2 + k*exifIFDEntrySize
+		if off+exifIFDEntrySize > int64(len(tiff)) {
+			break
+		}
+
+		entry := tiff[off : off+exifIFDEntrySize]
+		if order.Uint16(entry) != exifOrientationTag || order.Uint16(entry[2:]) != exifTypeShort {
+			continue
+		}
+
+		// A single SHORT value is stored left aligned in the value field.
+		if o := int(order.Uint16(entry[8:])); o >= orientationNormal && o <= orientationRotate270 {
+			return o
+		}
+
+		break
+	}
+
+	return orientationNormal
+}
+
+// orientationExif return minimal big endian TIFF data holding only given orientation.
+func orientationExif(o int) []byte {
+	tiff := make([]byte, tiffHeaderSize+2+exifIFDEntrySize+4)
+	copy(tiff, "MM\x00*")
+	binary.BigEndian.PutUint32(tiff[4:], tiffHeaderSize)
+	binary.BigEndian.PutUint16(tiff[8:], 1) // Entries count.
+
+	entry := tiff[10:]
+	binary.BigEndian.PutUint16(entry, exifOrientationTag)
+	binary.BigEndian.PutUint16(entry[2:], exifTypeShort)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], uint16(o))
+
+	return tiff
+}
+
+// orient apply given EXIF orientation to img so that it displays upright without metadata.
+func orient(img image.Image, o int) image.Image {
+	if o <= orientationNormal || o > orientationRotate270 {
+		return img
+	}
+
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	dw, dh := w, h
+	if o >= orientationTranspose {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := orientedPoint(o, x, y, w, h)
+			si, di := src.PixOffset(x, y), dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
+
+// orientedPoint return where given point of a w by h image lands once given orientation is applied.
+func orientedPoint(o, x, y, w, h int) (int, int) {
+	switch o {
+	case orientationFlipH:
+		return w - 1 - x, y
+	case orientationRotate180:
+		return w - 1 - x, h - 1 - y
+	case orientationFlipV:
+		return x, h - 1 - y
+	case orientationTranspose:
+		return y, x
+	case orientationRotate90:
+		return h - 1 - y, x
+	case orientationTransverse:
+		return h - 1 - y, w - 1 - x
+	case orientationRotate270:
+		return y, w - 1 - x
+	default:
+		return x, y
+	}
+}
@@ -0,0 +1,183 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// tiffWithOrientation build TIFF data with a leading unrelated tag then the orientation tag.
+func tiffWithOrientation(order binary.ByteOrder, o int) []byte {
+	tiff := make([]byte, tiffHeaderSize+2+2*exifIFDEntrySize+4)
+
+	if order == binary.LittleEndian {
+		copy(tiff, "II*\x00")
+	} else {
+		copy(tiff, "MM\x00*")
+	}
+
+	order.PutUint32(tiff[4:], tiffHeaderSize)
+	order.PutUint16(tiff[8:], 2)
+
+	// ImageDescription, ASCII.
+	order.PutUint16(tiff[10:], 0x010e)
+	order.PutUint16(tiff[12:], 2)
+
+	entry := tiff[10+exifIFDEntrySize:]
+	order.PutUint16(entry, exifOrientationTag)
+	order.PutUint16(entry[2:], exifTypeShort)
+	order.PutUint32(entry[4:], 1)
+	order.PutUint16(entry[8:], uint16(o))
+
+	return tiff
+}
+
+func TestTiffOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{name: "should read little endian orientation", tiff: tiffWithOrientation(binary.LittleEndian, 6), want: 6},
+		{name: "should read big endian orientation", tiff: tiffWithOrientation(binary.BigEndian, 8), want: 8},
+		{name: "should read minimal orientation data", tiff: orientationExif(3), want: 3},
+		{name: "should ignore out of range orientation", tiff: tiffWithOrientation(binary.BigEndian, 9), want: 1},
+		{name: "should ignore truncated data", tiff: tiffWithOrientation(binary.BigEndian, 6)[:20], want: 1},
+		{name: "should ignore invalid header", tiff: []byte("XX\x00*\x00\x00\x00\x08"), want: 1},
+		{name: "should ignore IFD offset overflowing", tiff: []byte("MM\x00*\xff\xff\xff\xff"), want: 1},
+		{name: "should ignore missing data", want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tiffOrientation(tt.tiff); got != tt.want {
+				t.Errorf("tiffOrientation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func orientedJPEG(t *testing.T, img image.Image, o int) []byte {
+	t.Helper()
+
+	payload := append(append([]byte{}, exifHeader...), tiffWithOrientation(binary.LittleEndian, o)...)
+
+	return insertAt(encodeTestImage(t, img, "image/jpeg"), 2, jpegSegment(markerAPP1, payload))
+}
+
+func orientedPNG(t *testing.T, img image.Image, o int) []byte {
+	t.Helper()
+
+	afterIHDR := len(pngSignature) + 12 + 13
+
+	return insertAt(encodeTestImage(t, img, "image/png"), afterIHDR, pngChunk("eXIf", tiffWithOrientation(binary.BigEndian, o)))
+}
+
+func TestExifOrientation(t *testing.T) {
+	img := testImage(8, 4)
+
+	tests := []struct {
+		name   string
+		source []byte
+		want   int
+	}{
+		{name: "should read jpeg orientation", source: orientedJPEG(t, img, 6), want: 6},
+		{name: "should read png orientation", source: orientedPNG(t, img, 3), want: 3},
+		{name: "should default without exif", source: encodeTestImage(t, img, "image/jpeg"), want: 1},
+		{name: "should default with other formats", source: encodeTestImage(t, img, "image/gif"), want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exifOrientation(tt.source); got != tt.want {
+				t.Errorf("exifOrientation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 3x2 image, the top left pixel is red and the top right one is green.
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	red, green := color.RGBA{R: 255, A: 255}, color.RGBA{G: 255, A: 255}
+	img.SetRGBA(0, 0, red)
+	img.SetRGBA(2, 0, green)
+
+	tests := []struct {
+		orientation     int
+		wantW, wantH    int
+		wantRed, wantGr image.Point
+	}{
+		{orientation: 1, wantW: 3, wantH: 2, wantRed: image.Pt(0, 0), wantGr: image.Pt(2, 0)},
+		{orientation: 2, wantW: 3, wantH: 2, wantRed: image.Pt(2, 0), wantGr: image.Pt(0, 0)},
+		{orientation: 3, wantW: 3, wantH: 2, wantRed: image.Pt(2, 1), wantGr: image.Pt(0, 1)},
+		{orientation: 4, wantW: 3, wantH: 2, wantRed: image.Pt(0, 1), wantGr: image.Pt(2, 1)},
+		{orientation: 5, wantW: 2, wantH: 3, wantRed: image.Pt(0, 0), wantGr: image.Pt(0, 2)},
+		{orientation: 6, wantW: 2, wantH: 3, wantRed: image.Pt(1, 0), wantGr: image.Pt(1, 2)},
+		{orientation: 7, wantW: 2, wantH: 3, wantRed: image.Pt(1, 2), wantGr: image.Pt(1, 0)},
+		{orientation: 8, wantW: 2, wantH: 3, wantRed: image.Pt(0, 2), wantGr: image.Pt(0, 0)},
+	}
+	for _, tt := range tests {
+		got := orient(img, tt.orientation)
+
+		if b := got.Bounds(); b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+			t.Errorf("orient(%d) = %v, want %dx%d", tt.orientation, b, tt.wantW, tt.wantH)
+			continue
+		}
+
+		r, g := got.At(tt.wantRed.X, tt.wantRed.Y), got.At(tt.wantGr.X, tt.wantGr.Y)
+		if r != red || g != green {
+			t.Errorf("orient(%d) red at %v = %v, green at %v = %v", tt.orientation, tt.wantRed, r, tt.wantGr, g)
+		}
+	}
+}
+
+func TestLocalProcessor_OptimizeOrientation(t *testing.T) {
+	for _, source := range [][]byte{orientedJPEG(t, testImage(100, 50), 6), orientedPNG(t, testImage(100, 50), 8)} {
+		got, err := (&LocalProcessor{}).Optimize(context.Background(), Request{Source: source, Spec: Spec{Width: 25}})
+		if err != nil {
+			t.Fatalf("Optimize() unexpected error: %v", err)
+		}
+
+		if got.Width != 25 || got.Height != 50 {
+			t.Errorf("Optimize() = %dx%d, want rotated 25x50", got.Width, got.Height)
+		}
+	}
+}
+
+func TestImaginaryOperations_Autorotate(t *testing.T) {
+	ope, _, err := imaginaryOperations(Request{
+		Source: orientedJPEG(t, testImage(8, 4), 6),
+		Format: "image/jpeg",
+		Spec:   Spec{TargetFormat: "image/webp", Width: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ope) != 3 || ope[0].Operation != "autorotate" {
+		t.Errorf("imaginaryOperations() = %+v, want autorotate first", ope)
+	}
+}
+
+func TestStripProcessor_KeepOrientation(t *testing.T) {
+	for _, source := range [][]byte{orientedJPEG(t, testImage(8, 4), 6), orientedPNG(t, testImage(8, 4), 6)} {
+		got, err := (&StripProcessor{}).Optimize(context.Background(), Request{Source: source})
+		if err != nil {
+			t.Fatalf("Optimize() unexpected error: %v", err)
+		}
+
+		if o := exifOrientation(got.Bytes); o != 6 {
+			t.Errorf("stripped orientation = %d, want 6", o)
+		}
+
+		if bytes.Contains(got.Bytes, []byte("II*\x00")) || len(got.Bytes) >= len(source) {
+			t.Error("original EXIF data must be replaced by the minimal orientation")
+		}
+
+		if _, _, err = image.Decode(bytes.NewReader(got.Bytes)); err != nil {
+			t.Errorf("stripped image must stay decodable: %v", err)
+		}
+	}
+}
@@ -2,6 +2,8 @@
 package processor
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/agravelot/imageopti/config"
@@ -9,27 +11,45 @@ import (
 
 // Processor Define processor interface.
 type Processor interface {
-	Optimize(media []byte, originalFormat string, targetFormat string, quality, width int) ([]byte, string, error)
+	// Optimize process given image, it must give up as soon as ctx is done.
+	Optimize(ctx context.Context, req Request) (Result, error)
 }
 
-// New Processor factory from dynamic configurations.
-func New(conf config.Config) (Processor, error) {
-	if conf.Processor == "imaginary" {
-		p, err := NewImaginary(conf)
+// SourceFetcher is implemented by processors downloading sources themselves from Request.Path,
+// they ignore Request.Source.
+type SourceFetcher interface {
+	FetchesSource() bool
+}
+
+// FetchesSource report whether given processor download sources itself, such processors are given
+// requests without Source so that origins do not serve images twice.
+func FetchesSource(p Processor) bool {
+	sf, ok := p.(SourceFetcher)
+
+	return ok && sf.FetchesSource()
+}
+
+// New Processor factory from dynamic configurations, drivers are resolved from RegisterProcessor.
+// A configured pipeline is built as a *ChainProcessor, name identify the middleware instance and prefix
+// the circuit breakers of its processors.
+func New(name string, conf config.Config) (Processor, error) {
+	if len(conf.Pipeline) > 0 {
+		if conf.Processor != "" {
+			return nil, errors.New("processor and pipeline cannot be both defined")
+		}
+
+		c, err := newChain(name, conf)
 		if err != nil {
 			return nil, err
 		}
 
-		return p, nil
-	}
-
-	if conf.Processor == "local" {
-		return &LocalProcessor{}, nil
+		return c, nil
 	}
 
-	if conf.Processor == "none" {
-		return &NoneProcessor{}, nil
+	factory, ok := lookup(conf.Processor)
+	if !ok {
+		return nil, fmt.Errorf("unable to resolver given optimizer %s", conf.Processor)
 	}
 
-	return nil, fmt.Errorf("unable to resolver given optimizer %s", conf.Processor)
+	return factory(conf, conf.Drivers[conf.Processor])
 }
@@ -1,7 +1,7 @@
 package processor
 
 import (
-	"net/http"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -9,8 +9,6 @@ import (
 	"github.com/agravelot/imageopti/config"
 )
 
-const defaultTimeout = 1 * time.Second
-
 func TestNew(t *testing.T) {
 	type args struct {
 		conf config.Config
@@ -33,7 +31,7 @@ func TestNew(t *testing.T) {
 					File:      config.FileCacheConfig{Path: ""},
 				},
 			},
-			want:    &ImaginaryProcessor{"", http.Client{Timeout: defaultTimeout}},
+			want:    &ImaginaryProcessor{},
 			wantErr: false,
 		},
 		{
@@ -81,7 +79,7 @@ func TestNew(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := New(tt.args.conf)
+			got, err := New("test", tt.args.conf)
 			if (err != nil) != tt.wantErr {
 				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -95,3 +93,63 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+type customProcessor struct {
+	NoneProcessor
+	Endpoint string `json:"endpoint"`
+}
+
+func TestRegisterProcessor(t *testing.T) {
+	// Registrations last for the whole process, a unique name allows running tests several times.
+	name := fmt.Sprintf("custom-test-%d", time.Now().UnixNano())
+
+	RegisterProcessor(name, func(_ config.Config, settings map[string]interface{}) (Processor, error) {
+		p := &customProcessor{}
+		if err := config.DecodeSettings(settings, p); err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	})
+
+	got, err := New("test", config.Config{
+		Processor: name,
+		Drivers: map[string]map[string]interface{}{
+			name: {"endpoint": "http://custom"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+
+	p, ok := got.(*customProcessor)
+	if !ok {
+		t.Fatalf("New() = %T, want *customProcessor", got)
+	}
+
+	if p.Endpoint != "http://custom" {
+		t.Errorf("New() settings endpoint = %s, want http://custom", p.Endpoint)
+	}
+
+	found := false
+
+	for _, n := range Drivers() {
+		found = found || n == name
+	}
+
+	if !found {
+		t.Errorf("Drivers() = %v, must contain %s", Drivers(), name)
+	}
+}
+
+func TestRegisterProcessor_Duplicate(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("RegisterProcessor() must panic on duplicate driver")
+		}
+	}()
+
+	RegisterProcessor("none", func(_ config.Config, _ map[string]interface{}) (Processor, error) {
+		return &NoneProcessor{}, nil
+	})
+}
@@ -0,0 +1,171 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// Image formats detected from their leading bytes.
+const (
+	FormatJPEG = "image/jpeg"
+	FormatPNG  = "image/png"
+	FormatGIF  = "image/gif"
+	FormatWebP = "image/webp"
+	FormatAVIF = "image/avif"
+	FormatHEIF = "image/heif"
+	FormatBMP  = "image/bmp"
+	FormatTIFF = "image/tiff"
+	FormatSVG  = "image/svg+xml"
+	FormatICO  = "image/x-icon"
+)
+
+// svgSniffLen bound how far the SVG root element is looked for, past XML declaration, comments and doctype.
+const svgSniffLen = 4096
+
+// formatName return the MIME type of given configuration format name or alias, or an empty string when unknown.
+func formatName(name string) string {
+	switch name {
+	case "jpeg", "jpg":
+		return FormatJPEG
+	case "heif", "heic":
+		return FormatHEIF
+	case "tiff", "tif":
+		return FormatTIFF
+	case "svg":
+		return FormatSVG
+	case "ico":
+		return FormatICO
+	case "png", "gif", "webp", "avif", "bmp":
+		return "image/" + name
+	default:
+		return ""
+	}
+}
+
+// ParseFormat return the MIME type of given format name like "jpg" or "webp", or of a MIME type.
+// Unknown names are returned as an image MIME type, it is up to callers to reject them.
+func ParseFormat(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if f := formatName(strings.TrimPrefix(name, "image/")); f != "" {
+		return f
+	}
+
+	if strings.HasPrefix(name, "image/") {
+		return name
+	}
+
+	return "image/" + name
+}
+
+// IsDetectable report whether given MIME type can be returned by DetectFormat.
+func IsDetectable(format string) bool {
+	switch format {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatWebP, FormatAVIF, FormatHEIF, FormatBMP, FormatTIFF, FormatSVG, FormatICO:
+		return true
+	default:
+		return false
+	}
+}
+
+// DetectFormat return the MIME type of given image from its leading bytes, or an empty string when unknown.
+func DetectFormat(b []byte) string {
+	if f := signatureFormat(b); f != "" {
+		return f
+	}
+
+	switch {
+	case len(b) >= 12 && bytes.Equal(b[:4], []byte("RIFF")) && bytes.Equal(b[8:12], []byte("WEBP")):
+		return FormatWebP
+	case len(b) >= 12 && bytes.Equal(b[4:8], []byte("ftyp")):
+		return isobmffFormat(b)
+	case len(b) >= 6 && bytes.HasPrefix(b, []byte{0, 0, 1, 0}) && binary.LittleEndian.Uint16(b[4:6]) > 0:
+		return FormatICO
+	case isSVG(b):
+		return FormatSVG
+	default:
+		return ""
+	}
+}
+
+// signatureFormat return the MIME type of given image starting with a fixed signature, or an empty string.
+func signatureFormat(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xff, 0xd8, 0xff}):
+		return FormatJPEG
+	case bytes.HasPrefix(b, []byte(pngSignature)):
+		return FormatPNG
+	case bytes.HasPrefix(b, []byte("GIF87a")), bytes.HasPrefix(b, []byte("GIF89a")):
+		return FormatGIF
+	case len(b) >= 14 && bytes.HasPrefix(b, []byte("BM")):
+		return FormatBMP
+	case bytes.HasPrefix(b, []byte("II*\x00")), bytes.HasPrefix(b, []byte("MM\x00*")):
+		return FormatTIFF
+	default:
+		return ""
+	}
+}
+
+// isobmffFormat tell AVIF from HEIF images by the brands of their ftyp box.
+func isobmffFormat(b []byte) string {
+	size := int(binary.BigEndian.Uint32(b[:4]))
+	if size < 16 || size > len(b) {
+		size = len(b)
+	}
+
+	var heif bool
+
+	// Major brand then compatible brands, minor version in between is skipped.
+	for i := 8; i+4 <= size; i += 4 {
+		if i == 12 {
+			continue
+		}
+
+		switch string(b[i : i+4]) {
+		case "avif", "avis":
+			return FormatAVIF
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+			heif = true
+		}
+	}
+
+	if heif {
+		return FormatHEIF
+	}
+
+	return ""
+}
+
+// isSVG report whether given document root element is svg.
+func isSVG(b []byte) bool {
+	if len(b) > svgSniffLen {
+		b = b[:svgSniffLen]
+	}
+
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+
+	for {
+		b = bytes.TrimLeft(b, " \t\r\n")
+
+		var end []byte
+
+		switch {
+		case bytes.HasPrefix(b, []byte("<?")):
+			end = []byte("?>")
+		case bytes.HasPrefix(b, []byte("<!--")):
+			end = []byte("-->")
+		case bytes.HasPrefix(b, []byte("<!")):
+			end = []byte(">")
+		default:
+			return len(b) > 4 && bytes.HasPrefix(b, []byte("<svg")) && strings.IndexByte(" \t\r\n>/", b[4]) >= 0
+		}
+
+		i := bytes.Index(b, end)
+		if i < 0 {
+			return false
+		}
+
+		b = b[i+len(end):]
+	}
+}
@@ -0,0 +1,73 @@
+package processor
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "should detect jpeg", data: encodeTestImage(t, testImage(4, 4), "image/jpeg"), want: FormatJPEG},
+		{name: "should detect png", data: encodeTestImage(t, testImage(4, 4), "image/png"), want: FormatPNG},
+		{name: "should detect gif", data: encodeTestImage(t, testImage(4, 4), "image/gif"), want: FormatGIF},
+		{name: "should detect webp", data: []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), want: FormatWebP},
+		{name: "should detect avif", data: []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf"), want: FormatAVIF},
+		{name: "should detect avif from compatible brands", data: []byte("\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00avifmiaf"), want: FormatAVIF},
+		{name: "should detect heif", data: []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), want: FormatHEIF},
+		{name: "should not detect other iso media", data: []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2"), want: ""},
+		{name: "should detect bmp", data: append([]byte("BM"), make([]byte, 24)...), want: FormatBMP},
+		{name: "should detect little endian tiff", data: []byte("II*\x00\x08\x00\x00\x00"), want: FormatTIFF},
+		{name: "should detect big endian tiff", data: []byte("MM\x00*\x00\x00\x00\x08"), want: FormatTIFF},
+		{name: "should detect ico", data: []byte("\x00\x00\x01\x00\x01\x00\x10\x10"), want: FormatICO},
+		{name: "should detect svg", data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), want: FormatSVG},
+		{
+			name: "should detect svg after prolog",
+			data: []byte("\xef\xbb\xbf<?xml version=\"1.0\"?>\n<!-- logo -->\n<!DOCTYPE svg PUBLIC \"-//W3C//DTD SVG 1.1//EN\">\n<svg>"),
+			want: FormatSVG,
+		},
+		{name: "should not detect other xml", data: []byte(`<?xml version="1.0"?><svgx/>`), want: ""},
+		{name: "should not detect html", data: []byte("<!DOCTYPE html><html><svg></svg></html>"), want: ""},
+		{name: "should not detect truncated header", data: []byte("RIFF"), want: ""},
+		{name: "should not detect empty body", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectFormat(tt.data); got != tt.want {
+				t.Errorf("DetectFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectFormat_SVGSniffLimit(t *testing.T) {
+	data := append([]byte("<!--"+string(bytes.Repeat([]byte(" "), svgSniffLen))+"-->"), "<svg>"...)
+
+	if got := DetectFormat(data); got != "" {
+		t.Errorf("DetectFormat() = %q, want root element past sniff limit ignored", got)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "jpg", want: FormatJPEG},
+		{name: " JPEG ", want: FormatJPEG},
+		{name: "image/webp", want: FormatWebP},
+		{name: "heic", want: FormatHEIF},
+		{name: "svg", want: FormatSVG},
+		{name: "jxl", want: "image/jxl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseFormat(tt.name); got != tt.want {
+				t.Errorf("ParseFormat(%q) = %s, want %s", tt.name, got, tt.want)
+			}
+		})
+	}
+}
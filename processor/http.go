@@ -0,0 +1,138 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const maxErrorBodySize = 4 << 10
+
+// errResponseTooLarge is returned when a processing service response exceed the configured size limit.
+var errResponseTooLarge = errors.New("response exceeds size limit")
+
+// StatusError is returned when a processing service respond with a non 2xx status.
+type StatusError struct {
+	Service    string
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded with status %d: %s", e.Service, e.StatusCode, e.Message)
+}
+
+// Retryable report whether the request may succeed on a new attempt.
+func (e *StatusError) Retryable() bool {
+	return isTransientStatus(e.StatusCode)
+}
+
+// newStatusError read the beginning of given response body as error message.
+func newStatusError(service string, res *http.Response) *StatusError {
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+
+	return &StatusError{Service: service, StatusCode: res.StatusCode, Message: strings.TrimSpace(string(b))}
+}
+
+// isTransientStatus report whether given status means the service or a proxy in front of it is temporarily unavailable.
+func isTransientStatus(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// contentTypeError is returned when a processing service respond with another format than requested.
+type contentTypeError struct {
+	got, want string
+}
+
+func (e *contentTypeError) Error() string {
+	return fmt.Sprintf("unexpected response content type %q, want %q", e.got, e.want)
+}
+
+// mimeType return media type of given Content-Type without parameters.
+func mimeType(ct string) string {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(ct))
+	}
+
+	return mt
+}
+
+// responseLimit validate given size limit setting, zero means the default one.
+func responseLimit(name string, v int64) (int64, error) {
+	switch {
+	case v < 0:
+		return 0, fmt.Errorf("%s cannot be negative", name)
+	case v == 0:
+		return defaultMaxResponseBytes, nil
+	default:
+		return v, nil
+	}
+}
+
+// fetchImage send given request to a processing service and read the response body, up to limit bytes.
+// Responses other than 2xx are returned as *StatusError, and responses of another format than requested
+// are rejected. Headers are returned for services reporting output dimensions.
+func fetchImage(client *http.Client, req *http.Request, service, format string,
+	limit int64,
+) ([]byte, http.Header, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to send %s request: %w", service, err)
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, nil, newStatusError(service, res)
+	}
+
+	if ct := mimeType(res.Header.Get("Content-Type")); ct != format {
+		return nil, nil, &contentTypeError{got: ct, want: format}
+	}
+
+	body, err := readBody(res, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return body, res.Header, nil
+}
+
+// readBody read response body up to limit bytes, in a single allocation when its length is known.
+func readBody(res *http.Response, limit int64) ([]byte, error) {
+	if res.ContentLength > limit {
+		return nil, fmt.Errorf("%w: %d bytes", errResponseTooLarge, res.ContentLength)
+	}
+
+	if res.ContentLength >= 0 {
+		body := make([]byte, res.ContentLength)
+		if _, err := io.ReadFull(res.Body, body); err != nil {
+			return nil, fmt.Errorf("unable to read response body: %w", err)
+		}
+
+		return body, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response body: %w", err)
+	}
+
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", errResponseTooLarge, limit)
+	}
+
+	return body, nil
+}
@@ -2,24 +2,31 @@
 package processor
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/agravelot/imageopti/config"
 )
 
-const httpTimeout = 5 * time.Second
+const (
+	httpTimeout             = 5 * time.Second
+	defaultMaxResponseBytes = 64 << 20
+)
 
 type pipelineOperationParams struct {
 	Font      string  `json:"font,omitempty"`
 	Height    int     `json:"height,omitempty"`
 	Opacity   float64 `json:"opacity,omitempty"`
+	Quality   int     `json:"quality,omitempty"`
 	Rotate    int     `json:"rotate,omitempty"`
 	Text      string  `json:"text,omitempty"`
 	Textwidth int     `json:"textwidth,omitempty"`
@@ -35,97 +42,263 @@ type pipelineOperation struct {
 
 // ImaginaryProcessor define imaginary processor settings.
 type ImaginaryProcessor struct {
-	URL    string
-	client http.Client
+	cluster *imaginaryCluster
+
+	sourceBaseURL    string // Empty unless URL-fetch mode is enabled.
+	maxResponseBytes int64
+
+	apiKey       string
+	apiKeyHeader string
+	headers      map[string]string
 }
 
-func isValidURL(s string) error {
-	if s == "" {
-		return fmt.Errorf("url cannot be empty")
+// NewImaginary instantiate a new imaginary instance with given config.
+// Active health checks run along with requests when several endpoints are configured, or when an interval is given.
+func NewImaginary(conf config.Config) (*ImaginaryProcessor, error) {
+	cluster, err := newImaginaryCluster(conf.Imaginary)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.Imaginary.SourceBaseURL != "" {
+		u, err := url.ParseRequestURI(conf.Imaginary.SourceBaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid imaginary source base url %q", conf.Imaginary.SourceBaseURL)
+		}
 	}
 
-	u, err := url.ParseRequestURI(s)
+	maxResponseBytes, err := responseLimit("imaginary max response bytes", conf.Imaginary.MaxResponseBytes)
 	if err != nil {
-		return fmt.Errorf("unable to parse imaginary url: %w", err)
+		return nil, err
 	}
 
-	if u.Scheme != "http" && u.Scheme != "https" {
-		return fmt.Errorf("unvalid imaginary scheme")
+	ip := &ImaginaryProcessor{
+		cluster:          cluster,
+		sourceBaseURL:    strings.TrimSuffix(conf.Imaginary.SourceBaseURL, "/"),
+		maxResponseBytes: maxResponseBytes,
+		apiKey:           conf.Imaginary.APIKey,
+		apiKeyHeader:     conf.Imaginary.APIKeyHeader,
+		headers:          conf.Imaginary.Headers,
 	}
+	cluster.authorize = ip.authorize
 
-	return nil
+	return ip, nil
 }
 
-// NewImaginary instantiate a new imaginary instance with given config.
-func NewImaginary(conf config.Config) (*ImaginaryProcessor, error) {
-	err := isValidURL(conf.Imaginary.URL)
-	if err != nil {
-		return nil, err
+// authorize add configured headers and API key to given imaginary request.
+func (ip *ImaginaryProcessor) authorize(req *http.Request) {
+	for k, v := range ip.headers {
+		req.Header.Set(k, v)
 	}
 
-	return &ImaginaryProcessor{
-		client: http.Client{
-			Timeout: httpTimeout,
-		},
-		URL: conf.Imaginary.URL,
-	}, nil
+	if ip.apiKey == "" {
+		return
+	}
+
+	if ip.apiKeyHeader != "" {
+		req.Header.Set(ip.apiKeyHeader, ip.apiKey)
+		return
+	}
+
+	q := req.URL.Query()
+	q.Set("key", ip.apiKey)
+	req.URL.RawQuery = q.Encode()
+}
+
+// imaginaryOutputType return the imaginary type of given output MIME type.
+func imaginaryOutputType(format string) (string, bool) {
+	switch format {
+	case FormatWebP, FormatAVIF, FormatJPEG, FormatPNG:
+		return strings.TrimPrefix(format, "image/"), true
+	default:
+		return "", false
+	}
+}
+
+// sourceExtension return the file extension of given source MIME type, imaginary rely on it to detect the upload type.
+func sourceExtension(format string) (string, bool) {
+	switch format {
+	case FormatJPEG:
+		return "jpg", true
+	case FormatSVG:
+		return "svg", true
+	case FormatPNG, FormatGIF, FormatWebP, FormatAVIF, FormatHEIF, FormatTIFF, FormatBMP:
+		return strings.TrimPrefix(format, "image/"), true
+	default:
+		return "", false
+	}
+}
+
+// withImaginaryMessage read the message of imaginary JSON error bodies, like {"message": "...", "status": 400}.
+// Bodies of proxies in front of imaginary are kept as is.
+func withImaginaryMessage(err error) error {
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return err
+	}
+
+	var body struct {
+		Message string `json:"message"`
+	}
+
+	if json.Unmarshal([]byte(se.Message), &body) == nil && body.Message != "" {
+		se.Message = body.Message
+	}
+
+	return err
 }
 
-// Optimize method to process image with imaginary with given parameters.
-func (ip *ImaginaryProcessor) Optimize(media []byte, of string, tf string, q, width int) ([]byte, string, error) {
-	ope := []pipelineOperation{
-		{Operation: "convert", Params: pipelineOperationParams{Type: "webp", StripMeta: true}},
+func imaginaryOperations(r Request) ([]pipelineOperation, string, error) {
+	tf := mimeType(r.Spec.TargetFormat)
+	if tf == "" {
+		tf = mimeType(r.Format)
+	}
+
+	t, ok := imaginaryOutputType(tf)
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported imaginary target format %q", tf)
+	}
+
+	var ope []pipelineOperation
+
+	// Metadata is stripped, rotate first so that the output still display upright.
+	// Orientation is unknown when imaginary fetch the source itself.
+	if len(r.Source) == 0 || exifOrientation(r.Source) != orientationNormal {
+		ope = append(ope, pipelineOperation{Operation: "autorotate"})
 	}
 
-	if width > 0 {
-		ope = append(ope, pipelineOperation{Operation: "resize", Params: pipelineOperationParams{Width: width}})
+	if r.Spec.Width > 0 {
+		ope = append(ope, pipelineOperation{Operation: "resize", Params: pipelineOperationParams{Width: r.Spec.Width}})
+	}
+
+	// Last operation define output encoding.
+	ope = append(ope, pipelineOperation{
+		Operation: "convert",
+		Params:    pipelineOperationParams{Type: t, Quality: r.Spec.Quality, StripMeta: true},
+	})
+
+	return ope, tf, nil
+}
+
+// Optimize method to process image with imaginary with given parameters, on an endpoint selected by the balancer.
+func (ip *ImaginaryProcessor) Optimize(ctx context.Context, r Request) (Result, error) {
+	ep := ip.cluster.pick(r.Key)
+	done := ip.cluster.begin(ctx, ep)
+
+	res, err := ip.optimize(ctx, ep, r)
+	done(err)
+
+	return res, err
+}
+
+func (ip *ImaginaryProcessor) optimize(ctx context.Context, ep *imaginaryEndpoint, r Request) (Result, error) {
+	ope, tf, err := imaginaryOperations(r)
+	if err != nil {
+		return Result{}, err
 	}
 
 	opString, err := json.Marshal(ope)
 	if err != nil {
-		return nil, "", fmt.Errorf("unable generate imaginary operations: %w", err)
+		return Result{}, fmt.Errorf("unable generate imaginary operations: %w", err)
 	}
 
-	u := fmt.Sprintf("%s/pipeline?operations=%s", ip.URL, url.QueryEscape(string(opString)))
-	method := "POST"
+	u := fmt.Sprintf("%s/pipeline?operations=%s", ep.url, url.QueryEscape(string(opString)))
+
+	var req *http.Request
+
+	if ip.sourceBaseURL != "" && r.Path != "" {
+		req, err = ip.fetchRequest(ctx, u, r)
+	} else {
+		req, err = uploadRequest(ctx, u, r)
+	}
 
-	payload := &bytes.Buffer{}
-	writer := multipart.NewWriter(payload)
-	fileWriter, err := writer.CreateFormFile("file", "tmp.jpg")
 	if err != nil {
-		return nil, "", fmt.Errorf("unable to create file to imaginary file writer: %w", err)
+		return Result{}, err
 	}
 
-	_, err = fileWriter.Write(media)
+	ip.authorize(req)
+
+	body, header, err := fetchImage(&ep.client, req, "imaginary", tf, ip.maxResponseBytes)
 	if err != nil {
-		return nil, "", fmt.Errorf("unable to write file to imaginary file writer: %w", err)
+		return Result{}, withImaginaryMessage(err)
 	}
 
-	err = writer.Close()
+	width, _ := strconv.Atoi(header.Get("Image-Width"))
+	height, _ := strconv.Atoi(header.Get("Image-Height"))
+
+	return Result{
+		Bytes:    body,
+		Format:   tf,
+		Width:    width,
+		Height:   height,
+		Metadata: map[string]string{"processor": "imaginary", "endpoint": ep.url},
+	}, nil
+}
+
+// FetchesSource report whether URL-fetch mode is enabled.
+func (ip *ImaginaryProcessor) FetchesSource() bool {
+	return ip.sourceBaseURL != ""
+}
+
+// fetchRequest build a pipeline request letting imaginary download the source from its origin,
+// imaginary must run with -enable-url-source.
+func (ip *ImaginaryProcessor) fetchRequest(ctx context.Context, u string, r Request) (*http.Request, error) {
+	path := r.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	u += "&url=" + url.QueryEscape(ip.sourceBaseURL+path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
-		return nil, "", fmt.Errorf("unable to close imaginary file writer: %w", err)
+		return nil, fmt.Errorf("unable to create imaginary request: %w", err)
+	}
+
+	return req, nil
+}
+
+// uploadRequest build a pipeline request streaming the source as multipart form file,
+// the body is written by a goroutine as the transport reads it.
+func uploadRequest(ctx context.Context, u string, r Request) (*http.Request, error) {
+	filename := "image"
+	if ext, ok := sourceExtension(mimeType(r.Format)); ok {
+		filename += "." + ext
 	}
 
-	req, err := http.NewRequest(method, u, payload)
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, pr)
 	if err != nil {
-		return nil, "", fmt.Errorf("unable to create imaginary request: %w", err)
+		return nil, fmt.Errorf("unable to create imaginary request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-	res, err := ip.client.Do(req)
+
+	// The transport close the body once done, even on failure, unblocking pending writes.
+	go func() {
+		pw.CloseWithError(writeMultipart(writer, filename, r.Source))
+	}()
+
+	return req, nil
+}
+
+func writeMultipart(writer *multipart.Writer, filename string, source []byte) error {
+	fileWriter, err := writer.CreateFormFile("file", filename)
 	if err != nil {
-		return nil, "", fmt.Errorf("unable to send imaginary request: %w", err)
+		return fmt.Errorf("unable to create file to imaginary file writer: %w", err)
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	_, err = fileWriter.Write(source)
 	if err != nil {
-		return nil, "", fmt.Errorf("unable to read imaginary response body: %w", err)
+		return fmt.Errorf("unable to write file to imaginary file writer: %w", err)
 	}
 
-	err = res.Body.Close()
+	err = writer.Close()
 	if err != nil {
-		return nil, "", fmt.Errorf("unable to close imaginary body response: %w", err)
+		return fmt.Errorf("unable to close imaginary file writer: %w", err)
 	}
 
-	return body, "image/webp", nil
+	return nil
 }
@@ -0,0 +1,153 @@
+package processor
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+const (
+	unixScheme = "unix"
+	// unixBaseURL is the request URL used with unix sockets, the host is ignored by the dialer.
+	unixBaseURL = "http://imaginary"
+)
+
+func isValidURL(s string) error {
+	if s == "" {
+		return fmt.Errorf("url cannot be empty")
+	}
+
+	u, err := url.ParseRequestURI(s)
+	if err != nil {
+		return fmt.Errorf("unable to parse imaginary url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return nil
+	case unixScheme:
+		if u.Path == "" {
+			return fmt.Errorf("imaginary unix socket path cannot be empty")
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unvalid imaginary scheme")
+	}
+}
+
+// newImaginaryClient build the http client and base URL to reach imaginary with given configuration.
+func newImaginaryClient(conf config.ImaginaryProcessorConfig) (http.Client, string, error) {
+	if err := isValidURL(conf.URL); err != nil {
+		return http.Client{}, "", err
+	}
+
+	timeout, err := parseDuration(conf.Timeout, httpTimeout)
+	if err != nil {
+		return http.Client{}, "", fmt.Errorf("invalid imaginary timeout: %w", err)
+	}
+
+	idleTimeout, err := parseDuration(conf.IdleConnTimeout, 90*time.Second)
+	if err != nil {
+		return http.Client{}, "", fmt.Errorf("invalid imaginary idle connection timeout: %w", err)
+	}
+
+	tlsConfig, err := imaginaryTLSConfig(conf)
+	if err != nil {
+		return http.Client{}, "", err
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        conf.MaxIdleConns,
+		MaxIdleConnsPerHost: conf.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     conf.MaxConnsPerHost,
+		IdleConnTimeout:     idleTimeout,
+	}
+
+	base := strings.TrimSuffix(conf.URL, "/")
+
+	if u, _ := url.Parse(conf.URL); u.Scheme == unixScheme {
+		socket := filepath.Clean(u.Path)
+
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, unixScheme, socket)
+		}
+		base = unixBaseURL
+	}
+
+	return http.Client{Timeout: timeout, Transport: transport}, base, nil
+}
+
+func imaginaryTLSConfig(conf config.ImaginaryProcessorConfig) (*tls.Config, error) {
+	// #nosec G402 -- explicitly enabled for development only.
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+
+	if conf.CAFile != "" {
+		ca, err := ioutil.ReadFile(filepath.Clean(conf.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read imaginary CA file: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no valid certificate found in imaginary CA file")
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return nil, errors.New("imaginary client certificate requires both cert and key files")
+	}
+
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load imaginary client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// parseDuration parse given duration string, returning def when empty.
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if d <= 0 {
+		return 0, errors.New("duration must be positive")
+	}
+
+	return d, nil
+}
@@ -0,0 +1,176 @@
+package processor
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+func webpHandler(t *testing.T, check func(req *http.Request)) http.HandlerFunc {
+	t.Helper()
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if check != nil {
+			check(req)
+		}
+
+		rw.Header().Set("Content-Type", "image/webp")
+		_, _ = rw.Write([]byte("optimized"))
+	}
+}
+
+func optimizeWith(t *testing.T, conf config.ImaginaryProcessorConfig) error {
+	t.Helper()
+
+	p, err := NewImaginary(config.Config{Imaginary: conf})
+	if err != nil {
+		t.Fatalf("NewImaginary() unexpected error: %v", err)
+	}
+
+	_, err = p.Optimize(context.Background(), Request{
+		Source: []byte("original"),
+		Format: "image/jpeg",
+		Spec:   Spec{TargetFormat: "image/webp"},
+	})
+
+	return err
+}
+
+func TestNewImaginary_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.ImaginaryProcessorConfig
+	}{
+		{name: "should not accept invalid timeout", conf: config.ImaginaryProcessorConfig{URL: "http://localhost", Timeout: "soon"}},
+		{name: "should not accept negative timeout", conf: config.ImaginaryProcessorConfig{URL: "http://localhost", Timeout: "-1s"}},
+		{name: "should not accept unix url without path", conf: config.ImaginaryProcessorConfig{URL: "unix://"}},
+		{name: "should not accept missing CA file", conf: config.ImaginaryProcessorConfig{URL: "https://localhost", CAFile: "missing.pem"}},
+		{name: "should not accept cert without key", conf: config.ImaginaryProcessorConfig{URL: "https://localhost", CertFile: "cert.pem"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewImaginary(config.Config{Imaginary: tt.conf}); err == nil {
+				t.Error("NewImaginary() expected error")
+			}
+		})
+	}
+}
+
+func TestImaginaryProcessor_Authorization(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  config.ImaginaryProcessorConfig
+		check func(t *testing.T, req *http.Request)
+	}{
+		{
+			name: "should send api key as query parameter",
+			conf: config.ImaginaryProcessorConfig{APIKey: "secret"},
+			check: func(t *testing.T, req *http.Request) {
+				if got := req.URL.Query().Get("key"); got != "secret" {
+					t.Errorf("key query parameter = %q, want secret", got)
+				}
+
+				if req.URL.Query().Get("operations") == "" {
+					t.Error("operations query parameter must be kept")
+				}
+			},
+		},
+		{
+			name: "should send api key in header",
+			conf: config.ImaginaryProcessorConfig{APIKey: "secret", APIKeyHeader: "API-Key"},
+			check: func(t *testing.T, req *http.Request) {
+				if got := req.Header.Get("API-Key"); got != "secret" {
+					t.Errorf("API-Key header = %q, want secret", got)
+				}
+
+				if req.URL.Query().Get("key") != "" {
+					t.Error("key query parameter must not be sent")
+				}
+			},
+		},
+		{
+			name: "should send custom headers",
+			conf: config.ImaginaryProcessorConfig{Headers: map[string]string{"X-Tenant": "images"}},
+			check: func(t *testing.T, req *http.Request) {
+				if got := req.Header.Get("X-Tenant"); got != "images" {
+					t.Errorf("X-Tenant header = %q, want images", got)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(webpHandler(t, func(req *http.Request) { tt.check(t, req) }))
+			defer srv.Close()
+
+			tt.conf.URL = srv.URL
+
+			if err := optimizeWith(t, tt.conf); err != nil {
+				t.Fatalf("Optimize() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestImaginaryProcessor_TLS(t *testing.T) {
+	srv := httptest.NewTLSServer(webpHandler(t, nil))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "imaginary-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	if err = ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = optimizeWith(t, config.ImaginaryProcessorConfig{URL: srv.URL}); err == nil {
+		t.Error("Optimize() must not trust unknown certificate")
+	}
+
+	if err = optimizeWith(t, config.ImaginaryProcessorConfig{URL: srv.URL, CAFile: caFile}); err != nil {
+		t.Errorf("Optimize() with CA file unexpected error: %v", err)
+	}
+
+	if err = optimizeWith(t, config.ImaginaryProcessorConfig{URL: srv.URL, InsecureSkipVerify: true}); err != nil {
+		t.Errorf("Optimize() with insecure skip verify unexpected error: %v", err)
+	}
+}
+
+func TestImaginaryProcessor_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	socket := filepath.Join(dir, "imaginary.sock")
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unsupported: %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer(webpHandler(t, nil))
+	srv.Listener = l
+	srv.Start()
+
+	defer srv.Close()
+
+	if err = optimizeWith(t, config.ImaginaryProcessorConfig{URL: "unix://" + socket, Timeout: "2s"}); err != nil {
+		t.Errorf("Optimize() over unix socket unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+// Supported imaginary load balancing strategies.
+const (
+	BalancerRoundRobin    = "roundrobin"
+	BalancerLeastInflight = "leastinflight"
+	// BalancerHash route a same request key to a same endpoint, using rendezvous hashing
+	// so that adding or removing an endpoint only move the keys it owns.
+	BalancerHash = "hash"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultMaxFailures         = 3
+	defaultEjectionTime        = 30 * time.Second
+)
+
+type imaginaryEndpoint struct {
+	inflight     int64
+	ejectedUntil int64 // Unix nanoseconds.
+	failures     uint32
+	unhealthy    uint32
+
+	url    string
+	client http.Client
+}
+
+func (ep *imaginaryEndpoint) available(now int64) bool {
+	return atomic.LoadUint32(&ep.unhealthy) == 0 && atomic.LoadInt64(&ep.ejectedUntil) <= now
+}
+
+// imaginaryCluster select imaginary endpoints and track their health, checked along with traffic.
+type imaginaryCluster struct {
+	next        uint64
+	lastChecked int64 // Unix nanoseconds of the last health checks round.
+
+	endpoints    []*imaginaryEndpoint
+	balancer     string
+	maxFailures  uint32
+	ejectionTime time.Duration
+
+	healthInterval time.Duration // Zero disables health checks.
+	authorize      func(*http.Request)
+}
+
+func newImaginaryCluster(conf config.ImaginaryProcessorConfig) (*imaginaryCluster, error) {
+	urls := conf.URLs
+	if conf.URL != "" {
+		urls = append([]string{conf.URL}, urls...)
+	}
+
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("url cannot be empty")
+	}
+
+	balancer := conf.Balancer
+	switch balancer {
+	case "":
+		balancer = BalancerRoundRobin
+	case BalancerRoundRobin, BalancerLeastInflight, BalancerHash:
+	default:
+		return nil, fmt.Errorf("unsupported imaginary balancer %q", balancer)
+	}
+
+	ejection, err := parseDuration(conf.EjectionTime, defaultEjectionTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid imaginary ejection time: %w", err)
+	}
+
+	maxFailures := conf.MaxFailures
+	switch {
+	case maxFailures < 0:
+		return nil, errors.New("imaginary max failures cannot be negative")
+	case maxFailures == 0:
+		maxFailures = defaultMaxFailures
+	}
+
+	interval, err := healthCheckInterval(conf, len(urls))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &imaginaryCluster{
+		balancer:       balancer,
+		maxFailures:    uint32(maxFailures),
+		ejectionTime:   ejection,
+		healthInterval: interval,
+		authorize:      func(*http.Request) {},
+	}
+
+	for _, u := range urls {
+		epConf := conf
+		epConf.URL = u
+
+		client, base, err := newImaginaryClient(epConf)
+		if err != nil {
+			return nil, err
+		}
+
+		c.endpoints = append(c.endpoints, &imaginaryEndpoint{url: base, client: client})
+	}
+
+	return c, nil
+}
+
+// healthCheckInterval return the configured health checks interval, zero when disabled.
+// Health checks are enabled by default with several endpoints only.
+func healthCheckInterval(conf config.ImaginaryProcessorConfig, endpoints int) (time.Duration, error) {
+	if endpoints == 1 && conf.HealthCheckInterval == "" {
+		return 0, nil
+	}
+
+	interval, err := parseDuration(conf.HealthCheckInterval, defaultHealthCheckInterval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid imaginary health check interval: %w", err)
+	}
+
+	return interval, nil
+}
+
+// pick select an endpoint for given request key. When every endpoint is down,
+// all of them are considered rather than failing every request.
+func (c *imaginaryCluster) pick(key string) *imaginaryEndpoint {
+	now := time.Now().UnixNano()
+
+	c.checkHealthEvery(now)
+
+	candidates := make([]*imaginaryEndpoint, 0, len(c.endpoints))
+	for _, ep := range c.endpoints {
+		if ep.available(now) {
+			candidates = append(candidates, ep)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = c.endpoints
+	}
+
+	switch {
+	case c.balancer == BalancerHash && key != "":
+		return rendezvous(candidates, key)
+	case c.balancer == BalancerLeastInflight:
+		start := int(atomic.AddUint64(&c.next, 1) % uint64(len(candidates)))
+		best := candidates[start]
+
+		for i := 1; i < len(candidates); i++ {
+			ep := candidates[(start+i)%len(candidates)]
+			if atomic.LoadInt64(&ep.inflight) < atomic.LoadInt64(&best.inflight) {
+				best = ep
+			}
+		}
+
+		return best
+	default:
+		return candidates[atomic.AddUint64(&c.next, 1)%uint64(len(candidates))]
+	}
+}
+
+// rendezvous return the endpoint with the highest score for given key.
+func rendezvous(candidates []*imaginaryEndpoint, key string) *imaginaryEndpoint {
+	var (
+		best      *imaginaryEndpoint
+		bestScore uint64
+	)
+
+	for _, ep := range candidates {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(ep.url))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(key))
+
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = ep, score
+		}
+	}
+
+	return best
+}
+
+// begin mark a request in flight on given endpoint, the returned func must be called with its outcome.
+func (c *imaginaryCluster) begin(ctx context.Context, ep *imaginaryEndpoint) func(err error) {
+	atomic.AddInt64(&ep.inflight, 1)
+
+	return func(err error) {
+		atomic.AddInt64(&ep.inflight, -1)
+
+		if err == nil {
+			atomic.StoreUint32(&ep.failures, 0)
+			return
+		}
+
+		// Canceled by the client, nothing to blame the endpoint for.
+		if ctx.Err() != nil || !isEndpointFailure(err) {
+			return
+		}
+
+		if atomic.AddUint32(&ep.failures, 1) >= c.maxFailures {
+			atomic.StoreUint32(&ep.failures, 0)
+			atomic.StoreInt64(&ep.ejectedUntil, time.Now().Add(c.ejectionTime).UnixNano())
+		}
+	}
+}
+
+// isEndpointFailure report whether err is caused by the endpoint rather than by the request.
+func isEndpointFailure(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= http.StatusInternalServerError
+	}
+
+	var ce *contentTypeError
+
+	return !errors.As(err, &ce) && !errors.Is(err, errResponseTooLarge)
+}
+
+// checkHealthEvery start a health checks round in background when the last one is older than the interval,
+// a single caller win the round.
+func (c *imaginaryCluster) checkHealthEvery(now int64) {
+	if c.healthInterval <= 0 {
+		return
+	}
+
+	last := atomic.LoadInt64(&c.lastChecked)
+	if now-last < int64(c.healthInterval) || !atomic.CompareAndSwapInt64(&c.lastChecked, last, now) {
+		return
+	}
+
+	for _, ep := range c.endpoints {
+		go func(ep *imaginaryEndpoint) {
+			if ep.checkHealth(c.healthInterval, c.authorize) {
+				atomic.StoreUint32(&ep.unhealthy, 0)
+			} else {
+				atomic.StoreUint32(&ep.unhealthy, 1)
+			}
+		}(ep)
+	}
+}
+
+func (ep *imaginaryEndpoint) checkHealth(timeout time.Duration, authorize func(*http.Request)) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.url+"/health", nil)
+	if err != nil {
+		return false
+	}
+
+	authorize(req)
+
+	res, err := ep.client.Do(req)
+	if err != nil {
+		return false
+	}
+
+	_ = res.Body.Close()
+
+	return res.StatusCode == http.StatusOK
+}
@@ -0,0 +1,250 @@
+package processor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+type countingServer struct {
+	*httptest.Server
+	pipeline uint32
+	status   int32
+	health   int32
+}
+
+func newCountingServer(t *testing.T) *countingServer {
+	t.Helper()
+
+	s := &countingServer{status: http.StatusOK, health: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/health" {
+			rw.WriteHeader(int(atomic.LoadInt32(&s.health)))
+			return
+		}
+
+		atomic.AddUint32(&s.pipeline, 1)
+
+		if status := int(atomic.LoadInt32(&s.status)); status != http.StatusOK {
+			rw.WriteHeader(status)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "image/webp")
+		_, _ = rw.Write([]byte("optimized"))
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *countingServer) requests() uint32 {
+	return atomic.LoadUint32(&s.pipeline)
+}
+
+func newTestCluster(t *testing.T, conf config.ImaginaryProcessorConfig) *ImaginaryProcessor {
+	t.Helper()
+
+	p, err := NewImaginary(config.Config{Imaginary: conf})
+	if err != nil {
+		t.Fatalf("NewImaginary() unexpected error: %v", err)
+	}
+
+	return p
+}
+
+func optimizeKey(p *ImaginaryProcessor, key string) error {
+	_, err := p.Optimize(context.Background(), Request{
+		Source: []byte("original"),
+		Format: "image/jpeg",
+		Key:    key,
+		Spec:   Spec{TargetFormat: "image/webp"},
+	})
+
+	return err
+}
+
+func TestNewImaginary_InvalidCluster(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.ImaginaryProcessorConfig
+	}{
+		{name: "should not accept unknown balancer", conf: config.ImaginaryProcessorConfig{URL: "http://a", Balancer: "random"}},
+		{name: "should not accept invalid replica url", conf: config.ImaginaryProcessorConfig{URLs: []string{"http://a", "b"}}},
+		{name: "should not accept negative max failures", conf: config.ImaginaryProcessorConfig{URL: "http://a", MaxFailures: -1}},
+		{name: "should not accept invalid ejection time", conf: config.ImaginaryProcessorConfig{URL: "http://a", EjectionTime: "1"}},
+		{name: "should not accept invalid health check interval", conf: config.ImaginaryProcessorConfig{URL: "http://a", HealthCheckInterval: "x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewImaginary(config.Config{Imaginary: tt.conf}); err == nil {
+				t.Error("NewImaginary() expected error")
+			}
+		})
+	}
+}
+
+func TestImaginaryCluster_RoundRobin(t *testing.T) {
+	a, b := newCountingServer(t), newCountingServer(t)
+	p := newTestCluster(t, config.ImaginaryProcessorConfig{URLs: []string{a.URL, b.URL}})
+
+	for i := 0; i < 10; i++ {
+		if err := optimizeKey(p, "key"); err != nil {
+			t.Fatalf("Optimize() unexpected error: %v", err)
+		}
+	}
+
+	if a.requests() != 5 || b.requests() != 5 {
+		t.Errorf("unbalanced requests: %d and %d", a.requests(), b.requests())
+	}
+}
+
+func TestImaginaryCluster_Hash(t *testing.T) {
+	servers := []*countingServer{newCountingServer(t), newCountingServer(t), newCountingServer(t)}
+	p := newTestCluster(t, config.ImaginaryProcessorConfig{
+		URLs:     []string{servers[0].URL, servers[1].URL, servers[2].URL},
+		Balancer: BalancerHash,
+	})
+
+	for i := 0; i < 5; i++ {
+		if err := optimizeKey(p, "GET:http:localhost:/img.jpeg:300"); err != nil {
+			t.Fatalf("Optimize() unexpected error: %v", err)
+		}
+	}
+
+	used := 0
+
+	for _, s := range servers {
+		if s.requests() > 0 {
+			used++
+		}
+	}
+
+	if used != 1 {
+		t.Errorf("same key must always reach the same endpoint, %d endpoints used", used)
+	}
+}
+
+func TestImaginaryCluster_LeastInflight(t *testing.T) {
+	c, err := newImaginaryCluster(config.ImaginaryProcessorConfig{
+		URLs:     []string{"http://a", "http://b", "http://c"},
+		Balancer: BalancerLeastInflight,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt64(&c.endpoints[0].inflight, 3)
+	atomic.StoreInt64(&c.endpoints[1].inflight, 1)
+	atomic.StoreInt64(&c.endpoints[2].inflight, 2)
+
+	for i := 0; i < 3; i++ {
+		if got := c.pick(""); got != c.endpoints[1] {
+			t.Errorf("pick() = %s, want http://b", got.url)
+		}
+	}
+}
+
+func TestImaginaryCluster_PassiveEjection(t *testing.T) {
+	failing, healthy := newCountingServer(t), newCountingServer(t)
+	atomic.StoreInt32(&failing.status, http.StatusServiceUnavailable)
+
+	p := newTestCluster(t, config.ImaginaryProcessorConfig{
+		URLs:        []string{failing.URL, healthy.URL},
+		MaxFailures: 2,
+	})
+
+	for i := 0; i < 20; i++ {
+		_ = optimizeKey(p, "key")
+	}
+
+	if failing.requests() != 2 {
+		t.Errorf("failing endpoint must be ejected after 2 failures, got %d requests", failing.requests())
+	}
+}
+
+func TestImaginaryCluster_NoEjectionOnClientError(t *testing.T) {
+	s := newCountingServer(t)
+	atomic.StoreInt32(&s.status, http.StatusBadRequest)
+
+	p := newTestCluster(t, config.ImaginaryProcessorConfig{URLs: []string{s.URL}, MaxFailures: 1})
+
+	_ = optimizeKey(p, "key")
+
+	if !p.cluster.endpoints[0].available(time.Now().UnixNano()) {
+		t.Error("endpoint must not be ejected on client errors")
+	}
+}
+
+func TestImaginaryCluster_HealthCheck(t *testing.T) {
+	unhealthy, healthy := newCountingServer(t), newCountingServer(t)
+	atomic.StoreInt32(&unhealthy.health, http.StatusInternalServerError)
+
+	p := newTestCluster(t, config.ImaginaryProcessorConfig{
+		URLs:                []string{unhealthy.URL, healthy.URL},
+		HealthCheckInterval: "10ms",
+	})
+
+	// Checks run along with traffic, picking endpoints is enough to trigger them.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && p.cluster.endpoints[0].available(time.Now().UnixNano()) {
+		p.cluster.pick("")
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := optimizeKey(p, "key"); err != nil {
+			t.Fatalf("Optimize() unexpected error: %v", err)
+		}
+	}
+
+	if unhealthy.requests() != 0 {
+		t.Errorf("unhealthy endpoint must not receive requests, got %d", unhealthy.requests())
+	}
+
+	// Recovery.
+	atomic.StoreInt32(&unhealthy.health, http.StatusOK)
+
+	deadline = time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && !p.cluster.endpoints[0].available(time.Now().UnixNano()) {
+		p.cluster.pick("")
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if !p.cluster.endpoints[0].available(time.Now().UnixNano()) {
+		t.Error("endpoint must be available again once healthy")
+	}
+}
+
+func TestImaginaryCluster_HealthCheckDisabled(t *testing.T) {
+	s := newCountingServer(t)
+	atomic.StoreInt32(&s.health, http.StatusInternalServerError)
+
+	p := newTestCluster(t, config.ImaginaryProcessorConfig{URL: s.URL})
+
+	for i := 0; i < 3; i++ {
+		if err := optimizeKey(p, "key"); err != nil {
+			t.Fatalf("Optimize() unexpected error: %v", err)
+		}
+	}
+
+	if p.cluster.healthInterval != 0 || !p.cluster.endpoints[0].available(time.Now().UnixNano()) {
+		t.Error("single endpoint must not be health checked without interval")
+	}
+}
+
+func TestImaginaryCluster_AllDown(t *testing.T) {
+	s := newCountingServer(t)
+	p := newTestCluster(t, config.ImaginaryProcessorConfig{URLs: []string{s.URL}})
+
+	atomic.StoreUint32(&p.cluster.endpoints[0].unhealthy, 1)
+
+	if err := optimizeKey(p, "key"); err != nil {
+		t.Errorf("Optimize() must still try endpoints when all are down: %v", err)
+	}
+}
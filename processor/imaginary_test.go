@@ -0,0 +1,472 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+func newTestImaginary(t *testing.T, handler http.HandlerFunc) *ImaginaryProcessor {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	p, err := NewImaginary(config.Config{Imaginary: config.ImaginaryProcessorConfig{URL: srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestImaginaryProcessor_Optimize(t *testing.T) {
+	p := newTestImaginary(t, func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/pipeline" {
+			t.Errorf("unexpected imaginary path %s", req.URL.Path)
+		}
+
+		rw.Header().Set("Content-Type", "image/webp")
+		rw.Header().Set("Image-Width", "120")
+		rw.Header().Set("Image-Height", "80")
+		_, _ = rw.Write([]byte("optimized"))
+	})
+
+	got, err := p.Optimize(context.Background(), Request{
+		Source: []byte("original"),
+		Format: "image/jpeg",
+		Spec:   Spec{TargetFormat: "image/webp", Quality: 75, Width: 120},
+	})
+	if err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(got.Bytes, []byte("optimized")) || got.Format != "image/webp" {
+		t.Errorf("Optimize() = %s %s, want optimized image/webp", got.Bytes, got.Format)
+	}
+
+	if got.Width != 120 || got.Height != 80 {
+		t.Errorf("Optimize() dimensions = %dx%d, want 120x80", got.Width, got.Height)
+	}
+
+	if got.Metadata["processor"] != "imaginary" {
+		t.Errorf("Optimize() metadata = %v", got.Metadata)
+	}
+}
+
+func TestImaginaryProcessor_OptimizeFormats(t *testing.T) {
+	tests := []struct {
+		name         string
+		request      Request
+		wantOps      string
+		wantFilename string
+		wantFormat   string
+		wantErr      bool
+	}{
+		{
+			name:         "should convert jpeg to webp with quality",
+			request:      Request{Format: "image/jpeg", Spec: Spec{TargetFormat: "image/webp", Quality: 75}},
+			wantOps:      `[{"operation":"convert","params":{"quality":75,"type":"webp","stripmeta":true}}]`,
+			wantFilename: "image.jpg",
+			wantFormat:   "image/webp",
+		},
+		{
+			name:         "should resize then convert png to avif",
+			request:      Request{Format: "image/png", Spec: Spec{TargetFormat: "image/avif", Quality: 50, Width: 300}},
+			wantOps:      `[{"operation":"resize","params":{"width":300}},{"operation":"convert","params":{"quality":50,"type":"avif","stripmeta":true}}]`,
+			wantFilename: "image.png",
+			wantFormat:   "image/avif",
+		},
+		{
+			name:         "should keep source format without target format",
+			request:      Request{Format: "image/png; charset=binary", Spec: Spec{Quality: 80}},
+			wantOps:      `[{"operation":"convert","params":{"quality":80,"type":"png","stripmeta":true}}]`,
+			wantFilename: "image.png",
+			wantFormat:   "image/png",
+		},
+		{
+			name:         "should convert to jpeg",
+			request:      Request{Format: "image/gif", Spec: Spec{TargetFormat: "image/jpeg"}},
+			wantOps:      `[{"operation":"convert","params":{"type":"jpeg","stripmeta":true}}]`,
+			wantFilename: "image.gif",
+			wantFormat:   "image/jpeg",
+		},
+		{
+			name:    "should not convert to unsupported format",
+			request: Request{Format: "image/jpeg", Spec: Spec{TargetFormat: "image/bmp"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestImaginary(t, func(rw http.ResponseWriter, req *http.Request) {
+				if ops := req.URL.Query().Get("operations"); ops != tt.wantOps {
+					t.Errorf("operations = %s, want %s", ops, tt.wantOps)
+				}
+
+				_, fh, err := req.FormFile("file")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if fh.Filename != tt.wantFilename {
+					t.Errorf("filename = %s, want %s", fh.Filename, tt.wantFilename)
+				}
+
+				rw.Header().Set("Content-Type", tt.wantFormat)
+				_, _ = rw.Write([]byte("optimized"))
+			})
+
+			tt.request.Source = []byte("original")
+
+			got, err := p.Optimize(context.Background(), tt.request)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Optimize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got.Format != tt.wantFormat {
+				t.Errorf("Optimize() format = %s, want %s", got.Format, tt.wantFormat)
+			}
+		})
+	}
+}
+
+func TestImaginaryProcessor_OptimizeErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		wantStatus  int
+		wantMessage string
+	}{
+		{
+			name:        "should return imaginary json error message",
+			status:      http.StatusBadRequest,
+			contentType: "application/json",
+			body:        `{"message":"Unsupported media type","status":400}`,
+			wantStatus:  http.StatusBadRequest,
+			wantMessage: "Unsupported media type",
+		},
+		{
+			name:        "should return raw body on non json error",
+			status:      http.StatusBadGateway,
+			contentType: "text/plain",
+			body:        "bad gateway\n",
+			wantStatus:  http.StatusBadGateway,
+			wantMessage: "bad gateway",
+		},
+		{
+			name:        "should not accept unexpected content type",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        `{}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestImaginary(t, func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", tt.contentType)
+				rw.WriteHeader(tt.status)
+				_, _ = rw.Write([]byte(tt.body))
+			})
+
+			_, err := p.Optimize(context.Background(), Request{
+				Source: []byte("original"),
+				Format: "image/jpeg",
+				Spec:   Spec{TargetFormat: "image/webp"},
+			})
+			if err == nil {
+				t.Fatal("Optimize() expected error")
+			}
+
+			var se *StatusError
+
+			if tt.wantStatus == 0 {
+				if errors.As(err, &se) {
+					t.Errorf("Optimize() unexpected status error: %v", err)
+				}
+
+				return
+			}
+
+			if !errors.As(err, &se) {
+				t.Fatalf("Optimize() error = %v, want *StatusError", err)
+			}
+
+			if se.Service != "imaginary" || se.StatusCode != tt.wantStatus || se.Message != tt.wantMessage {
+				t.Errorf("Optimize() error = %s %d %q, want imaginary %d %q",
+					se.Service, se.StatusCode, se.Message, tt.wantStatus, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestImaginaryProcessor_OptimizeCanceled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	p := newTestImaginary(t, func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := p.Optimize(ctx, Request{Source: []byte("original"), Format: "image/jpeg"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Optimize() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Optimize() must return as soon as context is done, took %s", elapsed)
+	}
+}
+
+func TestImaginaryProcessor_OptimizeURLFetch(t *testing.T) {
+	tests := []struct {
+		name       string
+		baseURL    string
+		path       string
+		wantMethod string
+		wantURL    string
+	}{
+		{
+			name:       "should let imaginary fetch the source from base url and path",
+			baseURL:    "http://backend:8080/",
+			path:       "/images/photo.jpg?w=300",
+			wantMethod: http.MethodGet,
+			wantURL:    "http://backend:8080/images/photo.jpg?w=300",
+		},
+		{
+			name:       "should upload the source without request path",
+			baseURL:    "http://backend:8080",
+			wantMethod: http.MethodPost,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if req.Method != tt.wantMethod {
+					t.Errorf("imaginary method = %s, want %s", req.Method, tt.wantMethod)
+				}
+
+				if got := req.URL.Query().Get("url"); got != tt.wantURL {
+					t.Errorf("imaginary url param = %q, want %q", got, tt.wantURL)
+				}
+
+				if tt.wantURL != "" && req.ContentLength > 0 {
+					t.Errorf("source must not be uploaded in url-fetch mode, got %d bytes", req.ContentLength)
+				}
+
+				rw.Header().Set("Content-Type", "image/webp")
+				_, _ = rw.Write([]byte("optimized"))
+			}))
+			defer srv.Close()
+
+			p, err := NewImaginary(config.Config{Imaginary: config.ImaginaryProcessorConfig{
+				URL:           srv.URL,
+				SourceBaseURL: tt.baseURL,
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = p.Optimize(context.Background(), Request{
+				Source: []byte("original"),
+				Format: "image/jpeg",
+				Path:   tt.path,
+				Spec:   Spec{TargetFormat: "image/webp"},
+			})
+			if err != nil {
+				t.Fatalf("Optimize() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewImaginary_InvalidSourceBaseURL(t *testing.T) {
+	for _, u := range []string{"backend:8080", "unix:///var/run/backend.sock", "ftp://backend"} {
+		_, err := NewImaginary(config.Config{Imaginary: config.ImaginaryProcessorConfig{
+			URL:           "http://imaginary",
+			SourceBaseURL: u,
+		}})
+		if err == nil {
+			t.Errorf("NewImaginary() expected error with source base url %q", u)
+		}
+	}
+}
+
+func TestImaginaryProcessor_OptimizeStreamedUpload(t *testing.T) {
+	source := bytes.Repeat([]byte("original"), 1<<16)
+
+	p := newTestImaginary(t, func(rw http.ResponseWriter, req *http.Request) {
+		file, header, err := req.FormFile("file")
+		if err != nil {
+			t.Fatalf("unable to read uploaded file: %v", err)
+		}
+
+		got, _ := ioutil.ReadAll(file)
+		if !bytes.Equal(got, source) || header.Filename != "image.png" {
+			t.Errorf("uploaded %s of %d bytes, want image.png of %d bytes", header.Filename, len(got), len(source))
+		}
+
+		rw.Header().Set("Content-Type", "image/webp")
+		_, _ = rw.Write([]byte("optimized"))
+	})
+
+	if _, err := p.Optimize(context.Background(), Request{
+		Source: source,
+		Format: "image/png",
+		Spec:   Spec{TargetFormat: "image/webp"},
+	}); err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+}
+
+func TestImaginaryProcessor_OptimizeResponseLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunked bool
+		size    int
+		wantErr bool
+	}{
+		{name: "should accept response within limit", size: 16},
+		{name: "should accept chunked response within limit", size: 16, chunked: true},
+		{name: "should not accept response above limit", size: 17, wantErr: true},
+		{name: "should not accept chunked response above limit", size: 17, chunked: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "image/webp")
+
+				if !tt.chunked {
+					rw.Header().Set("Content-Length", fmt.Sprint(tt.size))
+				}
+
+				rw.WriteHeader(http.StatusOK)
+
+				for i := 0; i < tt.size; i++ {
+					_, _ = rw.Write([]byte("x"))
+					rw.(http.Flusher).Flush()
+				}
+			}))
+			defer srv.Close()
+
+			p, err := NewImaginary(config.Config{Imaginary: config.ImaginaryProcessorConfig{URL: srv.URL, MaxResponseBytes: 16}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := p.Optimize(context.Background(), Request{Format: "image/jpeg", Spec: Spec{TargetFormat: "image/webp"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Optimize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr && !errors.Is(err, errResponseTooLarge) {
+				t.Errorf("Optimize() error = %v, want %v", err, errResponseTooLarge)
+			}
+
+			if !tt.wantErr && len(got.Bytes) != tt.size {
+				t.Errorf("Optimize() = %d bytes, want %d", len(got.Bytes), tt.size)
+			}
+		})
+	}
+}
+
+// bufferedUploadRequest is the former upload implementation, kept as benchmarks baseline.
+func bufferedUploadRequest(ctx context.Context, u string, r Request) (*http.Request, error) {
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+
+	fileWriter, err := writer.CreateFormFile("file", "image.jpg")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = fileWriter.Write(r.Source); err != nil {
+		return nil, err
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return req, nil
+}
+
+func BenchmarkUploadRequest(b *testing.B) {
+	builders := map[string]func(context.Context, string, Request) (*http.Request, error){
+		"buffered": bufferedUploadRequest,
+		"streamed": uploadRequest,
+	}
+
+	for _, size := range []int{1 << 20, 20 << 20} {
+		r := Request{Source: make([]byte, size), Format: "image/jpeg"}
+
+		for name, build := range builders {
+			b.Run(fmt.Sprintf("%s/%dMiB", name, size>>20), func(b *testing.B) {
+				b.ReportAllocs()
+
+				for i := 0; i < b.N; i++ {
+					req, err := build(context.Background(), "http://imaginary/pipeline", r)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					_, _ = io.Copy(ioutil.Discard, req.Body)
+					_ = req.Body.Close()
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkReadBody(b *testing.B) {
+	readers := map[string]func(*http.Response) ([]byte, error){
+		"readall": func(res *http.Response) ([]byte, error) {
+			return ioutil.ReadAll(res.Body)
+		},
+		"sized": func(res *http.Response) ([]byte, error) {
+			return readBody(res, defaultMaxResponseBytes)
+		},
+	}
+
+	for _, size := range []int{1 << 20, 20 << 20} {
+		body := make([]byte, size)
+
+		for name, read := range readers {
+			b.Run(fmt.Sprintf("%s/%dMiB", name, size>>20), func(b *testing.B) {
+				b.ReportAllocs()
+
+				for i := 0; i < b.N; i++ {
+					res := &http.Response{Body: ioutil.NopCloser(bytes.NewReader(body)), ContentLength: int64(size)}
+
+					if _, err := read(res); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
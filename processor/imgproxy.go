@@ -0,0 +1,202 @@
+package processor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+// imgproxyFormat return the imgproxy extension of given output MIME type.
+func imgproxyFormat(format string) (string, bool) {
+	switch format {
+	case FormatJPEG:
+		return "jpg", true
+	case FormatWebP, FormatAVIF, FormatPNG, FormatGIF:
+		return strings.TrimPrefix(format, "image/"), true
+	default:
+		return "", false
+	}
+}
+
+func isImgproxyResizeType(t string) bool {
+	switch t {
+	case "fit", "fill", "fill-down", "force", "auto":
+		return true
+	default:
+		return false
+	}
+}
+
+// ImgproxyProcessor process images with imgproxy, which fetch sources itself from a base URL.
+// imgproxy has no upload API, sources are always referenced by URL.
+type ImgproxyProcessor struct {
+	client http.Client
+	url    string
+
+	key  []byte
+	salt []byte
+
+	sourceBaseURL    string
+	resizeType       string
+	gravity          string
+	maxResponseBytes int64
+}
+
+// NewImgproxy instantiate a new imgproxy processor with given config.
+func NewImgproxy(conf config.Config) (*ImgproxyProcessor, error) {
+	c := conf.Imgproxy
+
+	for name, u := range map[string]string{"url": c.URL, "source base url": c.SourceBaseURL} {
+		pu, err := url.ParseRequestURI(u)
+		if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+			return nil, fmt.Errorf("invalid imgproxy %s %q", name, u)
+		}
+	}
+
+	key, salt, err := imgproxySignatureKeys(c)
+	if err != nil {
+		return nil, err
+	}
+
+	resizeType := c.ResizeType
+	if resizeType == "" {
+		resizeType = "fit"
+	}
+
+	if !isImgproxyResizeType(resizeType) {
+		return nil, fmt.Errorf("unsupported imgproxy resize type %q", resizeType)
+	}
+
+	timeout, err := parseDuration(c.Timeout, httpTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid imgproxy timeout: %w", err)
+	}
+
+	maxResponseBytes, err := responseLimit("imgproxy max response bytes", c.MaxResponseBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImgproxyProcessor{
+		client:           http.Client{Timeout: timeout},
+		url:              strings.TrimSuffix(c.URL, "/"),
+		key:              key,
+		salt:             salt,
+		sourceBaseURL:    strings.TrimSuffix(c.SourceBaseURL, "/"),
+		resizeType:       resizeType,
+		gravity:          c.Gravity,
+		maxResponseBytes: maxResponseBytes,
+	}, nil
+}
+
+// imgproxySignatureKeys decode the hex encoded key and salt, both empty when signature is disabled.
+func imgproxySignatureKeys(c config.ImgproxyProcessorConfig) ([]byte, []byte, error) {
+	key, err := hex.DecodeString(c.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid imgproxy key: %w", err)
+	}
+
+	salt, err := hex.DecodeString(c.Salt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid imgproxy salt: %w", err)
+	}
+
+	if (len(key) == 0) != (len(salt) == 0) {
+		return nil, nil, errors.New("imgproxy signature requires both key and salt")
+	}
+
+	return key, salt, nil
+}
+
+// processingPath build the imgproxy path of given request, without signature.
+func (ip *ImgproxyProcessor) processingPath(r Request) (string, string, error) {
+	tf := mimeType(r.Spec.TargetFormat)
+	if tf == "" {
+		tf = mimeType(r.Format)
+	}
+
+	ext, ok := imgproxyFormat(tf)
+	if !ok {
+		return "", "", fmt.Errorf("unsupported imgproxy target format %q", tf)
+	}
+
+	if r.Path == "" {
+		return "", "", errors.New("imgproxy requires the request path to reference the source")
+	}
+
+	path := r.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	opts := []string{}
+
+	if r.Spec.Width > 0 || r.Spec.Height > 0 {
+		opts = append(opts, fmt.Sprintf("rs:%s:%d:%d", ip.resizeType, r.Spec.Width, r.Spec.Height))
+	}
+
+	if ip.gravity != "" {
+		opts = append(opts, "g:"+ip.gravity)
+	}
+
+	if r.Spec.Quality > 0 {
+		opts = append(opts, "q:"+strconv.Itoa(r.Spec.Quality))
+	}
+
+	opts = append(opts, "f:"+ext)
+	source := base64.RawURLEncoding.EncodeToString([]byte(ip.sourceBaseURL + path))
+
+	return "/" + strings.Join(opts, "/") + "/" + source, tf, nil
+}
+
+// sign return the signature segment of given processing path, "insecure" without key.
+func (ip *ImgproxyProcessor) sign(path string) string {
+	if len(ip.key) == 0 {
+		return "insecure"
+	}
+
+	mac := hmac.New(sha256.New, ip.key)
+	_, _ = mac.Write(ip.salt)
+	_, _ = mac.Write([]byte(path))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// FetchesSource report that imgproxy always download sources itself.
+func (ip *ImgproxyProcessor) FetchesSource() bool {
+	return true
+}
+
+// Optimize process image with imgproxy, which fetch the source from the configured base URL.
+func (ip *ImgproxyProcessor) Optimize(ctx context.Context, r Request) (Result, error) {
+	path, tf, err := ip.processingPath(r)
+	if err != nil {
+		return Result{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ip.url+"/"+ip.sign(path)+path, nil)
+	if err != nil {
+		return Result{}, fmt.Errorf("unable to create imgproxy request: %w", err)
+	}
+
+	body, _, err := fetchImage(&ip.client, req, "imgproxy", tf, ip.maxResponseBytes)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Bytes:    body,
+		Format:   tf,
+		Metadata: map[string]string{"processor": "imgproxy"},
+	}, nil
+}
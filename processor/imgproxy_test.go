@@ -0,0 +1,175 @@
+package processor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+const (
+	testImgproxyKey  = "943b421c9eb07c830af81030552c86009268de4e532ba2ee2eab8247c6da0881"
+	testImgproxySalt = "520f986b998545b4785e0defbc4f3c1203f22de2374a3d53cb7a7fe9fea309c5"
+)
+
+func newTestImgproxy(t *testing.T, handler http.HandlerFunc, conf config.ImgproxyProcessorConfig) *ImgproxyProcessor {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	conf.URL = srv.URL
+	if conf.SourceBaseURL == "" {
+		conf.SourceBaseURL = "http://backend:8080"
+	}
+
+	p, err := NewImgproxy(config.Config{Imgproxy: conf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestNewImgproxy_InvalidConfig(t *testing.T) {
+	valid := config.ImgproxyProcessorConfig{URL: "http://imgproxy", SourceBaseURL: "http://backend"}
+
+	tests := []struct {
+		name   string
+		mutate func(c *config.ImgproxyProcessorConfig)
+	}{
+		{name: "should not accept missing url", mutate: func(c *config.ImgproxyProcessorConfig) { c.URL = "" }},
+		{name: "should not accept missing source base url", mutate: func(c *config.ImgproxyProcessorConfig) { c.SourceBaseURL = "" }},
+		{name: "should not accept non hex key", mutate: func(c *config.ImgproxyProcessorConfig) { c.Key, c.Salt = "zz", "00" }},
+		{name: "should not accept non hex salt", mutate: func(c *config.ImgproxyProcessorConfig) { c.Key, c.Salt = "00", "zz" }},
+		{name: "should not accept key without salt", mutate: func(c *config.ImgproxyProcessorConfig) { c.Key = "00" }},
+		{name: "should not accept unknown resize type", mutate: func(c *config.ImgproxyProcessorConfig) { c.ResizeType = "stretch" }},
+		{name: "should not accept invalid timeout", mutate: func(c *config.ImgproxyProcessorConfig) { c.Timeout = "1" }},
+		{name: "should not accept negative response limit", mutate: func(c *config.ImgproxyProcessorConfig) { c.MaxResponseBytes = -1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.mutate(&c)
+
+			if _, err := NewImgproxy(config.Config{Imgproxy: c}); err == nil {
+				t.Error("NewImgproxy() expected error")
+			}
+		})
+	}
+}
+
+func TestImgproxyProcessor_SignInsecure(t *testing.T) {
+	if got := (&ImgproxyProcessor{}).sign("/f:webp/source"); got != "insecure" {
+		t.Errorf("sign() without key = %s, want insecure", got)
+	}
+}
+
+func TestImgproxyProcessor_Optimize(t *testing.T) {
+	key, _ := hex.DecodeString(testImgproxyKey)
+	salt, _ := hex.DecodeString(testImgproxySalt)
+
+	p := newTestImgproxy(t, func(rw http.ResponseWriter, req *http.Request) {
+		parts := strings.SplitN(req.URL.Path, "/", 3)
+		path := "/" + parts[2]
+
+		mac := hmac.New(sha256.New, key)
+		_, _ = mac.Write(salt)
+		_, _ = mac.Write([]byte(path))
+
+		if want := base64.RawURLEncoding.EncodeToString(mac.Sum(nil)); parts[1] != want {
+			t.Errorf("imgproxy signature = %s, want %s", parts[1], want)
+		}
+
+		source := base64.RawURLEncoding.EncodeToString([]byte("http://backend:8080/images/photo.jpg?w=300"))
+		if want := "/rs:fill:300:200/g:sm/q:80/f:webp/" + source; path != want {
+			t.Errorf("imgproxy path = %s, want %s", path, want)
+		}
+
+		rw.Header().Set("Content-Type", "image/webp")
+		_, _ = rw.Write([]byte("optimized"))
+	}, config.ImgproxyProcessorConfig{Key: testImgproxyKey, Salt: testImgproxySalt, ResizeType: "fill", Gravity: "sm"})
+
+	got, err := p.Optimize(context.Background(), Request{
+		Source: []byte("original"),
+		Format: "image/jpeg",
+		Path:   "/images/photo.jpg?w=300",
+		Spec:   Spec{TargetFormat: "image/webp", Quality: 80, Width: 300, Height: 200},
+	})
+	if err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+
+	if string(got.Bytes) != "optimized" || got.Format != "image/webp" || got.Metadata["processor"] != "imgproxy" {
+		t.Errorf("Optimize() = %s %s %v", got.Bytes, got.Format, got.Metadata)
+	}
+}
+
+func TestImgproxyProcessor_OptimizeDefaults(t *testing.T) {
+	p := newTestImgproxy(t, func(rw http.ResponseWriter, req *http.Request) {
+		source := base64.RawURLEncoding.EncodeToString([]byte("http://backend:8080/photo.png"))
+		if want := "/insecure/f:png/" + source; req.URL.Path != want {
+			t.Errorf("imgproxy path = %s, want %s", req.URL.Path, want)
+		}
+
+		rw.Header().Set("Content-Type", "image/png")
+		_, _ = rw.Write([]byte("optimized"))
+	}, config.ImgproxyProcessorConfig{})
+
+	if _, err := p.Optimize(context.Background(), Request{Format: "image/png", Path: "photo.png"}); err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+}
+
+func TestImgproxyProcessor_OptimizeErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		contentType   string
+		request       Request
+		wantStatus    int
+		wantRetryable bool
+	}{
+		{name: "should return status error", status: http.StatusNotFound, contentType: "text/plain", wantStatus: 404},
+		{name: "should return retryable status error", status: http.StatusServiceUnavailable, contentType: "text/plain", wantStatus: 503, wantRetryable: true},
+		{name: "should not accept unexpected content type", status: http.StatusOK, contentType: "image/jpeg"},
+		{name: "should not accept unsupported target format", request: Request{Path: "/a", Spec: Spec{TargetFormat: "image/bmp"}}},
+		{name: "should not accept request without path", request: Request{Spec: Spec{TargetFormat: "image/webp"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestImgproxy(t, func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", tt.contentType)
+				rw.WriteHeader(tt.status)
+				_, _ = rw.Write([]byte("Not found"))
+			}, config.ImgproxyProcessorConfig{})
+
+			r := tt.request
+			if r.Path == "" && r.Spec.TargetFormat == "" {
+				r = Request{Path: "/photo.jpg", Spec: Spec{TargetFormat: "image/webp"}}
+			}
+
+			_, err := p.Optimize(context.Background(), r)
+			if err == nil {
+				t.Fatal("Optimize() expected error")
+			}
+
+			var se *StatusError
+			if errors.As(err, &se) != (tt.wantStatus != 0) {
+				t.Fatalf("Optimize() error = %v, want status %d", err, tt.wantStatus)
+			}
+
+			if se != nil && (se.StatusCode != tt.wantStatus || se.Retryable() != tt.wantRetryable || se.Message != "Not found") {
+				t.Errorf("Optimize() error = %+v, want status %d retryable %v", se, tt.wantStatus, tt.wantRetryable)
+			}
+		})
+	}
+}
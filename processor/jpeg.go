@@ -0,0 +1,99 @@
+package processor
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// JPEG markers.
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerAPP1 = 0xe1
+	markerAPP2 = 0xe2
+	markerAPPD = 0xed
+	markerCOM  = 0xfe
+)
+
+// markerSegment is a JPEG marker with its payload, raw hold the whole segment including fill bytes.
+type markerSegment struct {
+	marker  byte
+	raw     []byte
+	payload []byte
+}
+
+// scanJPEG call fn with each segment following SOI until the first scan or fn return false.
+// It return the offset where fn stopped or where image data start.
+func scanJPEG(b []byte, fn func(s markerSegment) bool) (int, error) {
+	if len(b) < 2 || b[0] != 0xff || b[1] != markerSOI {
+		return 0, fmt.Errorf("%w: missing jpeg SOI marker", ErrInvalidSource)
+	}
+
+	for i := 2; i < len(b); {
+		s, end, err := nextSegment(b, i)
+		if err != nil {
+			return 0, err
+		}
+
+		if s.marker == markerEOI || s.marker == markerSOS {
+			return i, nil
+		}
+
+		if !fn(s) {
+			return end, nil
+		}
+
+		i = end
+	}
+
+	return 0, fmt.Errorf("%w: jpeg without image data", ErrInvalidSource)
+}
+
+// nextSegment parse the segment starting at given offset, it return the segment and the offset following it.
+func nextSegment(b []byte, i int) (markerSegment, int, error) {
+	if b[i] != 0xff {
+		return markerSegment{}, 0, fmt.Errorf("%w: jpeg marker expected at offset %d", ErrInvalidSource, i)
+	}
+
+	// Markers may be preceded by any number of fill bytes.
+	j := i + 1
+	for j < len(b) && b[j] == 0xff {
+		j++
+	}
+
+	if j >= len(b) {
+		return markerSegment{}, 0, fmt.Errorf("%w: truncated jpeg", ErrInvalidSource)
+	}
+
+	marker := b[j]
+
+	// Standalone markers have no length, EOI and SOS are followed by image data rather than a payload.
+	if marker == markerEOI || marker == markerSOS || isStandaloneMarker(marker) {
+		return markerSegment{marker: marker, raw: b[i : j+1]}, j + 1, nil
+	}
+
+	if j+3 > len(b) {
+		return markerSegment{}, 0, fmt.Errorf("%w: truncated jpeg segment", ErrInvalidSource)
+	}
+
+	end := j + 1 + int(binary.BigEndian.Uint16(b[j+1:]))
+	if end > len(b) || end < j+3 {
+		return markerSegment{}, 0, fmt.Errorf("%w: invalid jpeg segment length at offset %d", ErrInvalidSource, i)
+	}
+
+	return markerSegment{marker: marker, raw: b[i:end], payload: b[j+3 : end]}, end, nil
+}
+
+// isStandaloneMarker report whether given marker, TEM or RSTn, has no length nor payload.
+func isStandaloneMarker(marker byte) bool {
+	return marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7)
+}
+
+// jpegSegment build a marker segment with given payload.
+func jpegSegment(marker byte, payload []byte) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+
+	return append(seg, payload...)
+}
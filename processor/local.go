@@ -1,13 +1,300 @@
 package processor
 
-// LocalProcessor process images directly in traefik itself, unsupported with interpreter limitations.
-type LocalProcessor struct{}
-
-// Optimize optimize image with given params.
-func (lp *LocalProcessor) Optimize(media []byte, of string, tf string, q, w int) ([]byte, string, error) {
-	// newImage, err := bimg.NewImage(media).Convert(bimg.WEBP)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	return media, tf, nil
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+// LocalProcessor process images directly in traefik itself, with pure Go codecs and resampling.
+// Only JPEG, PNG and GIF can be decoded and encoded, other target formats keep the source format.
+type LocalProcessor struct {
+	filter resampleFilter
+}
+
+// NewLocal instantiate a new local processor with given config.
+func NewLocal(conf config.Config) (*LocalProcessor, error) {
+	f, err := lookupFilter(conf.Local.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalProcessor{filter: f}, nil
+}
+
+// isLocalFormat report whether the local processor can encode given MIME type.
+func isLocalFormat(format string) bool {
+	return format == FormatJPEG || format == FormatPNG || format == FormatGIF
+}
+
+// Optimize decode, resize and re-encode given image.
+func (lp *LocalProcessor) Optimize(ctx context.Context, req Request) (Result, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(req.Source))
+	if err != nil {
+		return Result{}, fmt.Errorf("%w: %v", ErrInvalidSource, err)
+	}
+
+	if format == "gif" && isAnimatedGIF(req.Source) {
+		// Resizing animations is not supported, keep them untouched.
+		return untouched(req.Source, format, cfg.Width, cfg.Height), nil
+	}
+
+	img, palette, err := decodeOriented(req.Source)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	// Taken once oriented, which may swap dimensions.
+	size := img.Bounds().Size()
+	img = lp.fit(img, req.Spec)
+
+	if err = ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	tf := localTargetFormat(req.Spec.TargetFormat, format)
+
+	buf := &bytes.Buffer{}
+	if err = encode(buf, img, tf, req.Spec.Quality, palette); err != nil {
+		return Result{}, err
+	}
+
+	b := img.Bounds()
+
+	// Re-encoding in the source format at the same size may grow images, keep the original then.
+	if tf == "image/"+format && b.Size() == size && buf.Len() >= len(req.Source) {
+		return untouched(req.Source, format, b.Dx(), b.Dy()), nil
+	}
+
+	return Result{
+		Bytes:    buf.Bytes(),
+		Format:   tf,
+		Width:    b.Dx(),
+		Height:   b.Dy(),
+		Metadata: map[string]string{"processor": "local"},
+	}, nil
+}
+
+// decodeOriented decode given image with its EXIF orientation applied, along with its palette if any.
+func decodeOriented(src []byte) (image.Image, color.Palette, error) {
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidSource, err)
+	}
+
+	// Resized GIFs are encoded with the source palette rather than a fixed one.
+	var palette color.Palette
+	if p, ok := img.(*image.Paletted); ok {
+		palette = p.Palette
+	}
+
+	// Encoders drop EXIF, apply the orientation so that the output still display upright.
+	if o := exifOrientation(src); o != orientationNormal {
+		img = orient(img, o)
+	}
+
+	return img, palette, nil
+}
+
+// fit resize img within the dimensions of given spec, keeping its aspect ratio.
+func (lp *LocalProcessor) fit(img image.Image, spec Spec) image.Image {
+	b := img.Bounds()
+
+	width, height := fitSize(b.Dx(), b.Dy(), spec.Width, spec.Height)
+	if width == b.Dx() && height == b.Dy() {
+		return img
+	}
+
+	return resize(img, width, height, lp.resampler())
+}
+
+// localTargetFormat return given target MIME type when it can be encoded, the source format otherwise.
+func localTargetFormat(target, format string) string {
+	if tf := mimeType(target); isLocalFormat(tf) {
+		return tf
+	}
+
+	return "image/" + format
+}
+
+// untouched return given source as the result of the local processor.
+func untouched(src []byte, format string, width, height int) Result {
+	return Result{
+		Bytes:    src,
+		Format:   "image/" + format,
+		Width:    width,
+		Height:   height,
+		Metadata: map[string]string{"processor": "local"},
+	}
+}
+
+// isAnimatedGIF report whether given GIF image has several frames, by counting image descriptors
+// without decoding them.
+func isAnimatedGIF(b []byte) bool {
+	const (
+		headerSize     = 6 + 7 // Signature and logical screen descriptor.
+		descriptorSize = 1 + 9 // Separator, position, size and packed fields.
+	)
+
+	if len(b) < headerSize {
+		return false
+	}
+
+	i := headerSize + gifColorTableSize(b[10])
+	frames := 0
+
+	for i < len(b) {
+		switch b[i] {
+		case 0x2c: // Image descriptor, followed by its optional color table, LZW code size and data.
+			if frames++; frames > 1 {
+				return true
+			}
+
+			if i+descriptorSize >= len(b) {
+				return false
+			}
+
+			i += descriptorSize + gifColorTableSize(b[i+9]) + 1
+		case 0x21: // Extension, followed by its label and data.
+			i += 2
+		default: // Trailer or malformed image.
+			return false
+		}
+
+		var ok bool
+		if i, ok = skipGIFSubBlocks(b, i); !ok {
+			return false
+		}
+	}
+
+	return false
+}
+
+// gifColorTableSize return the size of the color table announced by given packed fields, zero when absent.
+func gifColorTableSize(packed byte) int {
+	if packed&0x80 == 0 {
+		return 0
+	}
+
+	return 3 << (packed&0x07 + 1)
+}
+
+// skipGIFSubBlocks return the offset following the data sub-blocks starting at i, false when truncated.
+func skipGIFSubBlocks(b []byte, i int) (int, bool) {
+	for i < len(b) {
+		n := int(b[i])
+		i += 1 + n
+
+		if n == 0 {
+			return i, true
+		}
+	}
+
+	return i, false
+}
+
+// resampler return configured filter, the zero value processor use the default one.
+func (lp *LocalProcessor) resampler() resampleFilter {
+	if lp.filter.kernel == nil {
+		f, _ := lookupFilter(FilterCatmullRom)
+
+		return f
+	}
+
+	return lp.filter
+}
+
+// fitSize return dimensions fitting within given width and height while keeping the aspect ratio,
+// a zero width or height is unconstrained.
+func fitSize(srcWidth, srcHeight, width, height int) (int, int) {
+	if (width == 0 && height == 0) || srcWidth == 0 || srcHeight == 0 {
+		return srcWidth, srcHeight
+	}
+
+	ratio := math.Inf(1)
+	if width > 0 {
+		ratio = float64(width) / float64(srcWidth)
+	}
+
+	if height > 0 {
+		ratio = math.Min(ratio, float64(height)/float64(srcHeight))
+	}
+
+	w := int(math.Round(float64(srcWidth) * ratio))
+	h := int(math.Round(float64(srcHeight) * ratio))
+
+	if w < 1 {
+		w = 1
+	}
+
+	if h < 1 {
+		h = 1
+	}
+
+	return w, h
+}
+
+// encode write img in given format. GIFs are quantized to given palette, or to a fixed one when nil.
+func encode(buf *bytes.Buffer, img image.Image, format string, quality int, palette color.Palette) error {
+	var err error
+
+	switch format {
+	case "image/jpeg":
+		if quality <= 0 || quality > 100 {
+			quality = jpeg.DefaultQuality
+		}
+
+		err = jpeg.Encode(buf, flatten(img), &jpeg.Options{Quality: quality})
+	case "image/png":
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(buf, img)
+	case "image/gif":
+		var opts *gif.Options
+		if palette != nil {
+			opts = &gif.Options{NumColors: len(palette), Quantizer: paletteQuantizer(palette)}
+		}
+
+		err = gif.Encode(buf, img, opts)
+	default:
+		err = fmt.Errorf("unsupported local target format %q", format)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to encode image: %w", err)
+	}
+
+	return nil
+}
+
+// paletteQuantizer quantize images to a fixed palette, like the one of their source.
+type paletteQuantizer color.Palette
+
+func (q paletteQuantizer) Quantize(p color.Palette, _ image.Image) color.Palette {
+	return append(p, q...)
+}
+
+// flatten draw img over a white background, JPEG has no alpha channel and would turn transparency black.
+func flatten(img image.Image) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+
+	return dst
 }
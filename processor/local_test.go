@@ -0,0 +1,355 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+func testImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+
+	return img
+}
+
+func encodeTestImage(t testing.TB, img image.Image, format string) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+
+	var err error
+
+	switch format {
+	case "image/jpeg":
+		err = jpeg.Encode(buf, img, nil)
+	case "image/png":
+		err = png.Encode(buf, img)
+	case "image/gif":
+		err = gif.Encode(buf, img, nil)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestNewLocal(t *testing.T) {
+	for _, f := range []string{"", FilterBox, FilterBilinear, FilterCatmullRom, FilterLanczos} {
+		if _, err := NewLocal(config.Config{Local: config.LocalProcessorConfig{Filter: f}}); err != nil {
+			t.Errorf("NewLocal() unexpected error with filter %q: %v", f, err)
+		}
+	}
+
+	if _, err := NewLocal(config.Config{Local: config.LocalProcessorConfig{Filter: "nearest"}}); err == nil {
+		t.Error("NewLocal() expected error with unsupported filter")
+	}
+}
+
+func TestLocalProcessor_Optimize(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		spec       Spec
+		wantFormat string
+		wantWidth  int
+		wantHeight int
+	}{
+		{
+			name:       "should resize jpeg keeping aspect ratio",
+			format:     "image/jpeg",
+			spec:       Spec{TargetFormat: "image/jpeg", Quality: 80, Width: 50},
+			wantFormat: "image/jpeg",
+			wantWidth:  50,
+			wantHeight: 25,
+		},
+		{
+			name:       "should convert png to jpeg",
+			format:     "image/png",
+			spec:       Spec{TargetFormat: "image/jpeg"},
+			wantFormat: "image/jpeg",
+			wantWidth:  100,
+			wantHeight: 50,
+		},
+		{
+			name:       "should keep source format with unsupported target",
+			format:     "image/png",
+			spec:       Spec{TargetFormat: "image/webp", Width: 20},
+			wantFormat: "image/png",
+			wantWidth:  20,
+			wantHeight: 10,
+		},
+		{
+			name:       "should resize gif",
+			format:     "image/gif",
+			spec:       Spec{Width: 10},
+			wantFormat: "image/gif",
+			wantWidth:  10,
+			wantHeight: 5,
+		},
+		{
+			name:       "should fit within width and height",
+			format:     "image/png",
+			spec:       Spec{TargetFormat: "image/png", Width: 80, Height: 20},
+			wantFormat: "image/png",
+			wantWidth:  40,
+			wantHeight: 20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lp := &LocalProcessor{}
+
+			got, err := lp.Optimize(context.Background(), Request{
+				Source: encodeTestImage(t, testImage(100, 50), tt.format),
+				Format: tt.format,
+				Spec:   tt.spec,
+			})
+			if err != nil {
+				t.Fatalf("Optimize() unexpected error: %v", err)
+			}
+
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(got.Bytes))
+			if err != nil {
+				t.Fatalf("unable to decode result: %v", err)
+			}
+
+			if got.Format != tt.wantFormat || "image/"+format != tt.wantFormat {
+				t.Errorf("Optimize() format = %s encoded as %s, want %s", got.Format, format, tt.wantFormat)
+			}
+
+			if cfg.Width != tt.wantWidth || cfg.Height != tt.wantHeight || got.Width != cfg.Width || got.Height != cfg.Height {
+				t.Errorf("Optimize() = %dx%d reported %dx%d, want %dx%d",
+					cfg.Width, cfg.Height, got.Width, got.Height, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestLocalProcessor_OptimizeQuality(t *testing.T) {
+	source := encodeTestImage(t, testImage(200, 200), "image/png")
+	lp := &LocalProcessor{}
+
+	low, err := lp.Optimize(context.Background(), Request{Source: source, Spec: Spec{TargetFormat: "image/jpeg", Quality: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	high, err := lp.Optimize(context.Background(), Request{Source: source, Spec: Spec{TargetFormat: "image/jpeg", Quality: 95}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(low.Bytes) >= len(high.Bytes) {
+		t.Errorf("quality 10 gave %d bytes, must be smaller than quality 95 %d bytes", len(low.Bytes), len(high.Bytes))
+	}
+}
+
+func TestLocalProcessor_OptimizeAnimatedGIF(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{
+		Image: []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 8, 8), pal), image.NewPaletted(image.Rect(0, 0, 8, 8), pal)},
+		Delay: []int{10, 10},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := (&LocalProcessor{}).Optimize(context.Background(), Request{Source: buf.Bytes(), Spec: Spec{Width: 4}})
+	if err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(got.Bytes, buf.Bytes()) {
+		t.Error("Optimize() must keep animated gif untouched")
+	}
+}
+
+func TestIsAnimatedGIF(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	frame := image.NewPaletted(image.Rect(0, 0, 8, 8), pal)
+
+	encodeAll := func(frames ...*image.Paletted) []byte {
+		buf := &bytes.Buffer{}
+		if err := gif.EncodeAll(buf, &gif.GIF{Image: frames, Delay: make([]int, len(frames))}); err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.Bytes()
+	}
+
+	animated := encodeAll(frame, frame)
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{name: "should detect several frames", data: animated, want: true},
+		{name: "should not detect a single frame", data: encodeAll(frame)},
+		{name: "should not detect a static gif with global color table", data: encodeTestImage(t, testImage(10, 10), "image/gif")},
+		{name: "should not detect truncated frames", data: animated[:len(animated)/2]},
+		{name: "should not detect truncated header", data: animated[:8]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAnimatedGIF(tt.data); got != tt.want {
+				t.Errorf("isAnimatedGIF() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalProcessor_OptimizeGIFPalette(t *testing.T) {
+	// Four colors, so that no padding is added to the source color table.
+	pal := color.Palette{
+		color.RGBA{R: 255, A: 255}, color.RGBA{G: 255, A: 255}, color.RGBA{B: 255, A: 255}, color.RGBA{R: 255, G: 255, A: 255},
+	}
+	src := image.NewPaletted(image.Rect(0, 0, 40, 20), pal)
+
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i % len(pal))
+	}
+
+	got, err := (&LocalProcessor{}).Optimize(context.Background(), Request{
+		Source: encodeTestImage(t, src, "image/gif"),
+		Spec:   Spec{Width: 10},
+	})
+	if err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+
+	img, err := gif.Decode(bytes.NewReader(got.Bytes))
+	if err != nil {
+		t.Fatalf("unable to decode result: %v", err)
+	}
+
+	// Color tables are padded to a power of two, only used colors matter.
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if c := img.At(x, y); pal[pal.Index(c)] != c {
+				t.Fatalf("Optimize() pixel color %v, want one of source palette %v", c, pal)
+			}
+		}
+	}
+}
+
+func TestLocalProcessor_OptimizeKeepSmallerOriginal(t *testing.T) {
+	// Re-encoding a low quality JPEG with a higher quality grows it.
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, testImage(50, 50), &jpeg.Options{Quality: 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := (&LocalProcessor{}).Optimize(context.Background(), Request{
+		Source: buf.Bytes(),
+		Spec:   Spec{TargetFormat: "image/webp", Quality: 90},
+	})
+	if err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(got.Bytes, buf.Bytes()) || got.Format != "image/jpeg" || got.Width != 50 || got.Height != 50 {
+		t.Errorf("Optimize() = %d bytes %s %dx%d, want original jpeg", len(got.Bytes), got.Format, got.Width, got.Height)
+	}
+}
+
+func TestLocalProcessor_OptimizeInvalid(t *testing.T) {
+	_, err := (&LocalProcessor{}).Optimize(context.Background(), Request{Source: []byte("dummy image")})
+	if !errors.Is(err, ErrInvalidSource) {
+		t.Errorf("Optimize() error = %v, want %v", err, ErrInvalidSource)
+	}
+}
+
+func TestResize_UniformColor(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 37, 23))
+	want := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+
+	for y := 0; y < 23; y++ {
+		for x := 0; x < 37; x++ {
+			img.SetNRGBA(x, y, want)
+		}
+	}
+
+	for _, name := range []string{FilterBox, FilterBilinear, FilterCatmullRom, FilterLanczos} {
+		f, err := lookupFilter(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, size := range [][2]int{{10, 7}, {80, 50}} {
+			got := resize(img, size[0], size[1], f)
+
+			if got.Bounds().Dx() != size[0] || got.Bounds().Dy() != size[1] {
+				t.Fatalf("%s: resize() = %v, want %dx%d", name, got.Bounds(), size[0], size[1])
+			}
+
+			for y := 0; y < size[1]; y++ {
+				for x := 0; x < size[0]; x++ {
+					if c := got.RGBAAt(x, y); c != (color.RGBA{R: 200, G: 100, B: 50, A: 255}) {
+						t.Fatalf("%s: resize() pixel %d,%d = %v, want %v", name, x, y, c, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		width, height int
+		wantW, wantH  int
+	}{
+		{width: 0, height: 0, wantW: 400, wantH: 300},
+		{width: 200, height: 0, wantW: 200, wantH: 150},
+		{width: 0, height: 150, wantW: 200, wantH: 150},
+		{width: 200, height: 50, wantW: 67, wantH: 50},
+		{width: 800, height: 0, wantW: 800, wantH: 600},
+		{width: 1, height: 0, wantW: 1, wantH: 1},
+	}
+	for _, tt := range tests {
+		if w, h := fitSize(400, 300, tt.width, tt.height); w != tt.wantW || h != tt.wantH {
+			t.Errorf("fitSize(400, 300, %d, %d) = %dx%d, want %dx%d", tt.width, tt.height, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func BenchmarkLocalProcessor_Optimize(b *testing.B) {
+	source := encodeTestImage(b, testImage(1024, 768), "image/jpeg")
+
+	for _, f := range []string{FilterBox, FilterBilinear, FilterCatmullRom, FilterLanczos} {
+		lp, err := NewLocal(config.Config{Local: config.LocalProcessorConfig{Filter: f}})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(f, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				_, err := lp.Optimize(context.Background(), Request{Source: source, Spec: Spec{TargetFormat: "image/jpeg", Width: 300}})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,9 +1,15 @@
 package processor
 
+import "context"
+
 // NoneProcessor dummy processor, using null pattern.
 type NoneProcessor struct{}
 
 // Optimize return same data from media.
-func (lp *NoneProcessor) Optimize(media []byte, of string, tf string, q, w int) ([]byte, string, error) {
-	return media, of, nil
+func (lp *NoneProcessor) Optimize(_ context.Context, req Request) (Result, error) {
+	return Result{
+		Bytes:    req.Source,
+		Format:   req.Format,
+		Metadata: map[string]string{"processor": "none"},
+	}, nil
 }
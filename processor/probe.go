@@ -0,0 +1,307 @@
+package processor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrProbeUnsupported is returned when dimensions of a format cannot be read from its header.
+var ErrProbeUnsupported = errors.New("dimensions probing not supported")
+
+const (
+	// maxBoxDepth bound ISOBMFF boxes nesting followed while looking for ispe boxes.
+	maxBoxDepth = 4
+
+	// TIFF tags and field type read by probeTIFF.
+	tiffImageWidth  = 256
+	tiffImageLength = 257
+	tiffShort       = 3
+)
+
+// Probe return the displayed dimensions of given image of given format, reading its header only.
+// JPEG and PNG dimensions account for EXIF orientation, as processors apply it. Vector formats are not supported.
+func Probe(b []byte, format string) (int, int, error) {
+	switch format {
+	case FormatJPEG:
+		return probeJPEG(b)
+	case FormatPNG:
+		return probePNG(b)
+	case FormatGIF:
+		return probeGIF(b)
+	case FormatWebP:
+		return probeWebP(b)
+	case FormatAVIF, FormatHEIF:
+		return probeAVIF(b)
+	case FormatBMP:
+		return probeBMP(b)
+	case FormatTIFF:
+		return probeTIFF(b)
+	case FormatICO:
+		return probeICO(b)
+	default:
+		return 0, 0, fmt.Errorf("%w: %s", ErrProbeUnsupported, format)
+	}
+}
+
+func probePNG(b []byte) (int, int, error) {
+	// IHDR is always the first chunk.
+	if len(b) < 24 || string(b[12:16]) != "IHDR" {
+		return 0, 0, fmt.Errorf("%w: missing png IHDR chunk", ErrInvalidSource)
+	}
+
+	w, h := orientedSize(b, int(binary.BigEndian.Uint32(b[16:])), int(binary.BigEndian.Uint32(b[20:])))
+
+	return w, h, nil
+}
+
+func probeGIF(b []byte) (int, int, error) {
+	if len(b) < 10 {
+		return 0, 0, fmt.Errorf("%w: truncated gif logical screen descriptor", ErrInvalidSource)
+	}
+
+	return int(binary.LittleEndian.Uint16(b[6:])), int(binary.LittleEndian.Uint16(b[8:])), nil
+}
+
+func probeJPEG(b []byte) (int, int, error) {
+	var w, h int
+
+	_, err := scanJPEG(b, func(s markerSegment) bool {
+		// SOF0 to SOF15, except DHT, JPG and DAC sharing the range.
+		if s.marker < 0xc0 || s.marker > 0xcf || s.marker == 0xc4 || s.marker == 0xc8 || s.marker == 0xcc {
+			return true
+		}
+
+		if len(s.payload) >= 5 {
+			h = int(binary.BigEndian.Uint16(s.payload[1:]))
+			w = int(binary.BigEndian.Uint16(s.payload[3:]))
+		}
+
+		return false
+	})
+
+	switch {
+	case err != nil:
+		return 0, 0, err
+	case w == 0 || h == 0:
+		return 0, 0, fmt.Errorf("%w: missing jpeg SOF marker", ErrInvalidSource)
+	}
+
+	w, h = orientedSize(b, w, h)
+
+	return w, h, nil
+}
+
+// orientedSize return given stored dimensions once the EXIF orientation of given image is applied,
+// orientations from 5 to 8 transpose it.
+func orientedSize(b []byte, w, h int) (int, int) {
+	if exifOrientation(b) >= orientationTranspose {
+		return h, w
+	}
+
+	return w, h
+}
+
+func probeWebP(b []byte) (int, int, error) {
+	if len(b) < 30 {
+		return 0, 0, fmt.Errorf("%w: truncated webp header", ErrInvalidSource)
+	}
+
+	switch string(b[12:16]) {
+	case "VP8 ":
+		// Frame tag then start code.
+		if b[23] != 0x9d || b[24] != 0x01 || b[25] != 0x2a {
+			return 0, 0, fmt.Errorf("%w: missing webp VP8 start code", ErrInvalidSource)
+		}
+
+		return int(binary.LittleEndian.Uint16(b[26:]) & 0x3fff), int(binary.LittleEndian.Uint16(b[28:]) & 0x3fff), nil
+	case "VP8L":
+		if b[20] != 0x2f {
+			return 0, 0, fmt.Errorf("%w: missing webp VP8L signature", ErrInvalidSource)
+		}
+
+		bits := binary.LittleEndian.Uint32(b[21:])
+
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+	case "VP8X":
+		return int(uint24(b[24:])) + 1, int(uint24(b[27:])) + 1, nil
+	default:
+		return 0, 0, fmt.Errorf("%w: unknown webp chunk %q", ErrInvalidSource, b[12:16])
+	}
+}
+
+// probeBMP read the DIB header following the 14 bytes file header, its size tell OS/2 headers apart.
+// Negative heights are top-down bitmaps.
+func probeBMP(b []byte) (int, int, error) {
+	if len(b) >= 22 && binary.LittleEndian.Uint32(b[14:]) == 12 {
+		return int(binary.LittleEndian.Uint16(b[18:])), int(binary.LittleEndian.Uint16(b[20:])), nil
+	}
+
+	if len(b) < 26 {
+		return 0, 0, fmt.Errorf("%w: truncated bmp header", ErrInvalidSource)
+	}
+
+	w := int64(int32(binary.LittleEndian.Uint32(b[18:])))
+	h := int64(int32(binary.LittleEndian.Uint32(b[22:])))
+
+	if h < 0 {
+		h = -h
+	}
+
+	if w <= 0 || h == 0 {
+		return 0, 0, fmt.Errorf("%w: invalid bmp dimensions %dx%d", ErrInvalidSource, w, h)
+	}
+
+	return int(w), int(h), nil
+}
+
+// probeTIFF read ImageWidth and ImageLength tags of the first IFD, which processors decode.
+func probeTIFF(b []byte) (int, int, error) {
+	if len(b) < 8 {
+		return 0, 0, fmt.Errorf("%w: truncated tiff header", ErrInvalidSource)
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if b[0] == 'M' {
+		order = binary.BigEndian
+	}
+
+	off := uint64(order.Uint32(b[4:]))
+	if off+2 > uint64(len(b)) {
+		return 0, 0, fmt.Errorf("%w: tiff IFD out of bounds", ErrInvalidSource)
+	}
+
+	var w, h int
+
+	// Entries are a tag, a field type, a count then the value itself when it fits in 4 bytes.
+	for e, n := off+2, uint64(order.Uint16(b[off:])); n > 0 && e+12 <= uint64(len(b)); e, n = e+12, n-1 {
+		v := int(order.Uint32(b[e+8:]))
+		if order.Uint16(b[e+2:]) == tiffShort {
+			v = int(order.Uint16(b[e+8:]))
+		}
+
+		switch order.Uint16(b[e:]) {
+		case tiffImageWidth:
+			w = v
+		case tiffImageLength:
+			h = v
+		}
+	}
+
+	if w == 0 || h == 0 {
+		return 0, 0, fmt.Errorf("%w: missing tiff dimensions", ErrInvalidSource)
+	}
+
+	return w, h, nil
+}
+
+// probeICO return the largest image of the icon directory, zero sizes meaning 256 pixels.
+func probeICO(b []byte) (int, int, error) {
+	if len(b) < 6 {
+		return 0, 0, fmt.Errorf("%w: truncated ico header", ErrInvalidSource)
+	}
+
+	var w, h int
+
+	for i, n := 6, int(binary.LittleEndian.Uint16(b[4:])); n > 0 && i+2 <= len(b); i, n = i+16, n-1 {
+		ew, eh := int(b[i]), int(b[i+1])
+		if ew == 0 {
+			ew = 256
+		}
+
+		if eh == 0 {
+			eh = 256
+		}
+
+		if ew*eh > w*h {
+			w, h = ew, eh
+		}
+	}
+
+	if w == 0 {
+		return 0, 0, fmt.Errorf("%w: empty ico directory", ErrInvalidSource)
+	}
+
+	return w, h, nil
+}
+
+// uint24 decode a little endian 24 bits integer.
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// probeAVIF read ispe boxes of the meta box, shared by AVIF and HEIF. Thumbnails and alpha planes have their own,
+// the primary image is assumed to be the largest one rather than resolving item associations.
+func probeAVIF(b []byte) (int, int, error) {
+	var w, h int
+
+	err := walkBoxes(b, 0, func(typ string, payload []byte) {
+		// Full box header, then width and height.
+		if typ != "ispe" || len(payload) < 12 {
+			return
+		}
+
+		bw, bh := binary.BigEndian.Uint32(payload[4:]), binary.BigEndian.Uint32(payload[8:])
+		if uint64(bw)*uint64(bh) > uint64(w)*uint64(h) {
+			w, h = int(bw), int(bh)
+		}
+	})
+
+	switch {
+	case err != nil:
+		return 0, 0, err
+	case w == 0 || h == 0:
+		return 0, 0, fmt.Errorf("%w: missing avif ispe box", ErrInvalidSource)
+	}
+
+	return w, h, nil
+}
+
+// walkBoxes call fn with each ISOBMFF box leading to image properties, descending into meta, iprp and ipco.
+func walkBoxes(b []byte, depth int, fn func(typ string, payload []byte)) error {
+	for len(b) >= 8 {
+		size, header := uint64(binary.BigEndian.Uint32(b)), 8
+		typ := string(b[4:8])
+
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return fmt.Errorf("%w: truncated %s box", ErrInvalidSource, typ)
+			}
+
+			size, header = binary.BigEndian.Uint64(b[8:]), 16
+		}
+
+		if size < uint64(header) || size > uint64(len(b)) {
+			// Boxes following image properties, like mdat, may be truncated when only a header is given.
+			return nil
+		}
+
+		payload := b[header:size]
+		fn(typ, payload)
+
+		if depth < maxBoxDepth {
+			var err error
+
+			switch typ {
+			case "meta":
+				// Full box, version and flags come first.
+				if len(payload) >= 4 {
+					err = walkBoxes(payload[4:], depth+1, fn)
+				}
+			case "iprp", "ipco":
+				err = walkBoxes(payload, depth+1, fn)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		b = b[size:]
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// isoBox build an ISOBMFF box of given type around given payloads.
+func isoBox(typ string, payloads ...[]byte) []byte {
+	b := make([]byte, 8)
+	copy(b[4:], typ)
+
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+
+	return b
+}
+
+func ispeBox(w, h uint32) []byte {
+	p := make([]byte, 12)
+	binary.BigEndian.PutUint32(p[4:], w)
+	binary.BigEndian.PutUint32(p[8:], h)
+
+	return isoBox("ispe", p)
+}
+
+func testAVIF(ispe ...[]byte) []byte {
+	ftyp := isoBox("ftyp", []byte("avif\x00\x00\x00\x00avifmif1"))
+	ipco := isoBox("ipco", ispe...)
+	meta := isoBox("meta", make([]byte, 4), isoBox("hdlr", make([]byte, 24)), isoBox("iprp", ipco))
+
+	// Truncated mdat, as when only the beginning of a file is probed.
+	mdat := []byte("\x00\x10\x00\x00mdat")
+
+	return append(append(ftyp, meta...), mdat...)
+}
+
+// testBMP build a BMP file header followed by a DIB header of given size.
+func testBMP(headerSize uint32, w, h int32) []byte {
+	b := make([]byte, 14+headerSize)
+	copy(b, "BM")
+	binary.LittleEndian.PutUint32(b[14:], headerSize)
+
+	if headerSize == 12 {
+		binary.LittleEndian.PutUint16(b[18:], uint16(w))
+		binary.LittleEndian.PutUint16(b[20:], uint16(h))
+
+		return b
+	}
+
+	binary.LittleEndian.PutUint32(b[18:], uint32(w))
+	binary.LittleEndian.PutUint32(b[22:], uint32(h))
+
+	return b
+}
+
+// testTIFF build a TIFF header and an IFD with a SHORT height and a LONG width.
+func testTIFF(order binary.ByteOrder, w uint32, h uint16) []byte {
+	b := make([]byte, 8+2+3*12+4)
+	if order == binary.BigEndian {
+		copy(b, "MM\x00*")
+	} else {
+		copy(b, "II*\x00")
+	}
+
+	order.PutUint32(b[4:], 8)
+	order.PutUint16(b[8:], 3)
+
+	// Compression, then dimensions.
+	order.PutUint16(b[10:], 259)
+	order.PutUint16(b[12:], tiffShort)
+	order.PutUint16(b[22:], tiffImageLength)
+	order.PutUint16(b[24:], tiffShort)
+	order.PutUint32(b[26:], 1)
+	order.PutUint16(b[30:], h)
+	order.PutUint16(b[34:], tiffImageWidth)
+	order.PutUint16(b[36:], 4)
+	order.PutUint32(b[38:], 1)
+	order.PutUint32(b[42:], w)
+
+	return b
+}
+
+func TestProbe(t *testing.T) {
+	img := testImage(8, 4)
+
+	vp8 := []byte("RIFF\x00\x00\x00\x00WEBPVP8 \x00\x00\x00\x00\x00\x00\x00\x9d\x01\x2a\x40\x01\xf0\x00")
+	vp8l := []byte("RIFF\x00\x00\x00\x00WEBPVP8L\x00\x00\x00\x00\x2f")
+	vp8l = append(vp8l, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(vp8l[21:], uint32(640-1)|uint32(480-1)<<14)
+	vp8x := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x10\x00\x00\x00\x7f\x07\x00\x37\x04\x00")
+
+	tests := []struct {
+		name       string
+		data       []byte
+		format     string
+		wantWidth  int
+		wantHeight int
+		wantErr    error
+	}{
+		{name: "should read jpeg SOF", data: encodeTestImage(t, img, "image/jpeg"), format: FormatJPEG, wantWidth: 8, wantHeight: 4},
+		{name: "should swap transposed jpeg", data: orientedJPEG(t, img, 6), format: FormatJPEG, wantWidth: 4, wantHeight: 8},
+		{name: "should read png IHDR", data: encodeTestImage(t, img, "image/png"), format: FormatPNG, wantWidth: 8, wantHeight: 4},
+		{name: "should swap transposed png", data: orientedPNG(t, img, 8), format: FormatPNG, wantWidth: 4, wantHeight: 8},
+		{name: "should read gif logical screen", data: encodeTestImage(t, img, "image/gif"), format: FormatGIF, wantWidth: 8, wantHeight: 4},
+		{name: "should read webp VP8", data: vp8, format: FormatWebP, wantWidth: 320, wantHeight: 240},
+		{name: "should read webp VP8L", data: vp8l, format: FormatWebP, wantWidth: 640, wantHeight: 480},
+		{name: "should read webp VP8X", data: vp8x, format: FormatWebP, wantWidth: 1920, wantHeight: 1080},
+		{name: "should read largest avif ispe", data: testAVIF(ispeBox(160, 90), ispeBox(1600, 900)), format: FormatAVIF, wantWidth: 1600, wantHeight: 900},
+		{name: "should not accept avif without ispe", data: testAVIF(), format: FormatAVIF, wantErr: ErrInvalidSource},
+		{name: "should not accept truncated jpeg", data: []byte("\xff\xd8\xff\xe0\x00"), format: FormatJPEG, wantErr: ErrInvalidSource},
+		{name: "should not accept truncated png", data: []byte(pngSignature), format: FormatPNG, wantErr: ErrInvalidSource},
+		{name: "should not accept truncated gif", data: []byte("GIF89a"), format: FormatGIF, wantErr: ErrInvalidSource},
+		{name: "should not accept truncated webp", data: vp8[:20], format: FormatWebP, wantErr: ErrInvalidSource},
+		{name: "should read bmp info header", data: testBMP(40, 640, -480), format: FormatBMP, wantWidth: 640, wantHeight: 480},
+		{name: "should read bmp core header", data: testBMP(12, 320, 240), format: FormatBMP, wantWidth: 320, wantHeight: 240},
+		{name: "should not accept truncated bmp", data: []byte("BM\x00\x00\x00\x00"), format: FormatBMP, wantErr: ErrInvalidSource},
+		{name: "should read little endian tiff", data: testTIFF(binary.LittleEndian, 4000, 3000), format: FormatTIFF, wantWidth: 4000, wantHeight: 3000},
+		{name: "should read big endian tiff", data: testTIFF(binary.BigEndian, 100000, 8), format: FormatTIFF, wantWidth: 100000, wantHeight: 8},
+		{name: "should not accept tiff without dimensions", data: []byte("II*\x00\x08\x00\x00\x00\x00\x00"), format: FormatTIFF, wantErr: ErrInvalidSource},
+		{name: "should read largest ico entry", data: []byte("\x00\x00\x01\x00\x02\x00" + "\x10\x10" + strings.Repeat("\x00", 14) + "\x00\x00"), format: FormatICO, wantWidth: 256, wantHeight: 256},
+		{name: "should not probe vector format", data: []byte("<svg/>"), format: FormatSVG, wantErr: ErrProbeUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h, err := Probe(tt.data, tt.format)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Probe() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if w != tt.wantWidth || h != tt.wantHeight {
+				t.Errorf("Probe() = %dx%d, want %dx%d", w, h, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
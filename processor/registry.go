@@ -0,0 +1,130 @@
+package processor
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+// Factory instantiate a processor, settings is the raw configuration section of the driver
+// found under its name in config.Config.Drivers, nil if not defined.
+type Factory func(conf config.Config, settings map[string]interface{}) (Processor, error)
+
+// registry hold drivers available to every middleware instance of the process, builtin ones are added on first use.
+var registry struct { //nolint:gochecknoglobals // RegisterProcessor extend it process wide.
+	sync.RWMutex
+	once      sync.Once
+	factories map[string]Factory
+}
+
+func loadBuiltins() {
+	registry.once.Do(func() {
+		registry.factories = builtinProcessors()
+	})
+}
+
+// builtinProcessors return factories of the drivers shipped with the plugin.
+func builtinProcessors() map[string]Factory {
+	return map[string]Factory{
+		"imaginary": func(conf config.Config, _ map[string]interface{}) (Processor, error) {
+			p, err := NewImaginary(conf)
+			if err != nil {
+				return nil, err
+			}
+
+			return p, nil
+		},
+		"imgproxy": func(conf config.Config, _ map[string]interface{}) (Processor, error) {
+			p, err := NewImgproxy(conf)
+			if err != nil {
+				return nil, err
+			}
+
+			return p, nil
+		},
+		"local": func(conf config.Config, _ map[string]interface{}) (Processor, error) {
+			p, err := NewLocal(conf)
+			if err != nil {
+				return nil, err
+			}
+
+			return p, nil
+		},
+		"strip": func(conf config.Config, _ map[string]interface{}) (Processor, error) {
+			p, err := NewStrip(conf)
+			if err != nil {
+				return nil, err
+			}
+
+			return p, nil
+		},
+		"thumbor": func(conf config.Config, _ map[string]interface{}) (Processor, error) {
+			p, err := NewThumbor(conf)
+			if err != nil {
+				return nil, err
+			}
+
+			return p, nil
+		},
+		"exec": func(conf config.Config, _ map[string]interface{}) (Processor, error) {
+			p, err := NewExec(conf)
+			if err != nil {
+				return nil, err
+			}
+
+			return p, nil
+		},
+		"none": func(_ config.Config, _ map[string]interface{}) (Processor, error) {
+			return &NoneProcessor{}, nil
+		},
+	}
+}
+
+// RegisterProcessor make a processor available by name in the configuration.
+// It panics if name is empty, factory is nil or name is already registered.
+func RegisterProcessor(name string, factory Factory) {
+	loadBuiltins()
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if name == "" || factory == nil {
+		panic("processor: register requires a name and a factory")
+	}
+
+	if _, ok := registry.factories[name]; ok {
+		panic(fmt.Sprintf("processor: register called twice for driver %s", name))
+	}
+
+	registry.factories[name] = factory
+}
+
+// Drivers return sorted names of registered processors.
+func Drivers() []string {
+	loadBuiltins()
+
+	registry.RLock()
+	defer registry.RUnlock()
+
+	names := make([]string, 0, len(registry.factories))
+	for name := range registry.factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func lookup(name string) (Factory, bool) {
+	loadBuiltins()
+
+	registry.RLock()
+	defer registry.RUnlock()
+
+	f, ok := registry.factories[name]
+
+	return f, ok
+}
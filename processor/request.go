@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInvalidSource is returned when the source image cannot be decoded, retrying it is pointless.
+var ErrInvalidSource = errors.New("invalid source image")
+
+// Spec describe the transformation to apply on an image.
+type Spec struct {
+	// TargetFormat is the wanted output MIME type, like "image/webp".
+	TargetFormat string
+	// Quality is the encoding quality, from 1 to 100.
+	Quality int
+	// Width is the wanted output width in pixels, zero keeps the original width.
+	Width int
+	// Height is the wanted output height in pixels, zero keeps the aspect ratio.
+	Height int
+}
+
+// Request hold an image to process.
+type Request struct {
+	// Source is the original image.
+	Source []byte
+	// Format is the detected source MIME type, like "image/jpeg".
+	Format string
+	// Key identify the request, like its cache key, processors may use it for affinity.
+	Key string
+	// Path is the original request URI, path and query, processors fetching the source themselves
+	// resolve it against their own origin.
+	Path string
+	Spec Spec
+}
+
+// Result hold a processed image.
+type Result struct {
+	Bytes []byte
+	// Format is the MIME type of Bytes.
+	Format string
+	// Width and Height are the output dimensions in pixels, zero when unknown.
+	Width  int
+	Height int
+	// Metadata hold processor specific information, like its name.
+	Metadata map[string]string
+	// Stages report each processor run by a chain, in order, including failed ones.
+	Stages []Stage
+}
+
+// FellBack report whether a chain had to fall back from a failed processor. Such results are not what
+// the pipeline is configured to produce, like an untouched original during an outage, and should not be cached.
+func (r Result) FellBack() bool {
+	for _, s := range r.Stages {
+		if s.Err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Stage report a processor run within a chain.
+type Stage struct {
+	Name     string
+	Duration time.Duration
+	// Err is the failure which made the chain fall back to the next processor, nil on success.
+	Err error
+}
@@ -0,0 +1,229 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Supported local resampling filters.
+const (
+	FilterBox        = "box"
+	FilterBilinear   = "bilinear"
+	FilterCatmullRom = "catmullrom"
+	FilterLanczos    = "lanczos"
+)
+
+// resampleFilter is a separable convolution kernel, null beyond support.
+type resampleFilter struct {
+	support float64
+	kernel  func(x float64) float64
+}
+
+func lookupFilter(name string) (resampleFilter, error) {
+	switch name {
+	case FilterBox:
+		return resampleFilter{support: 0.5, kernel: boxKernel}, nil
+	case FilterBilinear:
+		return resampleFilter{support: 1, kernel: bilinearKernel}, nil
+	case "", FilterCatmullRom:
+		return resampleFilter{support: 2, kernel: catmullRomKernel}, nil
+	case FilterLanczos:
+		return resampleFilter{support: 3, kernel: lanczosKernel}, nil
+	default:
+		return resampleFilter{}, fmt.Errorf("unsupported resampling filter %q", name)
+	}
+}
+
+func boxKernel(x float64) float64 {
+	if math.Abs(x) <= 0.5 {
+		return 1
+	}
+
+	return 0
+}
+
+func bilinearKernel(x float64) float64 {
+	if x = math.Abs(x); x < 1 {
+		return 1 - x
+	}
+
+	return 0
+}
+
+func catmullRomKernel(x float64) float64 {
+	x = math.Abs(x)
+
+	switch {
+	case x < 1:
+		return (1.5*x-2.5)*x*x + 1
+	case x < 2:
+		return ((-0.5*x+2.5)*x-4)*x + 2
+	default:
+		return 0
+	}
+}
+
+func lanczosKernel(x float64) float64 {
+	x = math.Abs(x)
+
+	switch {
+	case x == 0:
+		return 1
+	case x < 3:
+		return 3 * math.Sin(math.Pi*x) * math.Sin(math.Pi*x/3) / (math.Pi * math.Pi * x * x)
+	default:
+		return 0
+	}
+}
+
+// contribution hold weights of source pixels, from start, making a destination pixel.
+type contribution struct {
+	start   int
+	weights []float64
+}
+
+// contributions compute, for each of dst pixels, weights of the src pixels it covers.
+// The kernel is stretched when downscaling so that every source pixel contributes.
+func contributions(dst, src int, f resampleFilter) []contribution {
+	scale := float64(src) / float64(dst)
+	fscale := math.Max(scale, 1)
+	support := f.support * fscale
+
+	cs := make([]contribution, dst)
+
+	for i := range cs {
+		center := (float64(i) + 0.5) * scale
+
+		start := int(math.Floor(center - support))
+		if start < 0 {
+			start = 0
+		}
+
+		end := int(math.Ceil(center + support))
+		if end > src {
+			end = src
+		}
+
+		weights := make([]float64, 0, end-start)
+		sum := 0.0
+
+		for j := start; j < end; j++ {
+			w := f.kernel((float64(j) + 0.5 - center) / fscale)
+			weights = append(weights, w)
+			sum += w
+		}
+
+		if sum == 0 {
+			// Kernel narrower than the pixel grid, use the nearest pixel.
+			start = int(center)
+			if start >= src {
+				start = src - 1
+			}
+
+			weights, sum = []float64{1}, 1
+		}
+
+		for k := range weights {
+			weights[k] /= sum
+		}
+
+		cs[i] = contribution{start: start, weights: weights}
+	}
+
+	return cs
+}
+
+// toRGBA convert img to premultiplied RGBA with bounds starting at origin, resampling premultiplied
+// values avoid dark fringes around transparent areas.
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+
+	if rgba, ok := img.(*image.RGBA); ok && b.Min == (image.Point{}) {
+		return rgba
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+
+	return dst
+}
+
+// resize scale img to width x height with given filter, in two separable passes.
+func resize(img image.Image, width, height int, f resampleFilter) *image.RGBA {
+	src := toRGBA(img)
+	b := src.Bounds()
+
+	if b.Dx() == width && b.Dy() == height {
+		return src
+	}
+
+	tmp := image.NewRGBA(image.Rect(0, 0, width, b.Dy()))
+	resamplePass(tmp, src, contributions(width, b.Dx(), f), true)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	resamplePass(dst, tmp, contributions(height, b.Dy(), f), false)
+
+	return dst
+}
+
+// resamplePass convolve src along one axis into dst, horizontally when horizontal is true.
+func resamplePass(dst, src *image.RGBA, cs []contribution, horizontal bool) {
+	db := dst.Bounds()
+
+	for y := 0; y < db.Dy(); y++ {
+		for x := 0; x < db.Dx(); x++ {
+			i := y
+			if horizontal {
+				i = x
+			}
+
+			c := cs[i]
+
+			var r, g, bl, a float64
+
+			for k, w := range c.weights {
+				var off int
+				if horizontal {
+					off = src.PixOffset(c.start+k, y)
+				} else {
+					off = src.PixOffset(x, c.start+k)
+				}
+
+				px := src.Pix[off : off+4 : off+4]
+				r += float64(px[0]) * w
+				g += float64(px[1]) * w
+				bl += float64(px[2]) * w
+				a += float64(px[3]) * w
+			}
+
+			alpha := clampUint8(a)
+			off := dst.PixOffset(x, y)
+			dst.Pix[off] = minUint8(clampUint8(r), alpha)
+			dst.Pix[off+1] = minUint8(clampUint8(g), alpha)
+			dst.Pix[off+2] = minUint8(clampUint8(bl), alpha)
+			dst.Pix[off+3] = alpha
+		}
+	}
+}
+
+func clampUint8(v float64) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	default:
+		return uint8(v + 0.5)
+	}
+}
+
+// minUint8 keep premultiplied color channels within alpha, negative lobes may overshoot it.
+func minUint8(v, max uint8) uint8 {
+	if v > max {
+		return max
+	}
+
+	return v
+}
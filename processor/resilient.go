@@ -0,0 +1,179 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 50 * time.Millisecond
+	defaultRetryMaxBackoff     = time.Second
+	defaultRetryBudget         = 10 * time.Second
+)
+
+// ErrCircuitOpen is returned without calling the processor while its circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// ResilientProcessor retry transient failures of a processor and guard it with a circuit breaker.
+type ResilientProcessor struct {
+	name    string
+	next    Processor
+	breaker *breaker // Nil when disabled.
+
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	budget         time.Duration
+}
+
+// NewResilient wrap given processor with retries and circuit breaker from conf, name identify it in logs.
+func NewResilient(name string, p Processor, conf config.Config) (*ResilientProcessor, error) {
+	maxAttempts := conf.Retry.MaxAttempts
+	switch {
+	case maxAttempts < 0:
+		return nil, fmt.Errorf("retry max attempts cannot be negative")
+	case maxAttempts == 0:
+		maxAttempts = defaultRetryMaxAttempts
+	}
+
+	initialBackoff, err := parseDuration(conf.Retry.InitialBackoff, defaultRetryInitialBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry initial backoff: %w", err)
+	}
+
+	maxBackoff, err := parseDuration(conf.Retry.MaxBackoff, defaultRetryMaxBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry max backoff: %w", err)
+	}
+
+	budget, err := parseDuration(conf.Retry.Budget, defaultRetryBudget)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry budget: %w", err)
+	}
+
+	rp := &ResilientProcessor{
+		name:           name,
+		next:           p,
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		budget:         budget,
+	}
+
+	if !conf.Breaker.Disabled {
+		if rp.breaker, err = newBreaker(name, conf.Breaker); err != nil {
+			return nil, err
+		}
+	}
+
+	return rp, nil
+}
+
+// State return the circuit breaker state, always closed when disabled.
+func (rp *ResilientProcessor) State() BreakerState {
+	if rp.breaker == nil {
+		return BreakerClosed
+	}
+
+	return rp.breaker.State()
+}
+
+// FetchesSource report whether wrapped processor download sources itself.
+func (rp *ResilientProcessor) FetchesSource() bool {
+	return FetchesSource(rp.next)
+}
+
+// Optimize call wrapped processor, retrying transient failures within the time budget.
+// It fails fast with ErrCircuitOpen while the breaker is open.
+func (rp *ResilientProcessor) Optimize(ctx context.Context, req Request) (Result, error) {
+	if rp.breaker != nil && !rp.breaker.allow() {
+		return Result{}, fmt.Errorf("%s: %w", rp.name, ErrCircuitOpen)
+	}
+
+	res, err := rp.retry(ctx, req)
+
+	if rp.breaker != nil {
+		rp.breaker.record(outcomeOf(ctx, err))
+	}
+
+	return res, err
+}
+
+func (rp *ResilientProcessor) retry(ctx context.Context, req Request) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, rp.budget)
+	defer cancel()
+
+	backoff := rp.initialBackoff
+
+	for attempt := 1; ; attempt++ {
+		res, err := rp.next.Optimize(ctx, req)
+		if err == nil || attempt >= rp.maxAttempts || !isRetryable(err) {
+			return res, err
+		}
+
+		// Equal jitter, keeping at least half of the backoff so that retries are still spaced out.
+		// #nosec G404 -- jitter needs no secure source.
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return res, err
+		}
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return res, err
+		case <-timer.C:
+		}
+
+		if backoff *= 2; backoff > rp.maxBackoff {
+			backoff = rp.maxBackoff
+		}
+	}
+}
+
+// isRetryable report whether err is a transient failure for which a new attempt is safe,
+// errors may implement Retryable() to decide, refused connections are always retried.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var r interface{ Retryable() bool }
+	if errors.As(err, &r) {
+		return r.Retryable()
+	}
+
+	// The request could not even be sent.
+	var op *net.OpError
+
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// outcomeOf classify a call result for the breaker, client cancellations and request errors are not
+// the processor fault.
+func outcomeOf(ctx context.Context, err error) breakerOutcome {
+	if err == nil {
+		return outcomeSuccess
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) || errors.Is(err, ErrInvalidSource) {
+		return outcomeIgnored
+	}
+
+	var se *StatusError
+	if errors.As(err, &se) && se.StatusCode < 500 {
+		return outcomeIgnored
+	}
+
+	return outcomeFailure
+}
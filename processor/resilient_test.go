@@ -0,0 +1,219 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+type funcProcessor func(ctx context.Context, req Request) (Result, error)
+
+func (f funcProcessor) Optimize(ctx context.Context, req Request) (Result, error) {
+	return f(ctx, req)
+}
+
+func newTestResilient(t *testing.T, p Processor, conf config.Config) *ResilientProcessor {
+	t.Helper()
+
+	if conf.Retry.InitialBackoff == "" {
+		conf.Retry.InitialBackoff = "1ms"
+	}
+
+	rp, err := NewResilient("test", p, conf)
+	if err != nil {
+		t.Fatalf("NewResilient() unexpected error: %v", err)
+	}
+
+	return rp
+}
+
+func TestNewResilient_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.Config
+	}{
+		{name: "should not accept negative attempts", conf: config.Config{Retry: config.RetryConfig{MaxAttempts: -1}}},
+		{name: "should not accept invalid backoff", conf: config.Config{Retry: config.RetryConfig{InitialBackoff: "x"}}},
+		{name: "should not accept invalid max backoff", conf: config.Config{Retry: config.RetryConfig{MaxBackoff: "0s"}}},
+		{name: "should not accept invalid budget", conf: config.Config{Retry: config.RetryConfig{Budget: "1"}}},
+		{name: "should not accept invalid breaker", conf: config.Config{Breaker: config.BreakerConfig{ErrorRate: 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewResilient("test", &NoneProcessor{}, tt.conf); err == nil {
+				t.Error("NewResilient() expected error")
+			}
+		})
+	}
+}
+
+func TestResilientProcessor_Retry(t *testing.T) {
+	var calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "image/webp")
+		_, _ = rw.Write([]byte("optimized"))
+	}))
+	defer srv.Close()
+
+	ip, err := NewImaginary(config.Config{Imaginary: config.ImaginaryProcessorConfig{URL: srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rp := newTestResilient(t, ip, config.Config{})
+
+	res, err := rp.Optimize(context.Background(), Request{Source: []byte("original"), Spec: Spec{TargetFormat: "image/webp"}})
+	if err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+
+	if string(res.Bytes) != "optimized" || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("Optimize() = %q after %d calls, want optimized after 3", res.Bytes, calls)
+	}
+}
+
+func TestResilientProcessor_RetryConnectionRefused(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	ip, err := NewImaginary(config.Config{Imaginary: config.ImaginaryProcessorConfig{URL: srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+
+	rp := newTestResilient(t, funcProcessor(func(ctx context.Context, req Request) (Result, error) {
+		atomic.AddInt32(&calls, 1)
+		return ip.Optimize(ctx, req)
+	}), config.Config{Retry: config.RetryConfig{MaxAttempts: 4}})
+
+	if _, err = rp.Optimize(context.Background(), Request{Spec: Spec{TargetFormat: "image/webp"}}); err == nil {
+		t.Fatal("Optimize() expected error")
+	}
+
+	if calls != 4 {
+		t.Errorf("refused connections must be retried, got %d calls, want 4", calls)
+	}
+}
+
+func TestResilientProcessor_NoRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "should not retry client errors", err: &StatusError{Service: "imaginary", StatusCode: http.StatusBadRequest}},
+		{name: "should not retry internal errors", err: &StatusError{Service: "imaginary", StatusCode: http.StatusInternalServerError}},
+		{name: "should not retry unknown errors", err: errors.New("boom")},
+		{name: "should not retry timeouts", err: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+
+			rp := newTestResilient(t, funcProcessor(func(_ context.Context, _ Request) (Result, error) {
+				calls++
+				return Result{}, tt.err
+			}), config.Config{})
+
+			if _, err := rp.Optimize(context.Background(), Request{}); !errors.Is(err, tt.err) {
+				t.Errorf("Optimize() error = %v, want %v", err, tt.err)
+			}
+
+			if calls != 1 {
+				t.Errorf("got %d calls, want 1", calls)
+			}
+		})
+	}
+}
+
+func TestResilientProcessor_Budget(t *testing.T) {
+	var calls int32
+
+	rp := newTestResilient(t, funcProcessor(func(_ context.Context, _ Request) (Result, error) {
+		atomic.AddInt32(&calls, 1)
+		return Result{}, &StatusError{Service: "imaginary", StatusCode: http.StatusBadGateway}
+	}), config.Config{Retry: config.RetryConfig{MaxAttempts: 100, InitialBackoff: "20ms", Budget: "50ms"}})
+
+	start := time.Now()
+
+	if _, err := rp.Optimize(context.Background(), Request{}); err == nil {
+		t.Fatal("Optimize() expected error")
+	}
+
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Optimize() took %s, must give up within its budget", elapsed)
+	}
+
+	if n := atomic.LoadInt32(&calls); n < 2 || n >= 100 {
+		t.Errorf("got %d calls, want retries bounded by the budget", n)
+	}
+}
+
+func TestResilientProcessor_Breaker(t *testing.T) {
+	var calls int
+
+	rp := newTestResilient(t, funcProcessor(func(_ context.Context, _ Request) (Result, error) {
+		calls++
+		return Result{}, errors.New("boom")
+	}), config.Config{Breaker: config.BreakerConfig{MinRequests: 2}})
+
+	for i := 0; i < 2; i++ {
+		_, _ = rp.Optimize(context.Background(), Request{})
+	}
+
+	if rp.State() != BreakerOpen {
+		t.Fatalf("State() = %s, want open", rp.State())
+	}
+
+	if _, err := rp.Optimize(context.Background(), Request{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Optimize() error = %v, want ErrCircuitOpen", err)
+	}
+
+	if calls != 2 {
+		t.Errorf("open breaker must not call the processor, got %d calls", calls)
+	}
+}
+
+func TestResilientProcessor_BreakerDisabled(t *testing.T) {
+	rp := newTestResilient(t, funcProcessor(func(_ context.Context, _ Request) (Result, error) {
+		return Result{}, errors.New("boom")
+	}), config.Config{Breaker: config.BreakerConfig{Disabled: true}})
+
+	for i := 0; i < 50; i++ {
+		if _, err := rp.Optimize(context.Background(), Request{}); errors.Is(err, ErrCircuitOpen) {
+			t.Fatal("disabled breaker must never open")
+		}
+	}
+
+	if rp.State() != BreakerClosed {
+		t.Errorf("State() = %s, want closed", rp.State())
+	}
+}
+
+func TestResilientProcessor_ClientCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rp := newTestResilient(t, funcProcessor(func(ctx context.Context, _ Request) (Result, error) {
+		return Result{}, ctx.Err()
+	}), config.Config{Breaker: config.BreakerConfig{MinRequests: 1}})
+
+	_, _ = rp.Optimize(ctx, Request{})
+
+	if rp.State() != BreakerClosed {
+		t.Errorf("State() = %s, client cancellations must not open the breaker", rp.State())
+	}
+}
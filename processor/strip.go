@@ -0,0 +1,194 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+const (
+	pngSignature = "\x89PNG\r\n\x1a\n"
+	iccProfileID = "ICC_PROFILE\x00"
+)
+
+// StripProcessor remove metadata from JPEG and PNG images without re-encoding them, pixel data
+// is kept bit-identical. Other formats are left untouched.
+type StripProcessor struct {
+	keepICC bool
+	next    Processor // Optional processor of the stripped image.
+}
+
+// NewStrip instantiate a new strip processor with given config, followed by the configured next processor if any.
+func NewStrip(conf config.Config) (*StripProcessor, error) {
+	sp := &StripProcessor{keepICC: conf.Strip.KeepICC}
+
+	if conf.Strip.Next == "" {
+		return sp, nil
+	}
+
+	if conf.Strip.Next == "strip" {
+		return nil, errors.New("strip processor cannot be followed by itself")
+	}
+
+	next := conf
+	next.Processor = conf.Strip.Next
+
+	// Pipelines cannot follow strip, no breaker is named from here.
+	p, err := New("", next)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create processor following strip: %w", err)
+	}
+
+	sp.next = p
+
+	return sp, nil
+}
+
+// Optimize strip metadata from given image, then hand it to the next processor if any.
+func (sp *StripProcessor) Optimize(ctx context.Context, req Request) (Result, error) {
+	stripped, err := sp.strip(req.Source)
+	if err != nil {
+		return Result{}, err
+	}
+
+	removed := strconv.Itoa(len(req.Source) - len(stripped))
+
+	if sp.next == nil {
+		return Result{
+			Bytes:    stripped,
+			Format:   req.Format,
+			Metadata: map[string]string{"processor": "strip", "stripped": removed},
+		}, nil
+	}
+
+	req.Source = stripped
+
+	res, err := sp.next.Optimize(ctx, req)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if res.Metadata == nil {
+		res.Metadata = map[string]string{}
+	}
+
+	res.Metadata["stripped"] = removed
+
+	return res, nil
+}
+
+func (sp *StripProcessor) strip(b []byte) ([]byte, error) {
+	switch {
+	case len(b) >= 2 && b[0] == 0xff && b[1] == markerSOI:
+		return stripJPEG(b, sp.keepICC)
+	case bytes.HasPrefix(b, []byte(pngSignature)):
+		return stripPNG(b, sp.keepICC)
+	default:
+		return b, nil
+	}
+}
+
+// stripJPEG drop APP1 (EXIF, XMP), APP13 (IPTC) and COM segments, and APP2 ICC profiles unless kept.
+// A non normal orientation is kept in a minimal EXIF segment so that the image still display upright.
+// Everything from the first scan is copied verbatim.
+func stripJPEG(b []byte, keepICC bool) ([]byte, error) {
+	out := make([]byte, 0, len(b))
+	out = append(out, b[:2]...)
+
+	exifSeen := false
+
+	data, err := scanJPEG(b, func(s markerSegment) bool {
+		if s.marker == markerAPP1 && !exifSeen && bytes.HasPrefix(s.payload, []byte(exifHeader)) {
+			exifSeen = true
+
+			if o := tiffOrientation(s.payload[len(exifHeader):]); o != orientationNormal {
+				payload := append(append([]byte{}, exifHeader...), orientationExif(o)...)
+				out = append(out, jpegSegment(markerAPP1, payload)...)
+			}
+
+			return true
+		}
+
+		if !dropJPEGSegment(s.marker, s.payload, keepICC) {
+			out = append(out, s.raw...)
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(out, b[data:]...), nil
+}
+
+func dropJPEGSegment(marker byte, payload []byte, keepICC bool) bool {
+	switch marker {
+	case markerAPP1, markerAPPD, markerCOM:
+		return true
+	case markerAPP2:
+		return !keepICC && bytes.HasPrefix(payload, []byte(iccProfileID))
+	default:
+		return false
+	}
+}
+
+// stripPNG drop textual and EXIF chunks, and the iCCP profile unless kept. Chunks after IEND are dropped.
+// A non normal orientation is kept in a minimal eXIf chunk.
+func stripPNG(b []byte, keepICC bool) ([]byte, error) {
+	out := make([]byte, 0, len(b))
+	out = append(out, pngSignature...)
+
+	for i := len(pngSignature); i < len(b); {
+		if i+12 > len(b) {
+			return nil, fmt.Errorf("%w: truncated png chunk", ErrInvalidSource)
+		}
+
+		length := binary.BigEndian.Uint32(b[i:])
+		if uint64(length) > uint64(len(b)-i-12) {
+			return nil, fmt.Errorf("%w: invalid png chunk length at offset %d", ErrInvalidSource, i)
+		}
+
+		end := i + 12 + int(length)
+		typ := string(b[i+4 : i+8])
+
+		switch typ {
+		case "eXIf":
+			if o := tiffOrientation(b[i+8 : end-4]); o != orientationNormal {
+				out = append(out, pngChunk("eXIf", orientationExif(o))...)
+			}
+		case "tEXt", "zTXt", "iTXt":
+		case "iCCP":
+			if keepICC {
+				out = append(out, b[i:end]...)
+			}
+		case "IEND":
+			return append(out, b[i:end]...), nil
+		default:
+			out = append(out, b[i:end]...)
+		}
+
+		i = end
+	}
+
+	return nil, fmt.Errorf("%w: png without IEND chunk", ErrInvalidSource)
+}
+
+// pngChunk build a chunk of given type and data.
+func pngChunk(typ string, data []byte) []byte {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, data...)
+
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+
+	return append(chunk, crc...)
+}
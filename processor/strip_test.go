@@ -0,0 +1,175 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+func insertAt(b []byte, at int, parts ...[]byte) []byte {
+	out := append([]byte{}, b[:at]...)
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+
+	return append(out, b[at:]...)
+}
+
+func TestStripProcessor_JPEG(t *testing.T) {
+	original := encodeTestImage(t, testImage(16, 16), "image/jpeg")
+	icc := jpegSegment(markerAPP2, append(append([]byte{}, iccProfileID...), "\x01\x01profile"...))
+
+	// Go encoder writes no application segment, SOI is directly followed by tables.
+	source := insertAt(original, 2,
+		jpegSegment(0xe0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")),
+		jpegSegment(markerAPP1, []byte("Exif\x00\x00gps coordinates")),
+		jpegSegment(markerAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")),
+		icc,
+		jpegSegment(markerAPPD, []byte("Photoshop 3.0\x00iptc")),
+		[]byte{0xff, 0xff}, // Fill bytes.
+		jpegSegment(markerCOM, []byte("a comment")),
+	)
+
+	jfif := jpegSegment(0xe0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+
+	tests := []struct {
+		name    string
+		keepICC bool
+		want    []byte
+	}{
+		{name: "should drop metadata and color profile", want: insertAt(original, 2, jfif)},
+		{name: "should keep color profile", keepICC: true, want: insertAt(original, 2, jfif, icc)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp, err := NewStrip(config.Config{Strip: config.StripProcessorConfig{KeepICC: tt.keepICC}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := sp.Optimize(context.Background(), Request{Source: source, Format: "image/jpeg"})
+			if err != nil {
+				t.Fatalf("Optimize() unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(got.Bytes, tt.want) {
+				t.Errorf("Optimize() = %d bytes, want %d bytes", len(got.Bytes), len(tt.want))
+			}
+
+			if got.Format != "image/jpeg" || got.Metadata["processor"] != "strip" {
+				t.Errorf("Optimize() format = %s, metadata = %v", got.Format, got.Metadata)
+			}
+		})
+	}
+}
+
+func TestStripProcessor_PNG(t *testing.T) {
+	original := encodeTestImage(t, testImage(16, 16), "image/png")
+	// Signature then IHDR chunk of 13 bytes.
+	afterIHDR := len(pngSignature) + 12 + 13
+	iccp := pngChunk("iCCP", []byte("profile\x00\x00data"))
+
+	source := insertAt(original, afterIHDR,
+		pngChunk("tEXt", []byte("Author\x00someone")),
+		pngChunk("zTXt", []byte("Comment\x00\x00data")),
+		pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>")),
+		pngChunk("eXIf", []byte("MM\x00\x2a")),
+		iccp,
+	)
+	source = append(source, []byte("trailing garbage")...)
+
+	tests := []struct {
+		name    string
+		keepICC bool
+		want    []byte
+	}{
+		{name: "should drop metadata and color profile", want: original},
+		{name: "should keep color profile", keepICC: true, want: insertAt(original, afterIHDR, iccp)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := &StripProcessor{keepICC: tt.keepICC}
+
+			got, err := sp.Optimize(context.Background(), Request{Source: source, Format: "image/png"})
+			if err != nil {
+				t.Fatalf("Optimize() unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(got.Bytes, tt.want) {
+				t.Errorf("Optimize() = %d bytes, want %d bytes", len(got.Bytes), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestStripProcessor_Invalid(t *testing.T) {
+	jpg := encodeTestImage(t, testImage(16, 16), "image/jpeg")
+	png := encodeTestImage(t, testImage(16, 16), "image/png")
+
+	tests := []struct {
+		name   string
+		source []byte
+	}{
+		{name: "should not accept truncated jpeg segment", source: jpg[:5]},
+		{name: "should not accept jpeg segment overflowing", source: []byte{0xff, 0xd8, 0xff, 0xe1, 0xff, 0xff, 0}},
+		{name: "should not accept jpeg garbage between segments", source: []byte{0xff, 0xd8, 0x00}},
+		{name: "should not accept jpeg without scan", source: jpg[:2]},
+		{name: "should not accept png without IEND", source: png[:len(png)-12]},
+		{name: "should not accept png chunk overflowing", source: append(append([]byte{}, pngSignature...), 0xff, 0xff, 0xff, 0xff, 'I', 'H', 'D', 'R', 0, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := (&StripProcessor{}).Optimize(context.Background(), Request{Source: tt.source})
+			if !errors.Is(err, ErrInvalidSource) {
+				t.Errorf("Optimize() error = %v, want %v", err, ErrInvalidSource)
+			}
+		})
+	}
+}
+
+func TestStripProcessor_UnsupportedFormat(t *testing.T) {
+	source := encodeTestImage(t, testImage(16, 16), "image/gif")
+
+	got, err := (&StripProcessor{}).Optimize(context.Background(), Request{Source: source, Format: "image/gif"})
+	if err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(got.Bytes, source) || got.Format != "image/gif" {
+		t.Error("Optimize() must keep unsupported formats untouched")
+	}
+}
+
+func TestStripProcessor_Next(t *testing.T) {
+	original := encodeTestImage(t, testImage(16, 16), "image/jpeg")
+	source := insertAt(original, 2, jpegSegment(markerAPP1, []byte("Exif\x00\x00gps coordinates")))
+
+	sp, err := NewStrip(config.Config{Strip: config.StripProcessorConfig{Next: "none"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := sp.Optimize(context.Background(), Request{Source: source, Format: "image/jpeg"})
+	if err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(got.Bytes, original) {
+		t.Error("next processor must be given the stripped image")
+	}
+
+	if got.Metadata["processor"] != "none" || got.Metadata["stripped"] != "25" {
+		t.Errorf("Optimize() metadata = %v", got.Metadata)
+	}
+}
+
+func TestNewStrip_InvalidNext(t *testing.T) {
+	for _, next := range []string{"strip", "unsupported"} {
+		if _, err := NewStrip(config.Config{Strip: config.StripProcessorConfig{Next: next}}); err == nil {
+			t.Errorf("NewStrip() expected error with next processor %q", next)
+		}
+	}
+}
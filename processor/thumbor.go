@@ -0,0 +1,163 @@
+package processor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1" // #nosec G505 -- imposed by thumbor URL signature.
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+// thumborFormat return the thumbor format filter value of given output MIME type.
+func thumborFormat(format string) (string, bool) {
+	switch format {
+	case FormatWebP, FormatAVIF, FormatJPEG, FormatPNG, FormatGIF:
+		return strings.TrimPrefix(format, "image/"), true
+	default:
+		return "", false
+	}
+}
+
+// ThumborProcessor process images with thumbor, which fetch sources itself from an URL derived from the request.
+type ThumborProcessor struct {
+	client http.Client
+	url    string
+	key    []byte
+
+	source           string
+	smart            bool
+	maxResponseBytes int64
+}
+
+// NewThumbor instantiate a new thumbor processor with given config.
+func NewThumbor(conf config.Config) (*ThumborProcessor, error) {
+	c := conf.Thumbor
+
+	u, err := url.ParseRequestURI(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid thumbor url %q", c.URL)
+	}
+
+	if c.Source == "" {
+		return nil, errors.New("thumbor source template cannot be empty")
+	}
+
+	timeout, err := parseDuration(c.Timeout, httpTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid thumbor timeout: %w", err)
+	}
+
+	maxResponseBytes, err := responseLimit("thumbor max response bytes", c.MaxResponseBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ThumborProcessor{
+		client:           http.Client{Timeout: timeout},
+		url:              strings.TrimSuffix(c.URL, "/"),
+		key:              []byte(c.Key),
+		source:           c.Source,
+		smart:            c.Smart,
+		maxResponseBytes: maxResponseBytes,
+	}, nil
+}
+
+// sourceURL expand the source template with given request URI.
+func (tp *ThumborProcessor) sourceURL(uri string) string {
+	path, query := uri, ""
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		path, query = uri[:i], uri[i+1:]
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+		uri = "/" + uri
+	}
+
+	return strings.NewReplacer("{uri}", uri, "{path}", path, "{query}", query).Replace(tp.source)
+}
+
+// operationPath build thumbor path of given request, without signature nor leading slash.
+func (tp *ThumborProcessor) operationPath(r Request) (string, string, error) {
+	tf := mimeType(r.Spec.TargetFormat)
+	if tf == "" {
+		tf = mimeType(r.Format)
+	}
+
+	format, ok := thumborFormat(tf)
+	if !ok {
+		return "", "", fmt.Errorf("unsupported thumbor target format %q", tf)
+	}
+
+	if r.Path == "" {
+		return "", "", errors.New("thumbor requires the request path to derive the source url")
+	}
+
+	var parts []string
+
+	if r.Spec.Width > 0 || r.Spec.Height > 0 {
+		parts = append(parts, "fit-in", fmt.Sprintf("%dx%d", r.Spec.Width, r.Spec.Height))
+	}
+
+	if tp.smart {
+		parts = append(parts, "smart")
+	}
+
+	filters := "filters:format(" + format + ")"
+	if r.Spec.Quality > 0 {
+		filters += ":quality(" + strconv.Itoa(r.Spec.Quality) + ")"
+	}
+
+	// Escaping keep the source query string out of thumbor request query.
+	source := (&url.URL{Path: tp.sourceURL(r.Path)}).EscapedPath()
+
+	return strings.Join(append(parts, filters, source), "/"), tf, nil
+}
+
+// sign return the signature segment of given operation path, "unsafe" without key.
+func (tp *ThumborProcessor) sign(path string) string {
+	if len(tp.key) == 0 {
+		return "unsafe"
+	}
+
+	mac := hmac.New(sha1.New, tp.key)
+	_, _ = mac.Write([]byte(path))
+
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// FetchesSource report that thumbor always download sources itself.
+func (tp *ThumborProcessor) FetchesSource() bool {
+	return true
+}
+
+// Optimize process image with thumbor, which fetch the source from the configured source URL.
+func (tp *ThumborProcessor) Optimize(ctx context.Context, r Request) (Result, error) {
+	path, tf, err := tp.operationPath(r)
+	if err != nil {
+		return Result{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tp.url+"/"+tp.sign(path)+"/"+path, nil)
+	if err != nil {
+		return Result{}, fmt.Errorf("unable to create thumbor request: %w", err)
+	}
+
+	body, _, err := fetchImage(&tp.client, req, "thumbor", tf, tp.maxResponseBytes)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Bytes:    body,
+		Format:   tf,
+		Metadata: map[string]string{"processor": "thumbor"},
+	}, nil
+}
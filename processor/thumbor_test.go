@@ -0,0 +1,174 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/agravelot/imageopti/config"
+)
+
+func newTestThumbor(t *testing.T, handler http.HandlerFunc, conf config.ThumborProcessorConfig) *ThumborProcessor {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	conf.URL = srv.URL
+	if conf.Source == "" {
+		conf.Source = "http://backend:8080{uri}"
+	}
+
+	p, err := NewThumbor(config.Config{Thumbor: conf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestNewThumbor_InvalidConfig(t *testing.T) {
+	valid := config.ThumborProcessorConfig{URL: "http://thumbor", Source: "http://backend{uri}"}
+
+	tests := []struct {
+		name   string
+		mutate func(c *config.ThumborProcessorConfig)
+	}{
+		{name: "should not accept missing url", mutate: func(c *config.ThumborProcessorConfig) { c.URL = "" }},
+		{name: "should not accept non http url", mutate: func(c *config.ThumborProcessorConfig) { c.URL = "ftp://thumbor" }},
+		{name: "should not accept missing source", mutate: func(c *config.ThumborProcessorConfig) { c.Source = "" }},
+		{name: "should not accept invalid timeout", mutate: func(c *config.ThumborProcessorConfig) { c.Timeout = "1" }},
+		{name: "should not accept negative response limit", mutate: func(c *config.ThumborProcessorConfig) { c.MaxResponseBytes = -1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.mutate(&c)
+
+			if _, err := NewThumbor(config.Config{Thumbor: c}); err == nil {
+				t.Error("NewThumbor() expected error")
+			}
+		})
+	}
+}
+
+func TestThumborProcessor_SourceURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		uri    string
+		want   string
+	}{
+		{name: "should expand uri", source: "http://backend{uri}", uri: "/a/b.jpg?w=1", want: "http://backend/a/b.jpg?w=1"},
+		{name: "should expand path", source: "http://backend{path}", uri: "/a/b.jpg?w=1", want: "http://backend/a/b.jpg"},
+		{name: "should expand query", source: "backend/img{path}?{query}", uri: "/b.jpg?w=1", want: "backend/img/b.jpg?w=1"},
+		{name: "should add leading slash", source: "http://backend{uri}", uri: "b.jpg", want: "http://backend/b.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (&ThumborProcessor{source: tt.source}).sourceURL(tt.uri); got != tt.want {
+				t.Errorf("sourceURL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThumborProcessor_Sign(t *testing.T) {
+	path := "fit-in/300x200/smart/filters:format(webp):quality(80)/http://backend:8080/images/photo.jpg%3Fw=300"
+
+	if got := (&ThumborProcessor{key: []byte("MY_SECURE_KEY")}).sign(path); got != "k4TxLqtwXWByZKtw0so_6f5HqrM=" {
+		t.Errorf("sign() = %s, want k4TxLqtwXWByZKtw0so_6f5HqrM=", got)
+	}
+
+	if got := (&ThumborProcessor{}).sign(path); got != "unsafe" {
+		t.Errorf("sign() without key = %s, want unsafe", got)
+	}
+}
+
+func TestThumborProcessor_Optimize(t *testing.T) {
+	p := newTestThumbor(t, func(rw http.ResponseWriter, req *http.Request) {
+		want := "/k4TxLqtwXWByZKtw0so_6f5HqrM=/fit-in/300x200/smart/filters:format(webp):quality(80)/http://backend:8080/images/photo.jpg%3Fw=300"
+		if got := req.URL.EscapedPath(); got != want {
+			t.Errorf("thumbor path = %s, want %s", got, want)
+		}
+
+		rw.Header().Set("Content-Type", "image/webp")
+		_, _ = rw.Write([]byte("optimized"))
+	}, config.ThumborProcessorConfig{Key: "MY_SECURE_KEY", Smart: true})
+
+	got, err := p.Optimize(context.Background(), Request{
+		Source: []byte("original"),
+		Format: "image/jpeg",
+		Path:   "/images/photo.jpg?w=300",
+		Spec:   Spec{TargetFormat: "image/webp", Quality: 80, Width: 300, Height: 200},
+	})
+	if err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+
+	if string(got.Bytes) != "optimized" || got.Format != "image/webp" || got.Metadata["processor"] != "thumbor" {
+		t.Errorf("Optimize() = %s %s %v", got.Bytes, got.Format, got.Metadata)
+	}
+}
+
+func TestThumborProcessor_OptimizeDefaults(t *testing.T) {
+	p := newTestThumbor(t, func(rw http.ResponseWriter, req *http.Request) {
+		if want := "/unsafe/fit-in/300x0/filters:format(png)/http://backend:8080/photo.png"; req.URL.EscapedPath() != want {
+			t.Errorf("thumbor path = %s, want %s", req.URL.EscapedPath(), want)
+		}
+
+		rw.Header().Set("Content-Type", "image/png")
+		_, _ = rw.Write([]byte("optimized"))
+	}, config.ThumborProcessorConfig{})
+
+	if _, err := p.Optimize(context.Background(), Request{Format: "image/png", Path: "/photo.png", Spec: Spec{Width: 300}}); err != nil {
+		t.Fatalf("Optimize() unexpected error: %v", err)
+	}
+}
+
+func TestThumborProcessor_OptimizeErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		contentType   string
+		request       Request
+		wantStatus    int
+		wantRetryable bool
+	}{
+		{name: "should return status error", status: http.StatusBadRequest, contentType: "text/plain", wantStatus: 400},
+		{name: "should return retryable status error", status: http.StatusBadGateway, contentType: "text/plain", wantStatus: 502, wantRetryable: true},
+		{name: "should not accept unexpected content type", status: http.StatusOK, contentType: "image/jpeg"},
+		{name: "should not accept unsupported target format", request: Request{Path: "/a", Spec: Spec{TargetFormat: "image/bmp"}}},
+		{name: "should not accept request without path", request: Request{Spec: Spec{TargetFormat: "image/webp"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestThumbor(t, func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", tt.contentType)
+				rw.WriteHeader(tt.status)
+				_, _ = rw.Write([]byte("Bad request"))
+			}, config.ThumborProcessorConfig{})
+
+			r := tt.request
+			if r.Path == "" && r.Spec.TargetFormat == "" {
+				r = Request{Path: "/photo.jpg", Spec: Spec{TargetFormat: "image/webp"}}
+			}
+
+			_, err := p.Optimize(context.Background(), r)
+			if err == nil {
+				t.Fatal("Optimize() expected error")
+			}
+
+			var se *StatusError
+			if errors.As(err, &se) != (tt.wantStatus != 0) {
+				t.Fatalf("Optimize() error = %v, want status %d", err, tt.wantStatus)
+			}
+
+			if se != nil && (se.StatusCode != tt.wantStatus || se.Retryable() != tt.wantRetryable || se.Message != "Bad request") {
+				t.Errorf("Optimize() error = %+v, want status %d retryable %v", se, tt.wantStatus, tt.wantRetryable)
+			}
+		})
+	}
+}
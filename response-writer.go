@@ -5,27 +5,73 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"strconv"
 )
 
+// maxPreallocatedBody bound the buffer allocated ahead from an announced Content-Length.
+const maxPreallocatedBody = 64 << 20
+
 type responseWriter struct {
 	buffer       bytes.Buffer
 	bypassHeader bool
 	wroteHeader  bool // Control when to write header
 
+	// maxBuffered is the largest buffered body, larger ones are streamed through, zero means unlimited.
+	maxBuffered int64
+	passThrough bool
+	statusCode  int
+
 	http.ResponseWriter
 }
 
 func (r *responseWriter) WriteHeader(statusCode int) {
 	if !r.bypassHeader {
 		r.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	// Kept for pass-through, only the first one matters.
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
 	}
 }
 
+// status return the upstream status code, an implicit 200 when none was written.
+func (r *responseWriter) status() int {
+	if r.statusCode == 0 {
+		return http.StatusOK
+	}
+
+	return r.statusCode
+}
+
 func (r *responseWriter) Write(p []byte) (int, error) {
+	if r.passThrough {
+		return r.writeThrough(p)
+	}
+
 	if !r.wroteHeader {
 		r.WriteHeader(http.StatusOK)
 	}
 
+	if r.buffer.Cap() == 0 {
+		n, err := strconv.ParseInt(r.Header().Get(contentLength), 10, 64)
+
+		switch {
+		case err != nil || n <= 0:
+		case r.maxBuffered > 0 && n > r.maxBuffered:
+			// Too large to be processed, do not even start buffering.
+			return r.startPassThrough(p)
+		case n <= maxPreallocatedBody:
+			// Size the buffer once rather than growing it on each write.
+			r.buffer.Grow(int(n))
+		}
+	}
+
+	if r.maxBuffered > 0 && int64(r.buffer.Len()+len(p)) > r.maxBuffered {
+		return r.startPassThrough(p)
+	}
+
 	i, err := r.buffer.Write(p)
 	if err != nil {
 		return i, fmt.Errorf("unable to write response body: %w", err)
@@ -34,6 +80,33 @@ func (r *responseWriter) Write(p []byte) (int, error) {
 	return i, nil
 }
 
+// startPassThrough write headers, what was buffered so far and given bytes to the client,
+// following writes are no longer buffered.
+func (r *responseWriter) startPassThrough(p []byte) (int, error) {
+	r.passThrough = true
+
+	r.ResponseWriter.WriteHeader(r.status())
+
+	if r.buffer.Len() > 0 {
+		if _, err := r.ResponseWriter.Write(r.buffer.Bytes()); err != nil {
+			return 0, fmt.Errorf("unable to write buffered response body: %w", err)
+		}
+	}
+
+	r.buffer = bytes.Buffer{}
+
+	return r.writeThrough(p)
+}
+
+func (r *responseWriter) writeThrough(p []byte) (int, error) {
+	i, err := r.ResponseWriter.Write(p)
+	if err != nil {
+		return i, fmt.Errorf("unable to write response body: %w", err)
+	}
+
+	return i, nil
+}
+
 func (r *responseWriter) Flush() {
 	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
 		flusher.Flush()
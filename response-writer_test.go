@@ -0,0 +1,65 @@
+package imageopti
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestResponseWriter_PassThrough(t *testing.T) {
+	tests := []struct {
+		name            string
+		contentLength   int
+		writes          []string
+		wantPassThrough bool
+	}{
+		{name: "should buffer body within limit", contentLength: 8, writes: []string{"abcd", "efgh"}},
+		{name: "should buffer body without length within limit", writes: []string{"abcd", "efgh"}},
+		{name: "should stream body announced larger than limit", contentLength: 12, writes: []string{"abcdef", "ghijkl"}, wantPassThrough: true},
+		{name: "should stream body growing larger than limit", writes: []string{"abcdef", "ghijkl"}, wantPassThrough: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			rw := &responseWriter{ResponseWriter: recorder, bypassHeader: true, maxBuffered: 10}
+
+			if tt.contentLength > 0 {
+				rw.Header().Set(contentLength, strconv.Itoa(tt.contentLength))
+			}
+
+			rw.WriteHeader(http.StatusPartialContent)
+
+			var body []byte
+
+			for _, w := range tt.writes {
+				if _, err := rw.Write([]byte(w)); err != nil {
+					t.Fatalf("Write() unexpected error: %v", err)
+				}
+
+				body = append(body, w...)
+			}
+
+			if rw.passThrough != tt.wantPassThrough {
+				t.Fatalf("passThrough = %v, want %v", rw.passThrough, tt.wantPassThrough)
+			}
+
+			if !tt.wantPassThrough {
+				if !bytes.Equal(rw.buffer.Bytes(), body) || recorder.Body.Len() != 0 {
+					t.Errorf("buffer = %q, client body = %q, want everything buffered", rw.buffer.Bytes(), recorder.Body.Bytes())
+				}
+
+				return
+			}
+
+			if !bytes.Equal(recorder.Body.Bytes(), body) || rw.buffer.Len() != 0 {
+				t.Errorf("client body = %q, buffer = %q, want everything streamed", recorder.Body.Bytes(), rw.buffer.Bytes())
+			}
+
+			if recorder.Code != http.StatusPartialContent {
+				t.Errorf("status = %d, want upstream status %d", recorder.Code, http.StatusPartialContent)
+			}
+		})
+	}
+}